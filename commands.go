@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/prefetch"
+	"github.com/willie68/go_mapproxy/internal/tilecache"
+)
+
+type prefetchConfig interface {
+	GetPrefetchConfig() prefetch.Config
+}
+
+// runCommand runs the command given by the arguments and exits, if there is no command it simply returns
+func runCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch {
+	case len(args) >= 2 && args[0] == "cache" && args[1] == "verify":
+		os.Exit(cacheVerify())
+	case len(args) == 4 && args[0] == "cache" && args[1] == "export":
+		os.Exit(cacheExport(args[2], args[3]))
+	case len(args) == 4 && args[0] == "cache" && args[1] == "import":
+		os.Exit(cacheImport(args[2], args[3]))
+	case len(args) == 1 && args[0] == "seed":
+		os.Exit(seed())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %v\r\n\r\n", args)
+		showUsage()
+		os.Exit(1)
+	}
+}
+
+// cacheVerify verifies the cache and writes the report as json, exit code is 1 if there are unrepaired problems
+func cacheVerify() int {
+	internal.InitCache(inj)
+	cache := do.MustInvoke[*tilecache.Cache](inj)
+	defer cache.Close()
+	if !cache.IsActive() {
+		fmt.Fprintln(os.Stderr, "cache is not active")
+		return 1
+	}
+	report, err := cache.Verify(repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error verifying cache: %v\r\n", err)
+		return 1
+	}
+	if err := writeReport(report); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\r\n", err)
+		return 1
+	}
+	if !report.OK() && !report.Repaired {
+		return 1
+	}
+	return 0
+}
+
+// cacheExport exports the cached tiles of the provider into a MBTiles file and writes the result as json
+func cacheExport(providerName, file string) int {
+	f, err := tileFilter(providerName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\r\n", err)
+		return 1
+	}
+	internal.InitCache(inj)
+	cache := do.MustInvoke[*tilecache.Cache](inj)
+	defer cache.Close()
+	if !cache.IsActive() {
+		fmt.Fprintln(os.Stderr, "cache is not active")
+		return 1
+	}
+	res, err := cache.Export(file, "", f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error exporting cache: %v\r\n", err)
+		return 1
+	}
+	if err := writeReport(res); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\r\n", err)
+		return 1
+	}
+	return 0
+}
+
+// cacheImport imports a MBTiles file or a z/x/y tile directory into the cache of the provider and writes the result as json
+func cacheImport(providerName, source string) int {
+	f, err := tileFilter(providerName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\r\n", err)
+		return 1
+	}
+	internal.InitCache(inj)
+	cache := do.MustInvoke[*tilecache.Cache](inj)
+	defer cache.Close()
+	if !cache.IsActive() {
+		fmt.Fprintln(os.Stderr, "cache is not active")
+		return 1
+	}
+	res, err := cache.Import(source, providerName, tilecache.ImportOptions{
+		Filter: f,
+		TMS:    tms,
+		Progress: func(res tilecache.ImportResult) {
+			fmt.Fprintf(os.Stderr, "imported %d of %d tiles, skipped: %d, failed: %d\r\n", res.Imported, res.Total, res.Skipped, res.Failed)
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error importing into the cache: %v\r\n", err)
+		return 1
+	}
+	if err := writeReport(res); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\r\n", err)
+		return 1
+	}
+	return 0
+}
+
+// prefetchEstimate estimates the prefetch job (dry run) and writes the estimation as json
+func prefetchEstimate(job prefetch.Job) int {
+	defer internal.Stop(inj)
+	m := do.MustInvoke[*prefetch.Manager](inj)
+	e, err := m.Estimate(job)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error estimating prefetch: %v\r\n", err)
+		return 1
+	}
+	if err := writeReport(e); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\r\n", err)
+		return 1
+	}
+	return 0
+}
+
+// seed runs the prefetch job of the command line, or the jobs of the config, one after the other
+// without the http servers. The progress is written to stderr, the result as json report. The exit
+// code is 1 if a job isn't finished or more tiles failed than allowed by --max-failed.
+func seed() int {
+	limit, err := parseMaxFailed(maxFailed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\r\n", err)
+		return 1
+	}
+	internal.InitSeed(inj)
+	defer internal.Stop(inj)
+	m := do.MustInvoke[*prefetch.Manager](inj)
+
+	jobs := []prefetch.Job{cmdJob()}
+	if pfProviders == "" {
+		jobs = do.MustInvokeAs[prefetchConfig](inj).GetPrefetchConfig().Jobs
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintln(os.Stderr, "nothing to seed, give a provider with -s or define prefetch jobs in the config")
+		return 1
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	defer signal.Stop(c)
+
+	res := make([]prefetch.JobStatus, 0, len(jobs))
+	exit := 0
+	for _, job := range jobs {
+		s, err := m.Start(job)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't start prefetch for %s: %v\r\n", job.String(), err)
+			return 1
+		}
+		s = waitSeed(m, s.ID, c)
+		res = append(res, s)
+		fmt.Fprintf(os.Stderr, "%s: %s %d fetched, %d skipped, %d failed, %d bytes in %s\r\n", s.ID, s.State, s.Done, s.Skipped, s.Failed, s.Bytes, s.Finished.Sub(s.Started).Round(time.Second))
+		if code, reason := limit.exitCode(s); code != 0 {
+			fmt.Fprintf(os.Stderr, "%s: %s\r\n", s.ID, reason)
+			exit = code
+			if s.State != prefetch.StateFinished {
+				break
+			}
+		}
+	}
+	// the reported jobs aren't kept in the store
+	for _, s := range res {
+		_, _ = m.Cancel(s.ID)
+	}
+	if err := writeReport(res); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing report: %v\r\n", err)
+		return 1
+	}
+	return exit
+}
+
+// waitSeed waits until the job is done and writes the progress every few seconds, an interrupt cancels the job
+func waitSeed(m *prefetch.Manager, id string, interrupt chan os.Signal) prefetch.JobStatus {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	written := time.Now()
+	for {
+		select {
+		case <-interrupt:
+			fmt.Fprintf(os.Stderr, "%s: cancelled\r\n", id)
+			_, _ = m.Cancel(id)
+		case <-ticker.C:
+		}
+		s, err := m.Job(id)
+		if err != nil || (s.State != prefetch.StateRunning && s.State != prefetch.StatePaused) {
+			return s
+		}
+		if time.Since(written) >= 5*time.Second {
+			fmt.Fprintf(os.Stderr, "%s: %s\r\n", id, progressBar(s))
+			written = time.Now()
+		}
+	}
+}
+
+// progressBar the progress of the job as text bar with the counters and the eta
+func progressBar(s prefetch.JobStatus) string {
+	const width = 30
+	n := 0
+	pc := 0.0
+	if s.Total > 0 {
+		n = s.Processed() * width / s.Total
+		pc = float64(s.Processed()) * 100 / float64(s.Total)
+	}
+	bar := strings.Repeat("=", n) + strings.Repeat(" ", width-n)
+	line := fmt.Sprintf("[%s] %5.1f%% %d/%d tiles, %d fetched, %d skipped, %d failed", bar, pc, s.Processed(), s.Total, s.Done, s.Skipped, s.Failed)
+	if !s.ETA.IsZero() {
+		line += fmt.Sprintf(", eta %s", s.ETA.Format(time.TimeOnly))
+	}
+	return line
+}
+
+// failLimit the allowed failed tiles of a seeded job, a number of tiles or a percentage of all tiles
+type failLimit struct {
+	src     string
+	n       int
+	percent bool
+}
+
+// parseMaxFailed parses the allowed failed tiles, a number of tiles or a percentage like 1%
+func parseMaxFailed(s string) (failLimit, error) {
+	v, percent := strings.CutSuffix(strings.TrimSpace(s), "%")
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || (percent && n > 100) {
+		return failLimit{}, fmt.Errorf("invalid max failed tiles: %s", s)
+	}
+	return failLimit{src: s, n: n, percent: percent}, nil
+}
+
+// allowed the number of failed tiles allowed of total tiles, a percentage is rounded down
+func (l failLimit) allowed(total int) int {
+	if l.percent {
+		return total * l.n / 100
+	}
+	return l.n
+}
+
+// exitCode the exit code of the seeded job, 1 with the reason if the job isn't finished or more
+// tiles failed than allowed
+func (l failLimit) exitCode(s prefetch.JobStatus) (int, string) {
+	if s.State != prefetch.StateFinished {
+		return 1, fmt.Sprintf("job is %s", s.State)
+	}
+	if s.Failed > l.allowed(s.Total) {
+		return 1, fmt.Sprintf("%d tiles failed, only %s allowed", s.Failed, l.src)
+	}
+	return 0, ""
+}
+
+// cmdJob the prefetch job given by the command line options, the files are relative to the working
+// directory, not to the prefetch files directory
+func cmdJob() prefetch.Job {
+	return prefetch.Job{
+		Providers: pfProviders,
+		MinZoom:   minZoom,
+		MaxZoom:   pfZoom,
+		BBox:      bbox,
+		AreaFile:  absFile(areaFile),
+		Route:     absFile(route),
+		Buffer:    buffer,
+	}
+}
+
+func absFile(file string) string {
+	if file == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return file
+	}
+	return abs
+}
+
+// tileFilter the tile filter of the provider given by the command line options
+func tileFilter(providerName string) (tilecache.TileFilter, error) {
+	f := tilecache.TileFilter{
+		Provider: providerName,
+		MinZoom:  minZoom,
+		MaxZoom:  maxZoom,
+	}
+	if bbox != "" {
+		bb, err := mercantile.ParseBbox(bbox)
+		if err != nil {
+			return f, err
+		}
+		f.BBox = &bb
+	}
+	return f, nil
+}
+
+// writeReport writes the report as json into the report file or to stdout
+func writeReport(report any) error {
+	js, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if reportFile == "" {
+		fmt.Println(string(js))
+		return nil
+	}
+	return os.WriteFile(reportFile, js, 0o644)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/prefetch"
+)
+
+func TestParseMaxFailed(t *testing.T) {
+	ast := assert.New(t)
+	for _, tc := range []struct {
+		src     string
+		n       int
+		percent bool
+	}{
+		{"0", 0, false},
+		{"5", 5, false},
+		{" 12 ", 12, false},
+		{"1%", 1, true},
+		{"0%", 0, true},
+		{"100%", 100, true},
+	} {
+		l, err := parseMaxFailed(tc.src)
+		ast.NoError(err, tc.src)
+		ast.Equal(tc.n, l.n, tc.src)
+		ast.Equal(tc.percent, l.percent, tc.src)
+	}
+
+	for _, src := range []string{"", "x", "-1", "101%", "-1%", "1.5", "5%%", "%"} {
+		_, err := parseMaxFailed(src)
+		ast.Error(err, src)
+	}
+}
+
+func TestSeedExitCode(t *testing.T) {
+	ast := assert.New(t)
+	status := func(state string, total, failed int) prefetch.JobStatus {
+		s := prefetch.JobStatus{State: state, Total: total}
+		s.Failed = failed
+		return s
+	}
+	for _, tc := range []struct {
+		max  string
+		s    prefetch.JobStatus
+		code int
+	}{
+		{"0", status(prefetch.StateFinished, 100, 0), 0},
+		{"0", status(prefetch.StateFinished, 100, 1), 1},
+		{"5", status(prefetch.StateFinished, 100, 5), 0},
+		{"5", status(prefetch.StateFinished, 100, 6), 1},
+		{"1%", status(prefetch.StateFinished, 1000, 10), 0},
+		{"1%", status(prefetch.StateFinished, 1000, 11), 1},
+		// rounded down, no failed tile is allowed of 50 tiles
+		{"1%", status(prefetch.StateFinished, 50, 1), 1},
+		{"100%", status(prefetch.StateFinished, 100, 100), 0},
+		{"0%", status(prefetch.StateFinished, 100, 1), 1},
+		// an unfinished job always fails
+		{"100%", status(prefetch.StateCancelled, 100, 0), 1},
+		{"0", status(prefetch.StateFailed, 100, 0), 1},
+	} {
+		l, err := parseMaxFailed(tc.max)
+		ast.NoError(err)
+		code, reason := l.exitCode(tc.s)
+		ast.Equal(tc.code, code, "%s %v", tc.max, tc.s.Progress)
+		if code == 0 {
+			ast.Empty(reason)
+		} else {
+			ast.NotEmpty(reason)
+		}
+	}
+}
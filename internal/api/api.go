@@ -11,6 +11,9 @@ import (
 	"github.com/samber/do/v2"
 	"github.com/willie68/go_mapproxy/internal/apiv1"
 	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/offline"
+	"github.com/willie68/go_mapproxy/internal/prefetch"
+	"github.com/willie68/go_mapproxy/internal/tilecache"
 	"github.com/willie68/go_mapproxy/internal/utils/measurement"
 )
 
@@ -83,6 +86,9 @@ func HealthRoutes(inj do.Injector) *chi.Mux {
 
 	router.Route("/", func(r chi.Router) {
 		r.Mount("/health/metrics", measurement.Routes(inj))
+		r.Mount("/health/offline", offline.Routes(inj))
+		r.Mount("/health/cache", tilecache.Routes(inj))
+		r.Mount("/health/prefetch", prefetch.Routes(inj))
 	})
 
 	logger.Info("health api routes")
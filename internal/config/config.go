@@ -6,6 +6,7 @@ import (
 
 	"github.com/samber/do/v2"
 	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/offline"
 	"github.com/willie68/go_mapproxy/internal/prefetch"
 	"github.com/willie68/go_mapproxy/internal/provider"
 	"github.com/willie68/go_mapproxy/internal/shttp"
@@ -19,6 +20,7 @@ type service struct {
 	Logging   logging.Config     `yaml:"logging"`
 	Cache     tilecache.Config   `yaml:"cache"`
 	Prefetch  prefetch.Config    `yaml:"prefetch"`
+	Offline   offline.Config     `yaml:"offline"`
 }
 
 type ParameterOption func(*service)
@@ -29,6 +31,15 @@ func WithPort(port int) ParameterOption {
 	}
 }
 
+// WithOffline starts the service in offline mode, false will not change the config
+func WithOffline(offline bool) ParameterOption {
+	return func(s *service) {
+		if offline {
+			s.Offline.Active = true
+		}
+	}
+}
+
 var (
 	config service
 )
@@ -49,6 +60,10 @@ func (c service) GetPrefetchConfig() prefetch.Config {
 	return c.Prefetch
 }
 
+func (c service) GetOfflineConfig() offline.Config {
+	return c.Offline
+}
+
 func (c service) GetHttpConfig() shttp.Config {
 	return c.HTTP
 }
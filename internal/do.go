@@ -8,6 +8,7 @@ import (
 	"github.com/willie68/go_mapproxy/internal/config"
 	"github.com/willie68/go_mapproxy/internal/logging"
 	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/offline"
 	"github.com/willie68/go_mapproxy/internal/prefetch"
 	"github.com/willie68/go_mapproxy/internal/provider"
 	"github.com/willie68/go_mapproxy/internal/shttp"
@@ -26,19 +27,52 @@ func Init(inj do.Injector) {
 	prefetch.Init(inj)
 
 	provider.Init(inj)
+	offline.Init(inj)
 	tilecache.Init(inj)
 	tiles.Init(inj)
 
 	shttp.NewSHttp(inj)
 }
 
+// InitSeed initializes the services needed to prefetch tiles, without the http servers
+func InitSeed(inj do.Injector) {
+	config.Init(inj)
+	logging.Init(inj)
+
+	metrics := measurement.New(false)
+	do.ProvideValue(inj, metrics)
+
+	prefetch.Init(inj)
+
+	provider.Init(inj)
+	offline.Init(inj)
+	tilecache.Init(inj)
+	tiles.Init(inj)
+}
+
+// InitCache initializes only the services needed to work with the tile cache
+func InitCache(inj do.Injector) {
+	config.Init(inj)
+	logging.Init(inj)
+
+	metrics := measurement.New(false)
+	do.ProvideValue(inj, metrics)
+
+	tilecache.Init(inj)
+}
+
 type tileCache interface {
-	Tile(tile model.Tile) (io.Reader, bool)
+	Tile(tile model.Tile) (io.ReadCloser, bool)
+	Flush()
 	Close() error
 }
 
 func Stop(inj do.Injector) {
+	if pm, err := do.Invoke[*prefetch.Manager](inj); err == nil {
+		pm.Stop()
+	}
 	tc := do.MustInvokeAs[tileCache](inj)
+	tc.Flush()
 	err := tc.Close()
 	if err != nil {
 		logging.New("internal").Error(fmt.Sprintf("error on close tilecache: %v", err))
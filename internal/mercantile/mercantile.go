@@ -1,7 +1,10 @@
 package mercantile
 
 import (
+	"fmt"
 	"math"
+	"strconv"
+	"strings"
 )
 
 // Bbox represents Web Mercator Bounding Box.
@@ -114,3 +117,51 @@ func Tiles(west, south, east, north float64, zooms []int) []TileID {
 	}
 	return tiles
 }
+
+// ParseBbox parses a bbox given as "west,south,east,north" in degrees
+func ParseBbox(s string) (Bbox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bbox{}, fmt.Errorf("bbox needs 4 values west,south,east,north: %s", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return Bbox{}, fmt.Errorf("invalid bbox value %q: %v", p, err)
+		}
+		v[i] = f
+	}
+	if v[1] > v[3] {
+		return Bbox{}, fmt.Errorf("bbox south is above north: %s", s)
+	}
+	return Bbox{Left: v[0], Bottom: v[1], Right: v[2], Top: v[3]}, nil
+}
+
+// Intersects true if both bboxes (in degrees) overlap, a bbox with west > east crosses the antimeridian
+func (b Bbox) Intersects(o Bbox) bool {
+	for _, bp := range b.Split() {
+		for _, op := range o.Split() {
+			if bp.Left <= op.Right && bp.Right >= op.Left && bp.Bottom <= op.Top && bp.Top >= op.Bottom {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CrossesAntimeridian true if the bbox crosses the antimeridian, west is east of east
+func (b Bbox) CrossesAntimeridian() bool {
+	return b.Left > b.Right
+}
+
+// Split splits a bbox crossing the antimeridian into its western and eastern part
+func (b Bbox) Split() []Bbox {
+	if !b.CrossesAntimeridian() {
+		return []Bbox{b}
+	}
+	return []Bbox{
+		{Left: b.Left, Bottom: b.Bottom, Right: 180, Top: b.Top},
+		{Left: -180, Bottom: b.Bottom, Right: b.Right, Top: b.Top},
+	}
+}
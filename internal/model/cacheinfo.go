@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// CacheInfo the caching information of an upstream tile, taken from the http response headers
+type CacheInfo struct {
+	ETag         string
+	LastModified string
+	Expires      time.Time // zero, if the upstream gives no expiry
+}
+
+// HasValidator true if a conditional request can be made with this info
+func (c CacheInfo) HasValidator() bool {
+	return c.ETag != "" || c.LastModified != ""
+}
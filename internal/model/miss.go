@@ -0,0 +1,25 @@
+package model
+
+// MissStatus the reason why the upstream has no tile, used for the negative caching
+type MissStatus int
+
+const (
+	// MissNotFound the upstream has no such tile (http 404)
+	MissNotFound MissStatus = iota + 1
+	// MissEmpty the upstream answered with an empty tile
+	MissEmpty
+	// MissError the upstream request failed
+	MissError
+)
+
+func (m MissStatus) String() string {
+	switch m {
+	case MissNotFound:
+		return "not found"
+	case MissEmpty:
+		return "empty"
+	case MissError:
+		return "error"
+	}
+	return "unknown"
+}
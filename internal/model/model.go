@@ -4,11 +4,15 @@ import "fmt"
 
 type Tile struct {
 	Provider string
+	Variant  string // optional variant of the tile, e.g. another image format, empty for the default
 	Z        int
 	X        int
 	Y        int
 }
 
 func (t *Tile) String() string {
+	if t.Variant != "" {
+		return fmt.Sprintf("Provider: %s, Variant: %s, Z:%d, X:%d, Y:%d", t.Provider, t.Variant, t.Z, t.X, t.Y)
+	}
 	return fmt.Sprintf("Provider: %s, Z:%d, X:%d, Y:%d", t.Provider, t.Z, t.X, t.Y)
 }
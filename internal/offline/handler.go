@@ -0,0 +1,70 @@
+package offline
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/provider"
+)
+
+type switchRequest struct {
+	Offline bool `json:"offline"`
+}
+
+func Routes(inj do.Injector) *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/", GetStatusHandler(inj))
+	router.Put("/", PutOfflineHandler(inj))
+	router.Put("/{provider}", PutProviderOfflineHandler(inj))
+	return router
+}
+
+func GetStatusHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ofs := do.MustInvoke[*Service](inj)
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, ofs.Status())
+	})
+}
+
+func PutOfflineHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sr switchRequest
+		if err := render.DecodeJSON(r.Body, &sr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ofs := do.MustInvoke[*Service](inj)
+		ofs.SetOffline(sr.Offline)
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, ofs.Status())
+	})
+}
+
+func PutProviderOfflineHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "provider")
+		var sr switchRequest
+		if err := render.DecodeJSON(r.Body, &sr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ofs := do.MustInvoke[*Service](inj)
+		if err := ofs.SetProviderOffline(name, sr.Offline); err != nil {
+			if errors.Is(err, provider.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, ofs.Status())
+	})
+}
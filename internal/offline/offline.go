@@ -0,0 +1,180 @@
+package offline
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/assets"
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/provider"
+)
+
+// Config configuration of the offline mode
+type Config struct {
+	Active      bool        `yaml:"active"`      // start in offline mode
+	Placeholder string      `yaml:"placeholder"` // path to a png served for tiles missing in the cache, empty for a transparent tile
+	Probe       ProbeConfig `yaml:"probe"`       // automatic offline detection
+}
+
+// ProbeConfig configuration of the automatic offline detection
+type ProbeConfig struct {
+	URL      string `yaml:"url"`      // url to probe, empty disables the detection
+	Interval int    `yaml:"interval"` // in seconds
+	Timeout  int    `yaml:"timeout"`  // in seconds
+}
+
+type offlineConfig interface {
+	GetOfflineConfig() Config
+}
+
+type providerConfig interface {
+	GetProviderConfig() provider.ConfigMap
+}
+
+// Status the actual offline state
+type Status struct {
+	Offline   bool            `json:"offline"`   // global switch
+	Detected  bool            `json:"detected"`  // upstream not reachable, detected by the probe
+	Providers map[string]bool `json:"providers"` // switched per provider
+}
+
+// Service holds the global and per provider offline state
+type Service struct {
+	log         *slog.Logger
+	cfg         Config
+	placeholder []byte
+
+	slock     sync.RWMutex
+	offline   bool
+	detected  bool
+	providers map[string]bool
+}
+
+func Init(inj do.Injector) {
+	cfg := do.MustInvokeAs[offlineConfig](inj).GetOfflineConfig()
+	s := &Service{
+		log:       logging.New("offline"),
+		cfg:       cfg,
+		offline:   cfg.Active,
+		providers: make(map[string]bool),
+	}
+	for name, pc := range do.MustInvokeAs[providerConfig](inj).GetProviderConfig() {
+		s.providers[name] = pc.Offline
+	}
+	if cfg.Placeholder != "" {
+		data, err := os.ReadFile(cfg.Placeholder)
+		if err != nil {
+			s.log.Error(fmt.Sprintf("can't read placeholder %s, using empty tile: %v", cfg.Placeholder, err))
+		} else {
+			s.placeholder = data
+		}
+	}
+	if s.offline {
+		s.log.Info("starting in offline mode")
+	}
+	if cfg.Probe.URL != "" {
+		s.startProbe()
+	}
+	do.ProvideValue(inj, s)
+}
+
+// IsOffline true if no upstream request should be done for this provider
+func (s *Service) IsOffline(providerName string) bool {
+	s.slock.RLock()
+	defer s.slock.RUnlock()
+	return s.offline || s.detected || s.providers[providerName]
+}
+
+// SetOffline switches the global offline mode
+func (s *Service) SetOffline(offline bool) {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	s.offline = offline
+	s.log.Info(fmt.Sprintf("offline mode set to %t", offline))
+}
+
+// SetProviderOffline switches the offline mode of a single provider
+func (s *Service) SetProviderOffline(providerName string, offline bool) error {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	if _, ok := s.providers[providerName]; !ok {
+		return provider.ErrNotFound
+	}
+	s.providers[providerName] = offline
+	s.log.Info(fmt.Sprintf("offline mode of provider %s set to %t", providerName, offline))
+	return nil
+}
+
+// Status returns the actual offline state
+func (s *Service) Status() Status {
+	s.slock.RLock()
+	defer s.slock.RUnlock()
+	st := Status{
+		Offline:   s.offline,
+		Detected:  s.detected,
+		Providers: make(map[string]bool, len(s.providers)),
+	}
+	for k, v := range s.providers {
+		st.Providers[k] = v
+	}
+	return st
+}
+
+// Placeholder returns the tile served for missing tiles in offline mode
+func (s *Service) Placeholder() io.ReadCloser {
+	if s.placeholder == nil {
+		return assets.EmptyPNG()
+	}
+	return io.NopCloser(bytes.NewReader(s.placeholder))
+}
+
+func (s *Service) startProbe() {
+	interval := time.Duration(s.cfg.Probe.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	timeout := time.Duration(s.cfg.Probe.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	cl := &http.Client{Timeout: timeout}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.setDetected(!s.probe(cl))
+			<-ticker.C
+		}
+	}()
+}
+
+// probe true if the upstream is reachable, every http answer counts
+func (s *Service) probe(cl *http.Client) bool {
+	resp, err := cl.Head(s.cfg.Probe.URL)
+	if err != nil {
+		s.log.Debug(fmt.Sprintf("probe %s failed: %v", s.cfg.Probe.URL, err))
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (s *Service) setDetected(detected bool) {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	if s.detected != detected {
+		if detected {
+			s.log.Warn(fmt.Sprintf("upstream %s not reachable, switching to offline mode", s.cfg.Probe.URL))
+		} else {
+			s.log.Info(fmt.Sprintf("upstream %s reachable again, switching to online mode", s.cfg.Probe.URL))
+		}
+	}
+	s.detected = detected
+}
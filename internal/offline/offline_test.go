@@ -0,0 +1,56 @@
+package offline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/logging"
+)
+
+func newTestService() *Service {
+	return &Service{
+		log:       logging.New("offline"),
+		providers: map[string]bool{"gebco": false, "osm": true},
+	}
+}
+
+func TestOfflineSwitches(t *testing.T) {
+	ast := assert.New(t)
+	s := newTestService()
+
+	ast.False(s.IsOffline("gebco"))
+	ast.True(s.IsOffline("osm"))
+
+	s.SetOffline(true)
+	ast.True(s.IsOffline("gebco"))
+	s.SetOffline(false)
+
+	ast.NoError(s.SetProviderOffline("gebco", true))
+	ast.True(s.IsOffline("gebco"))
+	ast.Error(s.SetProviderOffline("unknown", true))
+
+	st := s.Status()
+	ast.False(st.Offline)
+	ast.True(st.Providers["gebco"])
+}
+
+func TestOfflineProbe(t *testing.T) {
+	ast := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	s := newTestService()
+	s.cfg.Probe.URL = srv.URL
+	cl := &http.Client{Timeout: time.Second}
+
+	ast.True(s.probe(cl))
+	srv.Close()
+	ast.False(s.probe(cl))
+
+	s.setDetected(true)
+	ast.True(s.IsOffline("gebco"))
+	ast.True(s.Status().Detected)
+}
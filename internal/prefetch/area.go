@@ -0,0 +1,362 @@
+package prefetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+)
+
+// maxLat the max latitude of web mercator
+const maxLat = 85.051129
+
+// worldBbox the whole world
+var worldBbox = mercantile.Bbox{Left: -180, Bottom: -maxLat, Right: 180, Top: maxLat}
+
+// area a region of a prefetch job, all coordinates are in degrees
+type area interface {
+	// bbox the bounding box of the area, west > east for boxes crossing the antimeridian
+	bbox() mercantile.Bbox
+	// intersects true if the tile bounds overlap the area
+	intersects(tb mercantile.Bbox) bool
+}
+
+// bboxArea a bounding box
+type bboxArea mercantile.Bbox
+
+func (b bboxArea) bbox() mercantile.Bbox {
+	return mercantile.Bbox(b)
+}
+
+func (b bboxArea) intersects(tb mercantile.Bbox) bool {
+	for _, p := range mercantile.Bbox(b).Split() {
+		if overlaps(p, tb) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps true if both boxes have a common area, touching boxes don't overlap
+func overlaps(a, b mercantile.Bbox) bool {
+	return a.Left < b.Right && a.Right > b.Left && a.Bottom < b.Top && a.Top > b.Bottom
+}
+
+// point a position as lng, lat
+type point [2]float64
+
+// polygon a polygon, the first ring is the outer ring, the others are holes
+type polygon struct {
+	rings  [][]point
+	bounds mercantile.Bbox
+}
+
+func newPolygon(rings [][]point) (*polygon, error) {
+	if len(rings) == 0 || len(rings[0]) < 3 {
+		return nil, fmt.Errorf("polygon needs at least 3 positions")
+	}
+	p := &polygon{rings: rings, bounds: mercantile.Bbox{Left: math.Inf(1), Bottom: math.Inf(1), Right: math.Inf(-1), Top: math.Inf(-1)}}
+	for _, pt := range rings[0] {
+		p.bounds.Left = min(p.bounds.Left, pt[0])
+		p.bounds.Right = max(p.bounds.Right, pt[0])
+		p.bounds.Bottom = min(p.bounds.Bottom, pt[1])
+		p.bounds.Top = max(p.bounds.Top, pt[1])
+	}
+	return p, nil
+}
+
+func (p *polygon) bbox() mercantile.Bbox {
+	return p.bounds
+}
+
+// intersects true if a vertex lies in the tile, a tile corner lies in the polygon or the edges are crossing
+func (p *polygon) intersects(tb mercantile.Bbox) bool {
+	if !overlaps(p.bounds, tb) {
+		return false
+	}
+	for _, pt := range p.rings[0] {
+		if pt[0] > tb.Left && pt[0] < tb.Right && pt[1] > tb.Bottom && pt[1] < tb.Top {
+			return true
+		}
+	}
+	corners := []point{{tb.Left, tb.Bottom}, {tb.Right, tb.Bottom}, {tb.Right, tb.Top}, {tb.Left, tb.Top}}
+	for _, c := range corners {
+		if p.contains(c) {
+			return true
+		}
+	}
+	for _, ring := range p.rings {
+		for i := range ring {
+			a, b := ring[i], ring[(i+1)%len(ring)]
+			for j := range corners {
+				if segmentsCross(a, b, corners[j], corners[(j+1)%len(corners)]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// contains point in polygon test with the even odd rule over all rings
+func (p *polygon) contains(pt point) bool {
+	in := false
+	for _, ring := range p.rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > pt[1]) != (b[1] > pt[1]) && pt[0] < (b[0]-a[0])*(pt[1]-a[1])/(b[1]-a[1])+a[0] {
+				in = !in
+			}
+		}
+	}
+	return in
+}
+
+// segmentsCross true if the segments a-b and c-d are properly crossing
+func segmentsCross(a, b, c, d point) bool {
+	d1 := cross(c, d, a)
+	d2 := cross(c, d, b)
+	d3 := cross(a, b, c)
+	d4 := cross(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+func cross(o, a, b point) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+// geoJSON the parts of a GeoJSON object needed to read the areas
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// readAreaFile reads the polygons of a GeoJSON file, a relative file is resolved against dir
+func readAreaFile(dir, file string) ([]area, error) {
+	data, err := readJobFile(dir, file)
+	if err != nil {
+		return nil, err
+	}
+	var gj geoJSON
+	if err := json.Unmarshal(data, &gj); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON in %s: %v", file, err)
+	}
+	areas, err := gj.areas()
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON in %s: %v", file, err)
+	}
+	if len(areas) == 0 {
+		return nil, fmt.Errorf("no polygons found in %s", file)
+	}
+	return areas, nil
+}
+
+// areas the polygons of the GeoJSON object, other geometries are ignored
+func (g geoJSON) areas() ([]area, error) {
+	areas := make([]area, 0)
+	switch g.Type {
+	case "FeatureCollection":
+		for _, f := range g.Features {
+			a, err := f.areas()
+			if err != nil {
+				return nil, err
+			}
+			areas = append(areas, a...)
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			return g.Geometry.areas()
+		}
+	case "GeometryCollection":
+		for _, geo := range g.Geometries {
+			a, err := geo.areas()
+			if err != nil {
+				return nil, err
+			}
+			areas = append(areas, a...)
+		}
+	case "Polygon":
+		var rings [][]point
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return nil, err
+		}
+		p, err := newPolygon(rings)
+		if err != nil {
+			return nil, err
+		}
+		areas = append(areas, p)
+	case "MultiPolygon":
+		var polys [][][]point
+		if err := json.Unmarshal(g.Coordinates, &polys); err != nil {
+			return nil, err
+		}
+		for _, rings := range polys {
+			p, err := newPolygon(rings)
+			if err != nil {
+				return nil, err
+			}
+			areas = append(areas, p)
+		}
+	}
+	return areas, nil
+}
+
+// eachTile calls fn for every tile of the zoom levels intersecting one of the areas, every tile is
+// called only once. Without areas the whole world is used. If fn returns false the enumeration stops.
+// The tiles are enumerated lazily, column by column of the bbox of each area.
+func eachTile(areas []area, minzoom, maxzoom int, fn func(tile mercantile.TileID) bool) {
+	if len(areas) == 0 {
+		areas = []area{bboxArea(worldBbox)}
+	}
+	for z := minzoom; z <= maxzoom; z++ {
+		for i, a := range areas {
+			for _, r := range bboxRanges(a.bbox(), z) {
+				for x := r.x0; x <= r.x1; x++ {
+					for y := r.y0; y <= r.y1; y++ {
+						t := mercantile.TileID{X: x, Y: y, Z: z}
+						tb := mercantile.ULBounds(t)
+						if !a.intersects(tb) || inAny(areas[:i], tb) {
+							continue
+						}
+						if !fn(t) {
+							return
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// countTiles the number of tiles of the zoom level intersecting one of the areas. For the world and
+// a single bbox the tiles are counted arithmetically, otherwise they are enumerated.
+func countTiles(areas []area, z int) int {
+	if rs, ok := simpleRanges(areas, z); ok {
+		n := 0
+		for _, r := range rs {
+			n += r.size()
+		}
+		return n
+	}
+	n := 0
+	eachTile(areas, z, z, func(t mercantile.TileID) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// spreadTiles n tiles of the zoom level spread evenly over the order of eachTile, total is the
+// number of tiles of the zoom level (see countTiles)
+func spreadTiles(areas []area, z, total, n int) []mercantile.TileID {
+	tiles := make([]mercantile.TileID, 0, n)
+	if rs, ok := simpleRanges(areas, z); ok {
+		for next := range n {
+			k := next * total / n
+			for _, r := range rs {
+				if k < r.size() {
+					h := r.y1 - r.y0 + 1
+					tiles = append(tiles, mercantile.TileID{X: r.x0 + k/h, Y: r.y0 + k%h, Z: z})
+					break
+				}
+				k -= r.size()
+			}
+		}
+		return tiles
+	}
+	i := 0
+	eachTile(areas, z, z, func(t mercantile.TileID) bool {
+		if i == len(tiles)*total/n {
+			tiles = append(tiles, t)
+		}
+		i++
+		return len(tiles) < n
+	})
+	return tiles
+}
+
+// simpleRanges the tile ranges of the world or a single bbox, false for other areas
+func simpleRanges(areas []area, z int) ([]tileRange, bool) {
+	switch {
+	case len(areas) == 0:
+		return bboxRanges(worldBbox, z), true
+	case len(areas) == 1:
+		if b, ok := areas[0].(bboxArea); ok {
+			return bboxRanges(mercantile.Bbox(b), z), true
+		}
+	}
+	return nil, false
+}
+
+// tileRange the tiles x0-x1, y0-y1 of a zoom level, empty if x0 > x1 or y0 > y1
+type tileRange struct {
+	x0, x1, y0, y1 int
+}
+
+func (r tileRange) size() int {
+	if r.x0 > r.x1 || r.y0 > r.y1 {
+		return 0
+	}
+	return (r.x1 - r.x0 + 1) * (r.y1 - r.y0 + 1)
+}
+
+// bboxRanges the ranges of the tiles overlapping the bbox, tiles only touching the bbox are not part
+// of it. A bbox crossing the antimeridian has two ranges, the western one first.
+func bboxRanges(b mercantile.Bbox, z int) []tileRange {
+	if !b.CrossesAntimeridian() {
+		return []tileRange{bboxRange(b, z)}
+	}
+	west := bboxRange(mercantile.Bbox{Left: -180, Bottom: b.Bottom, Right: b.Right, Top: b.Top}, z)
+	east := bboxRange(mercantile.Bbox{Left: b.Left, Bottom: b.Bottom, Right: 180, Top: b.Top}, z)
+	// on low zoom levels both parts may share columns
+	east.x0 = max(east.x0, west.x1+1)
+	return []tileRange{west, east}
+}
+
+// bboxRange the range of the tiles overlapping the bbox, the bbox must not cross the antimeridian
+func bboxRange(b mercantile.Bbox, z int) tileRange {
+	n := 1 << z
+	w, e := max(b.Left, -180), min(b.Right, 180)
+	s, north := max(b.Bottom, -maxLat), min(b.Top, maxLat)
+	if w >= e || s >= north {
+		return tileRange{x0: 0, x1: -1}
+	}
+	ll := mercantile.Tile(w, s, z)
+	ur := mercantile.Tile(e, north, z)
+	r := tileRange{x0: clampTile(ll.X, n), x1: clampTile(ur.X, n), y0: clampTile(ur.Y, n), y1: clampTile(ll.Y, n)}
+	// the bounds are the same as of mercantile.ULBounds, so the range matches the intersection tests
+	edge := func(x, y int) mercantile.LngLat {
+		return mercantile.Ul(mercantile.TileID{X: x, Y: y, Z: z})
+	}
+	for r.x0 <= r.x1 && edge(r.x0+1, 0).Lng <= w {
+		r.x0++
+	}
+	for r.x0 <= r.x1 && edge(r.x1, 0).Lng >= e {
+		r.x1--
+	}
+	for r.y0 <= r.y1 && edge(0, r.y0+1).Lat >= north {
+		r.y0++
+	}
+	for r.y0 <= r.y1 && edge(0, r.y1).Lat <= s {
+		r.y1--
+	}
+	return r
+}
+
+func clampTile(v, n int) int {
+	return min(max(v, 0), n-1)
+}
+
+// inAny true if the tile intersects one of the areas
+func inAny(areas []area, tb mercantile.Bbox) bool {
+	for _, a := range areas {
+		if a.intersects(tb) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package prefetch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+)
+
+func enumTiles(areas []area, minzoom, maxzoom int) map[int]int {
+	counts := make(map[int]int)
+	eachTile(areas, minzoom, maxzoom, func(t mercantile.TileID) bool {
+		counts[t.Z]++
+		return true
+	})
+	return counts
+}
+
+func TestEachTileWorld(t *testing.T) {
+	ast := assert.New(t)
+	counts := enumTiles(nil, 0, 3)
+	ast.Equal(map[int]int{0: 1, 1: 4, 2: 16, 3: 64}, counts)
+}
+
+func TestEachTileBbox(t *testing.T) {
+	ast := assert.New(t)
+	job := Job{BBox: "7.0,50.0,8.0,51.0"}
+	areas, err := job.areas("")
+	ast.NoError(err)
+	counts := enumTiles(areas, 8, 10)
+	// at zoom 8 a tile is 1.40625° wide, 7-8° lies in 2 columns and 50-51° in 2 rows
+	ast.Equal(4, counts[8])
+	ast.Equal(9, counts[9])
+	ast.Equal(24, counts[10])
+
+	// crossing the antimeridian
+	counts = enumTiles([]area{bboxArea{Left: 170, Bottom: -10, Right: -170, Top: 10}}, 2, 2)
+	ast.Equal(4, counts[2])
+
+	_, err = Job{BBox: "7,50,8"}.areas("")
+	ast.Error(err)
+}
+
+func TestCountTiles(t *testing.T) {
+	ast := assert.New(t)
+	boxes := []mercantile.Bbox{
+		worldBbox,
+		{Left: 7, Bottom: 50, Right: 8, Top: 51},
+		// on tile edges
+		{Left: 0, Bottom: 0, Right: 90, Top: 66.51326},
+		{Left: 170, Bottom: -10, Right: -170, Top: 10},
+		// the parts share a column on low zoom levels
+		{Left: 10, Bottom: -10, Right: 5, Top: 10},
+		{Left: 7, Bottom: 50, Right: 7, Top: 51},
+	}
+	for _, b := range boxes {
+		areas := []area{bboxArea(b)}
+		counts := enumTiles(areas, 0, 8)
+		for z := 0; z <= 8; z++ {
+			ast.Equal(counts[z], countTiles(areas, z), "%v zoom %d", b, z)
+			// every tile is enumerated only once
+			seen := make(map[mercantile.TileID]bool)
+			eachTile(areas, z, z, func(t mercantile.TileID) bool {
+				ast.False(seen[t])
+				seen[t] = true
+				return true
+			})
+		}
+	}
+	ast.Equal(1<<24, countTiles(nil, 12))
+	ast.Equal(1, countTiles([]area{bboxArea{Left: 10, Bottom: -10, Right: 5, Top: 10}}, 0))
+
+	// the spread samples are the same as by enumeration
+	areas := []area{bboxArea{Left: 170, Bottom: -10, Right: -170, Top: 10}}
+	all := make([]mercantile.TileID, 0)
+	eachTile(areas, 6, 6, func(t mercantile.TileID) bool {
+		all = append(all, t)
+		return true
+	})
+	spread := spreadTiles(areas, 6, len(all), 5)
+	ast.Len(spread, 5)
+	for i, tile := range spread {
+		ast.Equal(all[i*len(all)/5], tile)
+	}
+	ast.Equal(spread, spreadTiles(append(areas, areas[0]), 6, len(all), 5))
+}
+
+func TestEachTilePolygon(t *testing.T) {
+	ast := assert.New(t)
+	gj := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [[[0.1, 0.1], [40, 0.1], [0.1, 40], [0.1, 0.1]]]}},
+		{"type": "Feature", "properties": {}, "geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}},
+		{"type": "Feature", "properties": {}, "geometry": {"type": "MultiPolygon", "coordinates": [[[[1, 1], [2, 1], [2, 2], [1, 1]]]]}}
+	]}`
+	file := filepath.Join(t.TempDir(), "area.geojson")
+	ast.NoError(os.WriteFile(file, []byte(gj), 0o644))
+	areas, err := Job{AreaFile: file}.areas("")
+	ast.NoError(err)
+	ast.Len(areas, 2)
+
+	// at zoom 3 a tile is 45° wide, the triangle lies in one tile
+	ast.Equal(1, enumTiles(areas, 3, 3)[3])
+	// at zoom 4 (22.5°) the triangle touches 3 of the 4 tiles of its bbox
+	tiles := make([]mercantile.TileID, 0)
+	eachTile(areas, 4, 4, func(t mercantile.TileID) bool {
+		tiles = append(tiles, t)
+		return true
+	})
+	ast.Len(tiles, 3)
+	ast.NotContains(tiles, mercantile.TileID{X: 9, Y: 5, Z: 4})
+
+	// enumeration can be stopped
+	n := 0
+	eachTile(areas, 4, 10, func(t mercantile.TileID) bool {
+		n++
+		return n < 5
+	})
+	ast.Equal(5, n)
+
+	ast.NoError(os.WriteFile(file, []byte(`{"type": "Point", "coordinates": [1, 1]}`), 0o644))
+	_, err = Job{AreaFile: file}.areas("")
+	ast.Error(err)
+}
+
+func TestPolygonHole(t *testing.T) {
+	ast := assert.New(t)
+	p, err := newPolygon([][]point{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{2, 2}, {8, 2}, {8, 8}, {2, 8}, {2, 2}},
+	})
+	ast.NoError(err)
+	ast.True(p.contains(point{1, 1}))
+	ast.False(p.contains(point{5, 5}))
+	ast.False(p.intersects(mercantile.Bbox{Left: 4, Bottom: 4, Right: 6, Top: 6}))
+	ast.True(p.intersects(mercantile.Bbox{Left: 7, Bottom: 4, Right: 9, Top: 6}))
+	ast.True(p.intersects(mercantile.Bbox{Left: -5, Bottom: -5, Right: 20, Top: 20}))
+	ast.False(p.intersects(mercantile.Bbox{Left: 10, Bottom: 0, Right: 20, Top: 10}))
+}
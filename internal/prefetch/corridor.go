@@ -0,0 +1,289 @@
+package prefetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+)
+
+const (
+	// kmPerDegree the length of a degree latitude
+	kmPerDegree = 111.32
+	// kmPerNM the length of a nautical mile
+	kmPerNM = 1.852
+	// corridorChunk the max number of segments of a corridor area, long routes are split, so only
+	// the tiles near the route are enumerated
+	corridorChunk = 16
+)
+
+// corridor the area along a line within the buffer distance
+type corridor struct {
+	line   []point
+	buffer float64 // in km
+	bounds mercantile.Bbox
+}
+
+func newCorridor(line []point, buffer float64) *corridor {
+	c := &corridor{line: line, buffer: buffer}
+	b := mercantile.Bbox{Left: math.Inf(1), Bottom: math.Inf(1), Right: math.Inf(-1), Top: math.Inf(-1)}
+	for _, pt := range line {
+		b.Left = min(b.Left, pt[0])
+		b.Right = max(b.Right, pt[0])
+		b.Bottom = min(b.Bottom, pt[1])
+		b.Top = max(b.Top, pt[1])
+	}
+	dlat := buffer / kmPerDegree
+	b.Bottom = max(b.Bottom-dlat, -maxLat)
+	b.Top = min(b.Top+dlat, maxLat)
+	dlng := buffer / (kmPerDegree * math.Cos(max(math.Abs(b.Bottom), math.Abs(b.Top))*math.Pi/180))
+	b.Left = max(b.Left-dlng, -180)
+	b.Right = min(b.Right+dlng, 180)
+	c.bounds = b
+	return c
+}
+
+func (c *corridor) bbox() mercantile.Bbox {
+	return c.bounds
+}
+
+// intersects true if the tile is nearer to one of the segments than the buffer. The distances are
+// measured in a local equirectangular projection, which is exact enough for a corridor.
+func (c *corridor) intersects(tb mercantile.Bbox) bool {
+	if !overlaps(c.bounds, tb) {
+		return false
+	}
+	kx := kmPerDegree * math.Cos((tb.Bottom+tb.Top)/2*math.Pi/180)
+	proj := func(pt point) point {
+		return point{pt[0] * kx, pt[1] * kmPerDegree}
+	}
+	rect := mercantile.Bbox{Left: tb.Left * kx, Bottom: tb.Bottom * kmPerDegree, Right: tb.Right * kx, Top: tb.Top * kmPerDegree}
+	if len(c.line) == 1 {
+		return rectDistance(rect, proj(c.line[0])) <= c.buffer
+	}
+	for i := 1; i < len(c.line); i++ {
+		if segmentRectDistance(proj(c.line[i-1]), proj(c.line[i]), rect) <= c.buffer {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentRectDistance the distance between the segment a-b and the rectangle, 0 if they intersect
+func segmentRectDistance(a, b point, r mercantile.Bbox) float64 {
+	corners := []point{{r.Left, r.Bottom}, {r.Right, r.Bottom}, {r.Right, r.Top}, {r.Left, r.Top}}
+	if inRect(r, a) || inRect(r, b) {
+		return 0
+	}
+	for j := range corners {
+		if segmentsCross(a, b, corners[j], corners[(j+1)%len(corners)]) {
+			return 0
+		}
+	}
+	d := min(rectDistance(r, a), rectDistance(r, b))
+	for _, c := range corners {
+		d = min(d, segmentDistance(a, b, c))
+	}
+	return d
+}
+
+func inRect(r mercantile.Bbox, p point) bool {
+	return p[0] >= r.Left && p[0] <= r.Right && p[1] >= r.Bottom && p[1] <= r.Top
+}
+
+// rectDistance the distance of the point to the rectangle
+func rectDistance(r mercantile.Bbox, p point) float64 {
+	dx := max(r.Left-p[0], 0, p[0]-r.Right)
+	dy := max(r.Bottom-p[1], 0, p[1]-r.Top)
+	return math.Hypot(dx, dy)
+}
+
+// segmentDistance the distance of the point p to the segment a-b
+func segmentDistance(a, b, p point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	l := dx*dx + dy*dy
+	t := 0.0
+	if l > 0 {
+		t = max(0, min(1, ((p[0]-a[0])*dx+(p[1]-a[1])*dy)/l))
+	}
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+// ParseDistance parses a distance like 5nm, 10km or 500m, a plain number is in nautical miles. Returns km.
+func ParseDistance(distance string) (float64, error) {
+	s := strings.ToLower(strings.TrimSpace(distance))
+	if s == "" {
+		return 0, nil
+	}
+	factor := kmPerNM
+	for _, u := range []struct {
+		suffix string
+		factor float64
+	}{{"nm", kmPerNM}, {"km", 1}, {"m", 0.001}} {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			s = strings.TrimSpace(v)
+			factor = u.factor
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid distance: %s", distance)
+	}
+	return v * factor, nil
+}
+
+// readRouteFile reads the lines of a GPX (tracks and routes) or GeoJSON (LineString, MultiLineString) file
+// as corridors with the buffer distance in km, a relative file is resolved against dir
+func readRouteFile(dir, file string, buffer float64) ([]area, error) {
+	data, err := readJobFile(dir, file)
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]point
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		lines, err = gpxLines(data)
+	} else {
+		lines, err = geoJSONLines(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid route file %s: %v", file, err)
+	}
+	areas := make([]area, 0)
+	for _, line := range splitAntimeridian(lines) {
+		if len(line) == 0 {
+			continue
+		}
+		for start := 0; start < len(line); start += corridorChunk {
+			end := min(start+corridorChunk+1, len(line))
+			areas = append(areas, newCorridor(line[start:end], buffer))
+			if end == len(line) {
+				break
+			}
+		}
+	}
+	if len(areas) == 0 {
+		return nil, fmt.Errorf("no tracks, routes or lines found in %s", file)
+	}
+	return areas, nil
+}
+
+// splitAntimeridian splits the lines at the antimeridian. A segment is taken as crossing it, if the
+// longitudes differ by more than 180°, the shorter way round. Otherwise the corridor of the segment
+// would span the whole globe.
+func splitAntimeridian(lines [][]point) [][]point {
+	res := make([][]point, 0, len(lines))
+	for _, line := range lines {
+		part := make([]point, 0, len(line))
+		for i, b := range line {
+			if i > 0 {
+				a := line[i-1]
+				if d := b[0] - a[0]; math.Abs(d) > 180 {
+					// the side of the antimeridian a lies on
+					edge := math.Copysign(180, a[0])
+					// b shifted next to a
+					bx := b[0] + 2*edge
+					lat := a[1] + (b[1]-a[1])*(edge-a[0])/(bx-a[0])
+					part = append(part, point{edge, lat})
+					res = append(res, part)
+					part = []point{{-edge, lat}}
+				}
+			}
+			part = append(part, b)
+		}
+		res = append(res, part)
+	}
+	return res
+}
+
+type gpxPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+// gpxLines the track segments and routes of a GPX file
+func gpxLines(data []byte) ([][]point, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return nil, err
+	}
+	toLine := func(pts []gpxPoint) []point {
+		line := make([]point, 0, len(pts))
+		for _, p := range pts {
+			line = append(line, point{p.Lon, p.Lat})
+		}
+		return line
+	}
+	lines := make([][]point, 0)
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			if len(seg.Points) > 0 {
+				lines = append(lines, toLine(seg.Points))
+			}
+		}
+	}
+	for _, rte := range gpx.Routes {
+		if len(rte.Points) > 0 {
+			lines = append(lines, toLine(rte.Points))
+		}
+	}
+	return lines, nil
+}
+
+// geoJSONLines the LineStrings and MultiLineStrings of a GeoJSON object
+func geoJSONLines(data []byte) ([][]point, error) {
+	var gj geoJSON
+	if err := json.Unmarshal(data, &gj); err != nil {
+		return nil, err
+	}
+	return gj.lines()
+}
+
+func (g geoJSON) lines() ([][]point, error) {
+	lines := make([][]point, 0)
+	children := g.Features
+	if g.Type == "GeometryCollection" {
+		children = g.Geometries
+	}
+	if g.Type == "Feature" && g.Geometry != nil {
+		children = []geoJSON{*g.Geometry}
+	}
+	for _, c := range children {
+		l, err := c.lines()
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, l...)
+	}
+	switch g.Type {
+	case "LineString":
+		var line []point
+		if err := json.Unmarshal(g.Coordinates, &line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	case "MultiLineString":
+		var ml [][]point
+		if err := json.Unmarshal(g.Coordinates, &ml); err != nil {
+			return nil, err
+		}
+		lines = append(lines, ml...)
+	}
+	return lines, nil
+}
@@ -0,0 +1,117 @@
+package prefetch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+)
+
+func TestParseDistance(t *testing.T) {
+	ast := assert.New(t)
+	for s, km := range map[string]float64{"5nm": 9.26, "10 km": 10, "500m": 0.5, "2": 3.704, "": 0} {
+		d, err := ParseDistance(s)
+		ast.NoError(err)
+		ast.InDelta(km, d, 0.0001, s)
+	}
+	_, err := ParseDistance("5 miles")
+	ast.Error(err)
+	_, err = ParseDistance("-1km")
+	ast.Error(err)
+}
+
+func TestCorridor(t *testing.T) {
+	ast := assert.New(t)
+	// along the equator from 0° to 10°, 1° is about 111km
+	c := newCorridor([]point{{0, 0}, {10, 0}}, 50)
+	ast.InDelta(-0.449, c.bounds.Bottom, 0.001)
+	ast.True(c.intersects(mercantile.Bbox{Left: 5, Bottom: 0.2, Right: 6, Top: 1}))
+	ast.True(c.intersects(mercantile.Bbox{Left: 10.3, Bottom: -0.1, Right: 11, Top: 0.1}))
+	ast.False(c.intersects(mercantile.Bbox{Left: 5, Bottom: 0.5, Right: 6, Top: 1}))
+	ast.False(c.intersects(mercantile.Bbox{Left: 10.3, Bottom: 0.4, Right: 11, Top: 1}))
+
+	// a diagonal route needs fewer tiles than its bbox
+	n := 0
+	eachTile([]area{newCorridor([]point{{0, 0}, {20, 20}}, 1)}, 8, 8, func(t mercantile.TileID) bool {
+		n++
+		return true
+	})
+	bbox := len(mercantile.Tiles(0, 0, 20, 20, []int{8}))
+	ast.Greater(n, 0)
+	ast.Less(n, bbox/5)
+}
+
+func TestRouteFiles(t *testing.T) {
+	ast := assert.New(t)
+	dir := t.TempDir()
+	gpx := `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <rte><rtept lat="44.1" lon="12.4"/><rtept lat="44.5" lon="13.0"/></rte>
+  <trk><trkseg><trkpt lat="45.0" lon="13.5"><ele>0</ele></trkpt><trkpt lat="45.2" lon="13.6"/></trkseg></trk>
+</gpx>`
+	file := filepath.Join(dir, "passage.gpx")
+	ast.NoError(os.WriteFile(file, []byte(gpx), 0o644))
+	areas, err := readRouteFile("", file, 5)
+	ast.NoError(err)
+	ast.Len(areas, 2)
+
+	// long lines are split into chunks sharing their end points
+	line := `{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [`
+	for i := range 40 {
+		if i > 0 {
+			line += ","
+		}
+		line += fmt.Sprintf("[%.1f, 1.5, 0]", float64(i)/10)
+	}
+	line += `]}}`
+	file = filepath.Join(dir, "route.geojson")
+	ast.NoError(os.WriteFile(file, []byte(line), 0o644))
+	areas, err = readRouteFile("", file, 1)
+	ast.NoError(err)
+	ast.Len(areas, 3)
+	ast.Len(areas[0].(*corridor).line, corridorChunk+1)
+	ast.Equal(areas[0].(*corridor).line[corridorChunk], areas[1].(*corridor).line[0])
+
+	job := Job{Route: file, Buffer: "3nm"}
+	areas, err = job.areas("")
+	ast.NoError(err)
+	ast.InDelta(5.556, areas[0].(*corridor).buffer, 0.001)
+
+	ast.NoError(os.WriteFile(file, []byte(`{"type": "Polygon", "coordinates": []}`), 0o644))
+	_, err = job.areas("")
+	ast.Error(err)
+}
+
+func TestCorridorAntimeridian(t *testing.T) {
+	ast := assert.New(t)
+	lines := splitAntimeridian([][]point{{{170, 0}, {-170, 10}, {-160, 10}}, {{0, 0}, {1, 1}}})
+	ast.Len(lines, 3)
+	ast.Equal([]point{{170, 0}, {180, 5}}, lines[0])
+	ast.Equal([]point{{-180, 5}, {-170, 10}, {-160, 10}}, lines[1])
+	ast.Equal([]point{{0, 0}, {1, 1}}, lines[2])
+
+	// from the west to the east side
+	lines = splitAntimeridian([][]point{{{-175, -10}, {175, 10}}})
+	ast.Equal([]point{{-175, -10}, {-180, 0}}, lines[0])
+	ast.Equal([]point{{180, 0}, {175, 10}}, lines[1])
+
+	// only the tiles along the route are fetched, not the whole globe
+	gj := `{"type": "LineString", "coordinates": [[170, 0], [-170, 0]]}`
+	file := filepath.Join(t.TempDir(), "route.geojson")
+	ast.NoError(os.WriteFile(file, []byte(gj), 0o644))
+	areas, err := readRouteFile("", file, 10)
+	ast.NoError(err)
+	ast.Len(areas, 2)
+	n := 0
+	eachTile(areas, 6, 6, func(t mercantile.TileID) bool {
+		ast.True(t.X <= 2 || t.X >= 61, "tile %v", t)
+		n++
+		return true
+	})
+	// 20° are about 4 columns in 2 rows at the equator
+	ast.LessOrEqual(n, 8)
+	ast.Greater(n, 0)
+}
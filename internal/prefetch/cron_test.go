@@ -0,0 +1,35 @@
+package prefetch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	ast := assert.New(t)
+	// a wednesday
+	now := time.Date(2026, 10, 14, 12, 30, 20, 0, time.UTC)
+	for expr, next := range map[string]time.Time{
+		"0 2 * * sun":      time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC),
+		"0 2 * * 7":        time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC),
+		"*/15 * * * *":     time.Date(2026, 10, 14, 12, 45, 0, 0, time.UTC),
+		"@daily":           time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC),
+		"30 12 * * *":      time.Date(2026, 10, 15, 12, 30, 0, 0, time.UTC),
+		"0 0 1 jan *":      time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		"0 22 * * mon-fri": time.Date(2026, 10, 14, 22, 0, 0, 0, time.UTC),
+		// day of month or day of week
+		"0 0 20 * sat": time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC),
+		"0 0 31 2 *":   {},
+	} {
+		c, err := parseCron(expr)
+		ast.NoError(err, expr)
+		ast.Equal(next, c.next(now), expr)
+	}
+
+	for _, expr := range []string{"", "0 2 * *", "60 * * * *", "0 2 * * son", "5-1 * * * *", "*/0 * * * *"} {
+		_, err := parseCron(expr)
+		ast.Error(err, expr)
+	}
+}
@@ -0,0 +1,160 @@
+package prefetch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// Estimate the expected size and duration of a prefetch job, nothing is downloaded except the samples
+type Estimate struct {
+	Job      Job            `json:"job"`
+	Tiles    int            `json:"tiles"`    // tiles of the job, for all providers
+	Cached   int            `json:"cached"`   // tiles expected to be already cached
+	Bytes    int64          `json:"bytes"`    // expected size of the tiles to download
+	Duration string         `json:"duration"` // expected duration of the download
+	Zooms    []ZoomEstimate `json:"zooms"`
+}
+
+// ZoomEstimate the estimation of one zoom level of a provider
+type ZoomEstimate struct {
+	Provider      string `json:"provider"`
+	Zoom          int    `json:"zoom"`
+	Tiles         int    `json:"tiles"`
+	Prefetchable  bool   `json:"prefetchable"`      // false if the provider or zoom is refused, nothing is sampled
+	Refused       string `json:"refused,omitempty"` // the reason, why the zoom level isn't prefetched
+	Samples       int    `json:"samples"`           // sampled tiles
+	SamplesCached int    `json:"samplesCached"`
+	SamplesFailed int    `json:"samplesFailed"`
+	AvgSize       int64  `json:"avgSize"` // average size of the sampled tiles
+	Cached        int    `json:"cached"`  // tiles expected to be already cached
+	Bytes         int64  `json:"bytes"`   // expected size of the tiles to download
+
+	host     string        // upstream host of the provider
+	fetched  int           // samples fetched from the upstream
+	duration time.Duration // sum of the request durations of the fetched samples
+	size     int64         // sum of the sizes of the sampled tiles
+}
+
+// Estimate counts the tiles of the job and samples some tiles per zoom level from the upstream (or
+// the cache) to estimate the disk usage and the duration with the workers and rate limit of a job
+func (m *Manager) Estimate(job Job) (Estimate, error) {
+	syss, areas, err := job.validate(m.files)
+	if err != nil {
+		return Estimate{}, err
+	}
+	ts := do.MustInvokeAs[providerFactory](m.inj)
+	cache := do.MustInvokeAs[tileCache](m.inj)
+
+	pols := m.providers(ts, job, syss)
+	zooms := make([]*ZoomEstimate, 0)
+	samples := make(map[model.Tile]*ZoomEstimate)
+	rates := make(map[string]float64) // rate limits of the hosts
+	counts := make(map[int]int)       // tiles per zoom level, the same for all providers
+	for z := job.MinZoom; z <= job.MaxZoom; z++ {
+		counts[z] = countTiles(areas, z)
+	}
+	for _, sys := range syss {
+		pp := providerPolicy(pols, sys)
+		if pp.Rate > 0 {
+			rates[pp.Host] = pp.Rate
+		}
+		for z := job.MinZoom; z <= job.MaxZoom; z++ {
+			ze := &ZoomEstimate{Provider: sys, Zoom: z, Prefetchable: true, host: pp.Host}
+			switch {
+			case pp.Refused != "":
+				ze.Prefetchable, ze.Refused = false, pp.Refused
+			case z > pp.maxZoom(job):
+				ze.Prefetchable, ze.Refused = false, fmt.Sprintf("zoom is above the max zoom %d of host %s", pp.MaxZoom, pp.Host)
+			}
+			zooms = append(zooms, ze)
+			ze.Tiles = counts[z]
+			if !ze.Prefetchable || ze.Tiles == 0 {
+				continue
+			}
+			// the samples are spread evenly over the enumeration
+			n := min(m.samples, ze.Tiles)
+			for _, t := range spreadTiles(areas, z, ze.Tiles, n) {
+				samples[model.Tile{Provider: sys, X: t.X, Y: t.Y, Z: t.Z}] = ze
+			}
+		}
+	}
+
+	m.sample(ts, cache, samples)
+
+	e := Estimate{Job: job, Zooms: make([]ZoomEstimate, 0, len(zooms))}
+	downloads := 0
+	hostDownloads := make(map[string]int)
+	var duration time.Duration
+	fetched := 0
+	for _, ze := range zooms {
+		e.Tiles += ze.Tiles
+		if ok := ze.Samples - ze.SamplesFailed; ok > 0 {
+			ze.AvgSize = ze.size / int64(ok)
+			ze.Cached = ze.Tiles * ze.SamplesCached / ok
+		}
+		if ze.Prefetchable {
+			ze.Bytes = ze.AvgSize * int64(ze.Tiles-ze.Cached)
+			downloads += ze.Tiles - ze.Cached
+			hostDownloads[ze.host] += ze.Tiles - ze.Cached
+		}
+		e.Cached += ze.Cached
+		e.Bytes += ze.Bytes
+		duration += ze.duration
+		fetched += ze.fetched
+		e.Zooms = append(e.Zooms, *ze)
+	}
+	var d time.Duration
+	if fetched > 0 {
+		d = duration / time.Duration(fetched) * time.Duration(downloads) / time.Duration(m.workers)
+	}
+	if m.rate > 0 {
+		d = max(d, time.Duration(float64(downloads)/m.rate*float64(time.Second)))
+	}
+	for host, rate := range rates {
+		d = max(d, time.Duration(float64(hostDownloads[host])/rate*float64(time.Second)))
+	}
+	e.Duration = d.Round(time.Second).String()
+	return e, nil
+}
+
+// sample fetches the sample tiles with the workers, tiles not cached yet are fetched from the upstream
+func (m *Manager) sample(ts providerFactory, cache tileCache, samples map[model.Tile]*ZoomEstimate) {
+	var slock sync.Mutex
+	jobs := make(chan model.Tile)
+	wg := sync.WaitGroup{}
+	for range min(m.workers, max(len(samples), 1)) {
+		wg.Go(func() {
+			for tile := range jobs {
+				cached := cache.Has(tile)
+				start := time.Now()
+				n, err := fetch(ts, tile, false)
+				d := time.Since(start)
+				slock.Lock()
+				ze := samples[tile]
+				ze.Samples++
+				switch {
+				case err != nil:
+					log.Warn(fmt.Sprintf("error sampling tile %s: %v", tile.String(), err))
+					ze.SamplesFailed++
+				case cached:
+					ze.SamplesCached++
+					ze.size += n
+				default:
+					ze.size += n
+					ze.fetched++
+					ze.duration += d
+				}
+				slock.Unlock()
+			}
+		})
+	}
+	for tile := range samples {
+		jobs <- tile
+	}
+	close(jobs)
+	wg.Wait()
+}
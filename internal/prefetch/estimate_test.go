@@ -0,0 +1,62 @@
+package prefetch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestEstimate(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{cached: map[model.Tile]bool{{Provider: "osm", X: 0, Y: 0, Z: 0}: true}}
+	inj := do.New()
+	do.ProvideValue(inj, f)
+	m := newManager(inj, Config{Workers: 2, Rate: 10, Samples: 2})
+
+	e, err := m.Estimate(Job{Providers: "osm,blocked", MinZoom: 0, MaxZoom: 2})
+	ast.NoError(err)
+	ast.Equal(42, e.Tiles)
+	ast.Equal(1, e.Cached)
+	ast.Equal(int64(20*4), e.Bytes)
+	// 20 tiles with 10 tiles per second
+	ast.Equal("2s", e.Duration)
+	ast.Len(e.Zooms, 6)
+	z0 := e.Zooms[0]
+	ast.Equal(1, z0.Samples)
+	ast.Equal(1, z0.SamplesCached)
+	ast.Equal(int64(0), z0.Bytes)
+	z2 := e.Zooms[2]
+	ast.Equal(16, z2.Tiles)
+	ast.Equal(2, z2.Samples)
+	ast.Equal(int64(4), z2.AvgSize)
+	ast.False(e.Zooms[3].Prefetchable)
+	ast.Contains(e.Zooms[3].Refused, "noprefetch")
+	ast.Equal(0, e.Zooms[3].Samples)
+	// only the samples are requested
+	ast.Equal(5, f.fetched)
+
+	_, err = m.Estimate(Job{Providers: "osm", MinZoom: 3, MaxZoom: 2})
+	ast.Error(err)
+}
+
+func TestLimiter(t *testing.T) {
+	ast := assert.New(t)
+	var l *limiter
+	ast.True(l.wait(context.Background()))
+	ast.Nil(newLimiter(0))
+
+	l = newLimiter(100)
+	start := time.Now()
+	for range 11 {
+		ast.True(l.wait(context.Background()))
+	}
+	ast.GreaterOrEqual(time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ast.False(newLimiter(1).wait(ctx))
+}
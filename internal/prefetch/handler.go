@@ -0,0 +1,149 @@
+package prefetch
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/do/v2"
+)
+
+// Routes the REST interface of the prefetch jobs
+func Routes(inj do.Injector) *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/", GetJobsHandler(inj))
+	router.Post("/", PostJobHandler(inj))
+	router.Post("/estimate", PostEstimateHandler(inj))
+	router.Get("/schedules", GetSchedulesHandler(inj))
+	router.Get("/{id}", GetJobHandler(inj))
+	router.Post("/{id}/pause", PauseJobHandler(inj))
+	router.Post("/{id}/resume", ResumeJobHandler(inj))
+	router.Post("/{id}/retry", RetryJobHandler(inj))
+	router.Delete("/{id}", DeleteJobHandler(inj))
+	return router
+}
+
+// GetJobsHandler lists all jobs with their progress
+func GetJobsHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := do.MustInvoke[*Manager](inj)
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, m.Jobs())
+	})
+}
+
+// GetSchedulesHandler lists the schedules with their next start and their last runs
+func GetSchedulesHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := do.MustInvoke[*Manager](inj)
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, m.Schedules())
+	})
+}
+
+// PostJobHandler creates and starts a new job
+func PostJobHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job Job
+		if err := render.DecodeJSON(r.Body, &job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := do.MustInvoke[*Manager](inj)
+		if err := job.checkFiles(m.files); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, err := m.Start(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, status)
+	})
+}
+
+// PostEstimateHandler estimates the size and duration of a job without starting it (dry run)
+func PostEstimateHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job Job
+		if err := render.DecodeJSON(r.Body, &job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := do.MustInvoke[*Manager](inj)
+		if err := job.checkFiles(m.files); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, err := m.Estimate(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, e)
+	})
+}
+
+// GetJobHandler the progress of one job
+func GetJobHandler(inj do.Injector) http.HandlerFunc {
+	return jobHandler(inj, func(m *Manager, id string) (JobStatus, error) {
+		return m.Job(id)
+	})
+}
+
+// PauseJobHandler pauses a running job
+func PauseJobHandler(inj do.Injector) http.HandlerFunc {
+	return jobHandler(inj, func(m *Manager, id string) (JobStatus, error) {
+		return m.Pause(id)
+	})
+}
+
+// ResumeJobHandler resumes a paused job
+func ResumeJobHandler(inj do.Injector) http.HandlerFunc {
+	return jobHandler(inj, func(m *Manager, id string) (JobStatus, error) {
+		return m.Resume(id)
+	})
+}
+
+// RetryJobHandler fetches the failed tiles of a finished job again
+func RetryJobHandler(inj do.Injector) http.HandlerFunc {
+	return jobHandler(inj, func(m *Manager, id string) (JobStatus, error) {
+		return m.Retry(id)
+	})
+}
+
+// DeleteJobHandler cancels a running or paused job, a done job is removed
+func DeleteJobHandler(inj do.Injector) http.HandlerFunc {
+	return jobHandler(inj, func(m *Manager, id string) (JobStatus, error) {
+		return m.Cancel(id)
+	})
+}
+
+func jobHandler(inj do.Injector, fn func(m *Manager, id string) (JobStatus, error)) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := do.MustInvoke[*Manager](inj)
+		status, err := fn(m, chi.URLParam(r, "id"))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrJobNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, ErrJobDone), errors.Is(err, ErrJobNotFinished):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, status)
+	})
+}
@@ -0,0 +1,47 @@
+package prefetch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter spaces the tile requests of a job to the max rate, a nil limiter doesn't limit
+type limiter struct {
+	llock    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter a limiter for rate requests per second, nil for rate <= 0
+func newLimiter(rate float64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the next request is allowed, returns false if the context is done
+func (l *limiter) wait(ctx context.Context) bool {
+	if l == nil {
+		return ctx.Err() == nil
+	}
+	l.llock.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.llock.Unlock()
+	if d := at.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
@@ -0,0 +1,817 @@
+package prefetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/pkg/extstrgutils"
+)
+
+// the states of a prefetch job
+const (
+	StateRunning   = "running"
+	StatePaused    = "paused"
+	StateCancelled = "cancelled"
+	StateFinished  = "finished"
+	StateFailed    = "failed"
+)
+
+const (
+	// jobPrefix the key prefix of the persisted jobs
+	jobPrefix = "prefetch/"
+	// checkpointInterval the interval the progress of a running job is persisted
+	checkpointInterval = 30 * time.Second
+	// maxFailedTiles the max number of failed tiles of a job remembered for a retry
+	maxFailedTiles = 10000
+	// maxDoneJobs the number of done jobs, which aren't runs of a schedule, kept in the list and the store
+	maxDoneJobs = 100
+	// windowPerWorker the max number of tiles per worker the enumeration may be ahead of the position,
+	// a hanging tile request doesn't let the pending tiles grow without bounds
+	windowPerWorker = 64
+)
+
+var (
+	// ErrJobNotFound there is no job with this id
+	ErrJobNotFound = errors.New("prefetch job not found")
+	// ErrJobDone the job is already finished, failed or cancelled
+	ErrJobDone = errors.New("prefetch job is already done")
+	// ErrJobNotFinished the job is not finished yet
+	ErrJobNotFinished = errors.New("prefetch job is not finished")
+	// ErrFilesDisabled area and route files of jobs posted to the REST interface need a files directory
+	ErrFilesDisabled = errors.New("area and route files are disabled, no prefetch files directory configured")
+	// ErrInvalidFile an area or route file posted to the REST interface is not a name in the files directory
+	ErrInvalidFile = errors.New("area and route files must be names in the prefetch files directory")
+)
+
+// jobStore stores the definitions and checkpoints of the jobs, so they survive a restart
+type jobStore interface {
+	SaveState(key string, data []byte) error
+	States(prefix string) (map[string][]byte, error)
+	DeleteState(key string) error
+}
+
+// Progress the counters of a prefetch job
+type Progress struct {
+	Done    int   `json:"done"`    // fetched tiles
+	Skipped int   `json:"skipped"` // tiles already cached or not prefetchable
+	Failed  int   `json:"failed"`
+	Bytes   int64 `json:"bytes"` // size of the fetched tiles
+}
+
+func (p *Progress) add(o Progress) {
+	p.Done += o.Done
+	p.Skipped += o.Skipped
+	p.Failed += o.Failed
+	p.Bytes += o.Bytes
+}
+
+// JobStatus the state and the progress of a prefetch job
+type JobStatus struct {
+	ID    string `json:"id"`
+	Job   Job    `json:"job"`
+	State string `json:"state"`
+	Total int    `json:"total"` // tiles of the job, for all providers
+	Progress
+	Policy   []ProviderPolicy `json:"policy,omitempty"`   // the restricted providers of the job
+	Schedule string           `json:"schedule,omitempty"` // name of the schedule, which started the job
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished,omitzero"`
+	ETA      time.Time        `json:"eta,omitzero"` // estimated end of a running job
+	Error    string           `json:"error,omitempty"`
+}
+
+// Processed the number of processed tiles
+func (s JobStatus) Processed() int {
+	return s.Done + s.Skipped + s.Failed
+}
+
+// active true if the job is running or paused
+func (s JobStatus) active() bool {
+	return s.State == StateRunning || s.State == StatePaused
+}
+
+// checkpoint the persisted state of a job. The tiles are always enumerated in the same order, all
+// tiles before the position are processed and counted in the status, so a resumed job continues
+// without missing or double counting tiles.
+type checkpoint struct {
+	Status   JobStatus     `json:"status"`
+	Active   time.Duration `json:"active"`
+	Position int           `json:"position"`
+	Retry    []model.Tile  `json:"retry,omitempty"`
+	Failed   []model.Tile  `json:"failed,omitempty"`
+}
+
+// outcome the result of a processed tile
+type outcome struct {
+	tile  model.Tile
+	delta Progress
+}
+
+// seqTile a tile with its position in the enumeration of the job
+type seqTile struct {
+	seq     int
+	tile    model.Tile
+	refresh bool // the tile is cached, but too old
+}
+
+// task a prefetch job managed by the manager
+type task struct {
+	tlock    sync.Mutex
+	status   JobStatus
+	active   time.Duration // running time without pauses, up to the last pause
+	since    time.Time     // start of the actual running period
+	resume   chan struct{} // closed on resume, nil if not paused
+	ctx      context.Context
+	cancel   context.CancelFunc
+	areas    []area          // areas of the job, nil if not parsed yet
+	retry    []model.Tile    // the tiles of a retry run, nil for the tiles of the job
+	position int             // all tiles of the enumeration before are processed
+	done     Progress        // the counters of the tiles before the position
+	pending  map[int]outcome // processed tiles after the position
+	moved    chan struct{}   // closed if the position moves, nil if nobody waits for it
+	failed   []model.Tile    // failed tiles before the position
+}
+
+func newTask(status JobStatus) *task {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &task{
+		status:  status,
+		since:   time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[int]outcome),
+	}
+}
+
+// Manager runs the prefetch jobs, every job has its own pool of workers
+type Manager struct {
+	inj     do.Injector
+	mlock   sync.Mutex
+	tasks   map[string]*task
+	workers int
+	rate    float64 // max tile requests per second of a job, 0 for unlimited
+	samples int     // sampled tiles per zoom level of an estimation
+	policy  *policy
+	files   string   // directory of the area and route files
+	store   jobStore // nil if the jobs are not persisted
+	stopped atomic.Bool
+	done    chan struct{} // closed on stop
+	slock   sync.Mutex
+	sched   []*schedule
+}
+
+func newManager(inj do.Injector, cfg Config) *Manager {
+	m := &Manager{
+		inj:     inj,
+		tasks:   make(map[string]*task),
+		workers: cfg.Workers,
+		rate:    cfg.Rate,
+		samples: cfg.Samples,
+		files:   cfg.Files,
+		done:    make(chan struct{}),
+	}
+	if m.workers <= 0 {
+		m.workers = 10
+	}
+	if m.samples <= 0 {
+		m.samples = 10
+	}
+	pol, err := newPolicy(cfg.Policy)
+	if err != nil {
+		log.Error(fmt.Sprintf("invalid prefetch policy, using the embedded blacklist only: %v", err))
+		if pol, err = newPolicy(Policy{}); err != nil {
+			log.Error(fmt.Sprintf("invalid embedded prefetch blacklist: %v", err))
+			pol = &policy{limiters: make(map[string]*limiter)}
+		}
+	}
+	m.policy = pol
+	return m
+}
+
+// Start validates and starts the job, returns the status of the new job
+func (m *Manager) Start(job Job) (JobStatus, error) {
+	return m.start(job, "")
+}
+
+// start starts the job, schedule is the name of the schedule starting the job
+func (m *Manager) start(job Job, schedule string) (JobStatus, error) {
+	syss, areas, err := job.validate(m.files)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	pols := m.providers(do.MustInvokeAs[providerFactory](m.inj), job, syss)
+	refused := make([]string, 0)
+	for _, pp := range pols {
+		if pp.Refused != "" {
+			refused = append(refused, fmt.Sprintf("%s: %s", pp.Provider, pp.Refused))
+		}
+	}
+	if len(refused) == len(syss) {
+		return JobStatus{}, fmt.Errorf("no provider of the job can be prefetched, %s", strings.Join(refused, ", "))
+	}
+	counts := make([]int, job.MaxZoom+1)
+	for z := job.MinZoom; z <= job.MaxZoom; z++ {
+		counts[z] = countTiles(areas, z)
+	}
+	total := 0
+	for _, sys := range syss {
+		pp := providerPolicy(pols, sys)
+		if pp.Refused != "" {
+			continue
+		}
+		for z := job.MinZoom; z <= pp.maxZoom(job); z++ {
+			total += counts[z]
+		}
+	}
+
+	t := newTask(JobStatus{Job: job, State: StateRunning, Total: total, Started: time.Now(), Policy: pols, Schedule: schedule})
+	t.areas = areas
+	id := m.add(t)
+	log.Info(fmt.Sprintf("starting prefetch job %s for %s, %d tiles", id, job.String(), t.status.Total))
+	for _, pp := range pols {
+		switch {
+		case pp.Refused != "":
+			log.Warn(fmt.Sprintf("prefetch job %s: provider %s is refused, %s", id, pp.Provider, pp.Refused))
+		case pp.MaxZoom > 0:
+			log.Info(fmt.Sprintf("prefetch job %s: provider %s is limited to zoom %d by the policy of host %s", id, pp.Provider, pp.MaxZoom, pp.Host))
+		}
+	}
+	m.save(t)
+	go m.run(t)
+	return t.snapshot(), nil
+}
+
+// add adds the task with a new unique id to the list, returns the id
+func (m *Manager) add(t *task) string {
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	now := t.status.Started
+	id := strconv.FormatInt(now.UnixMilli(), 36)
+	for m.tasks[id] != nil {
+		now = now.Add(time.Millisecond)
+		id = strconv.FormatInt(now.UnixMilli(), 36)
+	}
+	t.status.ID = id
+	m.tasks[id] = t
+	return id
+}
+
+// Restore loads the persisted jobs, interrupted jobs are resumed from their last checkpoint,
+// paused jobs stay paused. From now on the jobs are persisted.
+func (m *Manager) Restore() error {
+	store, err := do.InvokeAs[jobStore](m.inj)
+	if err != nil {
+		return err
+	}
+	states, err := store.States(jobPrefix)
+	if err != nil {
+		return err
+	}
+	m.mlock.Lock()
+	m.store = store
+	m.mlock.Unlock()
+	for key, data := range states {
+		var cp checkpoint
+		if err := json.Unmarshal(data, &cp); err != nil {
+			log.Error(fmt.Sprintf("invalid checkpoint of prefetch job %s: %v", key, err))
+			continue
+		}
+		t := newTask(cp.Status)
+		t.active = cp.Active
+		t.position = cp.Position
+		t.done = cp.Status.Progress
+		t.retry = cp.Retry
+		t.failed = cp.Failed
+		if t.status.State == StatePaused {
+			t.resume = make(chan struct{})
+		}
+		m.mlock.Lock()
+		m.tasks[t.status.ID] = t
+		m.mlock.Unlock()
+		if t.status.State == StateRunning || t.status.State == StatePaused {
+			log.Info(fmt.Sprintf("resuming prefetch job %s for %s at tile %d", t.status.ID, t.status.Job.String(), t.position))
+			go m.run(t)
+		}
+	}
+	m.prune()
+	return nil
+}
+
+// Stop stops the running jobs and persists their checkpoints, they are resumed on the next start
+func (m *Manager) Stop() {
+	if !m.stopped.CompareAndSwap(false, true) {
+		return
+	}
+	close(m.done)
+	m.mlock.Lock()
+	tasks := make([]*task, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		tasks = append(tasks, t)
+	}
+	m.mlock.Unlock()
+	for _, t := range tasks {
+		t.cancel()
+		m.save(t)
+	}
+}
+
+// Jobs the status of all jobs, the newest first
+func (m *Manager) Jobs() []JobStatus {
+	m.mlock.Lock()
+	list := make([]JobStatus, 0, len(m.tasks))
+	for _, t := range m.tasks {
+		list = append(list, t.snapshot())
+	}
+	m.mlock.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.After(list[j].Started)
+	})
+	return list
+}
+
+// Job the status of the job
+func (m *Manager) Job(id string) (JobStatus, error) {
+	t, err := m.task(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	return t.snapshot(), nil
+}
+
+// Pause pauses a running job, the running tile requests are finished
+func (m *Manager) Pause(id string) (JobStatus, error) {
+	t, err := m.task(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	t.tlock.Lock()
+	switch t.status.State {
+	case StateRunning:
+		t.status.State = StatePaused
+		t.active += time.Since(t.since)
+		t.resume = make(chan struct{})
+		log.Info(fmt.Sprintf("prefetch job %s paused", id))
+	case StatePaused:
+	default:
+		t.tlock.Unlock()
+		return t.snapshot(), ErrJobDone
+	}
+	t.tlock.Unlock()
+	m.save(t)
+	return t.snapshot(), nil
+}
+
+// Resume resumes a paused job
+func (m *Manager) Resume(id string) (JobStatus, error) {
+	t, err := m.task(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	t.tlock.Lock()
+	switch t.status.State {
+	case StatePaused:
+		t.status.State = StateRunning
+		t.since = time.Now()
+		close(t.resume)
+		t.resume = nil
+		log.Info(fmt.Sprintf("prefetch job %s resumed", id))
+	case StateRunning:
+	default:
+		t.tlock.Unlock()
+		return t.snapshot(), ErrJobDone
+	}
+	t.tlock.Unlock()
+	m.save(t)
+	return t.snapshot(), nil
+}
+
+// Retry fetches the failed tiles of a finished job again
+func (m *Manager) Retry(id string) (JobStatus, error) {
+	t, err := m.task(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	t.tlock.Lock()
+	if t.status.State != StateFinished {
+		t.tlock.Unlock()
+		return t.snapshot(), ErrJobNotFinished
+	}
+	if len(t.failed) == 0 {
+		t.tlock.Unlock()
+		return t.snapshot(), nil
+	}
+	t.retry = t.failed
+	t.failed = nil
+	t.status.Failed -= len(t.retry)
+	t.status.State = StateRunning
+	t.status.Finished = time.Time{}
+	t.done = t.status.Progress
+	t.position = 0
+	t.pending = make(map[int]outcome)
+	t.since = time.Now()
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	log.Info(fmt.Sprintf("retrying %d failed tiles of prefetch job %s", len(t.retry), id))
+	t.tlock.Unlock()
+	m.save(t)
+	go m.run(t)
+	return t.snapshot(), nil
+}
+
+// Cancel cancels a running or paused job, a done job is removed from the list
+func (m *Manager) Cancel(id string) (JobStatus, error) {
+	t, err := m.task(id)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	t.tlock.Lock()
+	switch t.status.State {
+	case StateRunning, StatePaused:
+		t.status.State = StateCancelled
+		if t.resume != nil {
+			close(t.resume)
+			t.resume = nil
+		}
+		t.cancel()
+		log.Info(fmt.Sprintf("prefetch job %s cancelled", id))
+		t.tlock.Unlock()
+		m.save(t)
+	default:
+		t.tlock.Unlock()
+		m.remove(id)
+	}
+	return t.snapshot(), nil
+}
+
+// remove removes the job from the list and the store
+func (m *Manager) remove(id string) {
+	m.mlock.Lock()
+	delete(m.tasks, id)
+	store := m.store
+	m.mlock.Unlock()
+	if store != nil {
+		if err := store.DeleteState(jobPrefix + id); err != nil {
+			log.Error(fmt.Sprintf("can't delete prefetch job %s: %v", id, err))
+		}
+	}
+}
+
+// prune removes the oldest done jobs from the list and the store, only the last maxDoneJobs jobs
+// and the last maxRuns runs of every schedule are kept
+func (m *Manager) prune() {
+	done := 0
+	runs := make(map[string]int)
+	for _, j := range m.Jobs() {
+		if j.Schedule != "" {
+			runs[j.Schedule]++
+			if runs[j.Schedule] > maxRuns && !j.active() {
+				m.remove(j.ID)
+			}
+			continue
+		}
+		if j.active() {
+			continue
+		}
+		done++
+		if done > maxDoneJobs {
+			m.remove(j.ID)
+		}
+	}
+}
+
+// active true if a running or paused job has the same definition
+func (m *Manager) active(job Job) bool {
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	for _, t := range m.tasks {
+		s := t.snapshot()
+		if s.Job == job && s.active() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) task(id string) (*task, error) {
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	t, ok := m.tasks[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return t, nil
+}
+
+// run fetches the tiles of the job with the workers, tiles before the checkpoint are skipped
+func (m *Manager) run(t *task) {
+	ts := do.MustInvokeAs[providerFactory](m.inj)
+	cache := do.MustInvokeAs[tileCache](m.inj)
+
+	each, err := t.tiles(m.files)
+	if err != nil {
+		log.Error(fmt.Sprintf("prefetch job %s failed: %v", t.status.ID, err))
+		t.tlock.Lock()
+		t.status.State = StateFailed
+		t.status.Error = err.Error()
+		t.status.Finished = time.Now()
+		t.tlock.Unlock()
+		m.save(t)
+		return
+	}
+	t.tlock.Lock()
+	start := t.position
+	ctx := t.ctx
+	job := t.status.Job
+	stored := t.status.Policy
+	var before time.Time
+	if r := job.Refresh; r > 0 {
+		before = time.Now().Add(-time.Duration(r) * time.Hour)
+	}
+	t.tlock.Unlock()
+
+	// the policy may have changed since the start of a resumed job, the tiles of providers refused
+	// now are skipped
+	pols := make(map[string]ProviderPolicy)
+	limiters := make(map[string]*limiter)
+	for _, sys := range extstrgutils.SplitMultiValueParam(job.Providers) {
+		pols[sys] = providerPolicy(m.providers(ts, job, []string{sys}), sys)
+		limiters[sys] = m.policy.limiter(pols[sys].Host)
+		if r := pols[sys].Refused; r != "" && providerPolicy(stored, sys).Refused == "" {
+			log.Warn(fmt.Sprintf("prefetch job %s: provider %s is refused now, %s, its tiles are skipped", t.status.ID, sys, r))
+		}
+	}
+
+	stop := make(chan struct{})
+	go m.checkpoints(t, stop)
+	lim := newLimiter(m.rate)
+
+	jobs := make(chan seqTile, m.workers)
+	wg := sync.WaitGroup{}
+	for range m.workers {
+		wg.Go(func() {
+			for j := range jobs {
+				if !t.wait() {
+					continue
+				}
+				if !lim.wait(ctx) || !limiters[j.tile.Provider].wait(ctx) {
+					continue
+				}
+				n, err := fetch(ts, j.tile, j.refresh)
+				if err != nil {
+					log.Error(fmt.Sprintf("error getting tile %s: %v", j.tile.String(), err))
+					t.complete(j.seq, outcome{tile: j.tile, delta: Progress{Failed: 1}})
+					continue
+				}
+				log.Debug(fmt.Sprintf("fetched tile: %s", j.tile.String()))
+				t.complete(j.seq, outcome{tile: j.tile, delta: Progress{Done: 1, Bytes: n}})
+			}
+		})
+	}
+
+	seq := 0
+	each(func(tile model.Tile) bool {
+		n := seq
+		seq++
+		if n < start {
+			// processed before the restart
+			return true
+		}
+		if !t.wait() || !t.window(n, windowPerWorker*m.workers) {
+			return false
+		}
+		if pp := pols[tile.Provider]; pp.Refused != "" || tile.Z > pp.maxZoom(job) {
+			t.complete(n, outcome{tile: tile, delta: Progress{Skipped: 1}})
+			return true
+		}
+		refresh := false
+		if cache.Has(tile) {
+			if stamp, ok := cache.Timestamp(tile); before.IsZero() || !ok || !stamp.Before(before) {
+				t.complete(n, outcome{tile: tile, delta: Progress{Skipped: 1}})
+				return true
+			}
+			refresh = true
+		}
+		select {
+		case jobs <- seqTile{seq: n, tile: tile, refresh: refresh}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	close(stop)
+	if m.stopped.Load() {
+		// the service is stopping, the job is resumed on the next start
+		return
+	}
+
+	t.tlock.Lock()
+	t.status.Finished = time.Now()
+	if t.status.State == StateRunning {
+		t.status.State = StateFinished
+	}
+	log.Info(fmt.Sprintf("prefetch job %s %s: %d fetched, %d skipped, %d failed", t.status.ID, t.status.State, t.status.Done, t.status.Skipped, t.status.Failed))
+	t.tlock.Unlock()
+	m.save(t)
+	m.prune()
+}
+
+// checkpoints persists the progress of the job periodically, until stop is closed
+func (m *Manager) checkpoints(t *task, stop chan struct{}) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.save(t)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// save persists the checkpoint of the job, a removed job isn't saved again
+func (m *Manager) save(t *task) {
+	m.mlock.Lock()
+	store := m.store
+	listed := m.tasks[t.status.ID] == t
+	m.mlock.Unlock()
+	if store == nil || !listed {
+		return
+	}
+	cp := t.checkpoint()
+	data, err := json.Marshal(cp)
+	if err == nil {
+		err = store.SaveState(jobPrefix+cp.Status.ID, data)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("can't save checkpoint of prefetch job %s: %v", cp.Status.ID, err))
+	}
+}
+
+// fetch gets the tile through the tile service, so it's saved into the cache, returns the size of the tile.
+// With refresh the tile is fetched from the upstream, even if it's cached.
+func fetch(ts providerFactory, tile model.Tile, refresh bool) (int64, error) {
+	get := ts.FTile
+	if refresh {
+		get = ts.Refetch
+	}
+	rd, err := get(tile)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	return io.Copy(io.Discard, rd)
+}
+
+// tiles the enumeration of the tiles of the task, the order is always the same, so a checkpoint
+// is still valid after a restart. A retry run enumerates only the failed tiles.
+func (t *task) tiles(dir string) (func(fn func(tile model.Tile) bool), error) {
+	if t.retry != nil {
+		list := t.retry
+		return func(fn func(tile model.Tile) bool) {
+			for _, tile := range list {
+				if !fn(tile) {
+					return
+				}
+			}
+		}, nil
+	}
+	job := t.status.Job
+	areas := t.areas
+	if areas == nil {
+		var err error
+		areas, err = job.areas(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	syss := extstrgutils.SplitMultiValueParam(job.Providers)
+	pols := t.status.Policy
+	return func(fn func(tile model.Tile) bool) {
+		for _, sys := range syss {
+			pp := providerPolicy(pols, sys)
+			if pp.Refused != "" {
+				continue
+			}
+			stopped := false
+			eachTile(areas, job.MinZoom, pp.maxZoom(job), func(id mercantile.TileID) bool {
+				stopped = !fn(model.Tile{Provider: sys, X: id.X, Y: id.Y, Z: id.Z})
+				return !stopped
+			})
+			if stopped {
+				return
+			}
+		}
+	}, nil
+}
+
+// wait blocks while the job is paused, returns false if the job is cancelled
+func (t *task) wait() bool {
+	t.tlock.Lock()
+	resume := t.resume
+	ctx := t.ctx
+	t.tlock.Unlock()
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// window blocks while the tile seq is size or more tiles ahead of the position, returns false if
+// the job is cancelled
+func (t *task) window(seq, size int) bool {
+	for {
+		t.tlock.Lock()
+		if seq-t.position < size {
+			t.tlock.Unlock()
+			return true
+		}
+		if t.moved == nil {
+			t.moved = make(chan struct{})
+		}
+		moved := t.moved
+		ctx := t.ctx
+		t.tlock.Unlock()
+		select {
+		case <-moved:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// complete counts the processed tile and moves the position over all processed tiles
+func (t *task) complete(seq int, o outcome) {
+	t.tlock.Lock()
+	defer t.tlock.Unlock()
+	t.status.add(o.delta)
+	t.pending[seq] = o
+	if t.moved != nil && seq == t.position {
+		close(t.moved)
+		t.moved = nil
+	}
+	for {
+		p, ok := t.pending[t.position]
+		if !ok {
+			break
+		}
+		delete(t.pending, t.position)
+		t.done.add(p.delta)
+		if p.delta.Failed > 0 && len(t.failed) < maxFailedTiles {
+			t.failed = append(t.failed, p.tile)
+		}
+		t.position++
+	}
+}
+
+// checkpoint the state to persist, an active job has only the counters up to the position
+func (t *task) checkpoint() checkpoint {
+	t.tlock.Lock()
+	defer t.tlock.Unlock()
+	cp := checkpoint{
+		Status:   t.status,
+		Active:   t.active,
+		Position: t.position,
+		Retry:    t.retry,
+		Failed:   t.failed,
+	}
+	switch t.status.State {
+	case StateRunning:
+		cp.Active += time.Since(t.since)
+		cp.Status.Progress = t.done
+	case StatePaused:
+		cp.Status.Progress = t.done
+	}
+	return cp
+}
+
+// snapshot a copy of the status with the estimated end of the job
+func (t *task) snapshot() JobStatus {
+	t.tlock.Lock()
+	defer t.tlock.Unlock()
+	s := t.status
+	if s.State != StateRunning {
+		return s
+	}
+	active := t.active + time.Since(t.since)
+	if p := s.Processed(); p > 0 && s.Total > p {
+		s.ETA = time.Now().Add(time.Duration(float64(active) / float64(p) * float64(s.Total-p)))
+	}
+	return s
+}
@@ -0,0 +1,511 @@
+package prefetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// fakeTiles a provider factory and tile cache, FTile blocks while the gate is closed
+type fakeTiles struct {
+	flock     sync.Mutex
+	cached    map[model.Tile]bool
+	stamps    map[model.Tile]time.Time
+	fetched   int
+	refetched int
+	gate      chan struct{}
+	fail      atomic.Bool
+	stuck     *model.Tile // FTile of this tile blocks until release is closed
+	release   chan struct{}
+}
+
+func (f *fakeTiles) CheckPrefetch(providerName string) error {
+	if providerName == "blocked" {
+		return errors.New("prefetching is disabled for the provider (noprefetch)")
+	}
+	return nil
+}
+
+func (f *fakeTiles) Host(providerName string) string {
+	return providerName + ".example.com"
+}
+
+func (f *fakeTiles) FTile(tile model.Tile) (io.ReadCloser, error) {
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.stuck != nil && *f.stuck == tile {
+		<-f.release
+	}
+	if tile.Provider == "broken" || f.fail.Load() {
+		return nil, errors.New("upstream error")
+	}
+	f.flock.Lock()
+	f.fetched++
+	f.flock.Unlock()
+	return io.NopCloser(strings.NewReader("tile")), nil
+}
+
+func (f *fakeTiles) Refetch(tile model.Tile) (io.ReadCloser, error) {
+	f.flock.Lock()
+	f.refetched++
+	f.flock.Unlock()
+	return io.NopCloser(strings.NewReader("new tile")), nil
+}
+
+func (f *fakeTiles) Has(tile model.Tile) bool {
+	return f.cached[tile]
+}
+
+func (f *fakeTiles) Timestamp(tile model.Tile) (time.Time, bool) {
+	ts, ok := f.stamps[tile]
+	return ts, ok
+}
+
+// fakeStore a job store in memory
+type fakeStore struct {
+	slock  sync.Mutex
+	states map[string][]byte
+}
+
+func (s *fakeStore) SaveState(key string, data []byte) error {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	s.states[key] = data
+	return nil
+}
+
+func (s *fakeStore) States(prefix string) (map[string][]byte, error) {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	states := make(map[string][]byte)
+	for k, v := range s.states {
+		if strings.HasPrefix(k, prefix) {
+			states[k] = v
+		}
+	}
+	return states, nil
+}
+
+func (s *fakeStore) DeleteState(key string) error {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+func (s *fakeStore) checkpoint(id string) checkpoint {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	var cp checkpoint
+	_ = json.Unmarshal(s.states[jobPrefix+id], &cp)
+	return cp
+}
+
+func newPersistentManager(f *fakeTiles, store *fakeStore) *Manager {
+	m := newTestManager(f)
+	do.ProvideValue(m.inj, store)
+	return m
+}
+
+func newTestManager(f *fakeTiles) *Manager {
+	inj := do.New()
+	do.ProvideValue(inj, f)
+	return newManager(inj, Config{Workers: 2})
+}
+
+func waitFor(m *Manager, id string, state string) JobStatus {
+	for range 200 {
+		s, _ := m.Job(id)
+		if s.State == state {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s, _ := m.Job(id)
+	return s
+}
+
+func TestManagerJob(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{cached: map[model.Tile]bool{{Provider: "osm", X: 0, Y: 0, Z: 0}: true}}
+	m := newTestManager(f)
+
+	s, err := m.Start(Job{Providers: "osm,blocked,broken", MinZoom: 0, MaxZoom: 1})
+	ast.NoError(err)
+	// the tiles of the refused provider are not part of the job
+	ast.Equal(10, s.Total)
+	ast.Len(s.Policy, 1)
+	ast.Equal("blocked", s.Policy[0].Provider)
+	ast.Contains(s.Policy[0].Refused, "noprefetch")
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(StateFinished, s.State)
+	ast.Equal(4, s.Done)
+	ast.Equal(1, s.Skipped)
+	ast.Equal(5, s.Failed)
+	ast.Equal(int64(16), s.Bytes)
+	ast.False(s.Finished.IsZero())
+
+	_, err = m.Start(Job{Providers: "osm", MinZoom: 3, MaxZoom: 2})
+	ast.Error(err)
+	_, err = m.Start(Job{MaxZoom: 2})
+	ast.Error(err)
+
+	// a done job can't be paused, deleting removes it
+	_, err = m.Pause(s.ID)
+	ast.ErrorIs(err, ErrJobDone)
+	_, err = m.Cancel(s.ID)
+	ast.NoError(err)
+	_, err = m.Job(s.ID)
+	ast.ErrorIs(err, ErrJobNotFound)
+}
+
+func TestManagerPauseCancel(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{gate: make(chan struct{})}
+	m := newTestManager(f)
+
+	s, err := m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 5})
+	ast.NoError(err)
+	s, err = m.Pause(s.ID)
+	ast.NoError(err)
+	ast.Equal(StatePaused, s.State)
+	// the running requests are finished, no new tiles are fetched while paused
+	close(f.gate)
+	time.Sleep(50 * time.Millisecond)
+	s, _ = m.Job(s.ID)
+	ast.LessOrEqual(s.Done, 2)
+	ast.True(s.ETA.IsZero())
+
+	s, err = m.Resume(s.ID)
+	ast.NoError(err)
+	ast.Equal(StateRunning, s.State)
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(s.Total, s.Done)
+
+	f.gate = make(chan struct{})
+	s, err = m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 5})
+	ast.NoError(err)
+	s, err = m.Cancel(s.ID)
+	ast.NoError(err)
+	ast.Equal(StateCancelled, s.State)
+	close(f.gate)
+	time.Sleep(50 * time.Millisecond)
+	s, _ = m.Job(s.ID)
+	ast.Equal(StateCancelled, s.State)
+	ast.False(s.Finished.IsZero())
+	ast.Less(s.Done, s.Total)
+	_, err = m.Resume(s.ID)
+	ast.ErrorIs(err, ErrJobDone)
+	ast.Len(m.Jobs(), 2)
+}
+
+func TestManagerRestore(t *testing.T) {
+	ast := assert.New(t)
+	store := &fakeStore{states: make(map[string][]byte)}
+	f := &fakeTiles{gate: make(chan struct{})}
+	m := newPersistentManager(f, store)
+	ast.NoError(m.Restore())
+
+	s, err := m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 4})
+	ast.NoError(err)
+	ast.Equal(341, s.Total)
+	for range 20 {
+		f.gate <- struct{}{}
+	}
+	m.Stop()
+	close(f.gate)
+	cp := store.checkpoint(s.ID)
+	ast.Equal(StateRunning, cp.Status.State)
+	ast.Equal(cp.Position, cp.Status.Processed())
+	ast.LessOrEqual(cp.Position, 20)
+
+	// a paused job stays paused after the restart
+	paused := checkpoint{Status: JobStatus{ID: "paused", Job: Job{Providers: "osm", MaxZoom: 2}, State: StatePaused, Total: 21}}
+	data, _ := json.Marshal(paused)
+	ast.NoError(store.SaveState(jobPrefix+"paused", data))
+
+	// the restarted service resumes the job at the checkpoint
+	f2 := &fakeTiles{}
+	m2 := newPersistentManager(f2, store)
+	ast.NoError(m2.Restore())
+	s = waitFor(m2, s.ID, StateFinished)
+	ast.Equal(StateFinished, s.State)
+	ast.Equal(s.Total, s.Done)
+	ast.Equal(s.Total-cp.Position, f2.fetched)
+	ast.Equal(StateFinished, store.checkpoint(s.ID).Status.State)
+	ps, err := m2.Job("paused")
+	ast.NoError(err)
+	ast.Equal(StatePaused, ps.State)
+	ast.Equal(0, ps.Done)
+
+	// the job of the config isn't started twice
+	ast.True(m2.active(Job{Providers: "osm", MaxZoom: 2}))
+	ast.False(m2.active(Job{Providers: "osm", MinZoom: 0, MaxZoom: 4}))
+
+	_, err = m2.Cancel(s.ID)
+	ast.NoError(err)
+	states, _ := store.States(jobPrefix)
+	ast.NotContains(states, jobPrefix+s.ID)
+}
+
+func TestManagerRetry(t *testing.T) {
+	ast := assert.New(t)
+	store := &fakeStore{states: make(map[string][]byte)}
+	f := &fakeTiles{}
+	f.fail.Store(true)
+	m := newPersistentManager(f, store)
+	ast.NoError(m.Restore())
+
+	s, err := m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 1})
+	ast.NoError(err)
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(5, s.Failed)
+	ast.Len(store.checkpoint(s.ID).Failed, 5)
+
+	f.fail.Store(false)
+	s, err = m.Retry(s.ID)
+	ast.NoError(err)
+	ast.Equal(StateRunning, s.State)
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(5, s.Done)
+	ast.Equal(0, s.Failed)
+	ast.Empty(store.checkpoint(s.ID).Failed)
+
+	f.gate = make(chan struct{})
+	s, err = m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 1})
+	ast.NoError(err)
+	_, err = m.Retry(s.ID)
+	ast.ErrorIs(err, ErrJobNotFinished)
+	close(f.gate)
+}
+
+func TestJobRoutes(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{gate: make(chan struct{})}
+	m := newTestManager(f)
+	do.ProvideValue(m.inj, m)
+	srv := httptest.NewServer(Routes(m.inj))
+	defer srv.Close()
+
+	rs, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"providers": "osm", "minzoom": 0, "maxzoom": 4, "bbox": "0,0,10,10"}`))
+	ast.NoError(err)
+	ast.Equal(http.StatusCreated, rs.StatusCode)
+	var s JobStatus
+	ast.NoError(json.NewDecoder(rs.Body).Decode(&s))
+	rs.Body.Close()
+	ast.Equal(StateRunning, s.State)
+	ast.Equal("0,0,10,10", s.Job.BBox)
+
+	rs, err = http.Post(srv.URL+"/"+s.ID+"/pause", "application/json", nil)
+	ast.NoError(err)
+	ast.Equal(http.StatusOK, rs.StatusCode)
+	rs.Body.Close()
+
+	rs, err = http.Get(srv.URL)
+	ast.NoError(err)
+	var list []JobStatus
+	ast.NoError(json.NewDecoder(rs.Body).Decode(&list))
+	rs.Body.Close()
+	ast.Len(list, 1)
+	ast.Equal(StatePaused, list[0].State)
+
+	rq, _ := http.NewRequest(http.MethodDelete, srv.URL+"/"+s.ID, nil)
+	rs, err = http.DefaultClient.Do(rq)
+	ast.NoError(err)
+	ast.Equal(http.StatusOK, rs.StatusCode)
+	rs.Body.Close()
+	close(f.gate)
+
+	rs, err = http.Post(srv.URL+"/"+s.ID+"/resume", "application/json", nil)
+	ast.NoError(err)
+	ast.Equal(http.StatusConflict, rs.StatusCode)
+	rs.Body.Close()
+
+	rs, err = http.Get(srv.URL + "/unknown")
+	ast.NoError(err)
+	ast.Equal(http.StatusNotFound, rs.StatusCode)
+	rs.Body.Close()
+
+	rs, err = http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"providers": "osm", "minzoom": 5, "maxzoom": 4}`))
+	ast.NoError(err)
+	ast.Equal(http.StatusBadRequest, rs.StatusCode)
+	rs.Body.Close()
+}
+
+func TestJobRoutesFiles(t *testing.T) {
+	ast := assert.New(t)
+	dir := t.TempDir()
+	gj := `{"type": "Polygon", "coordinates": [[[7, 50], [8, 50], [8, 51], [7, 50]]]}`
+	ast.NoError(os.WriteFile(filepath.Join(dir, "area.geojson"), []byte(gj), 0o644))
+	f := &fakeTiles{}
+	m := newTestManager(f)
+	do.ProvideValue(m.inj, m)
+	srv := httptest.NewServer(Routes(m.inj))
+	defer srv.Close()
+
+	post := func(path, job string) (int, string) {
+		rs, err := http.Post(srv.URL+path, "application/json", bytes.NewBufferString(job))
+		ast.NoError(err)
+		defer rs.Body.Close()
+		body, _ := io.ReadAll(rs.Body)
+		return rs.StatusCode, string(body)
+	}
+
+	// without a files directory no files are read
+	code, body := post("/estimate", `{"providers": "osm", "minzoom": 0, "maxzoom": 4, "areafile": "area.geojson"}`)
+	ast.Equal(http.StatusBadRequest, code)
+	ast.Contains(body, ErrFilesDisabled.Error())
+
+	m.files = dir
+	code, _ = post("/estimate", `{"providers": "osm", "minzoom": 0, "maxzoom": 4, "areafile": "area.geojson"}`)
+	ast.Equal(http.StatusOK, code)
+	code, _ = post("", `{"providers": "osm", "minzoom": 0, "maxzoom": 4, "areafile": "area.geojson"}`)
+	ast.Equal(http.StatusCreated, code)
+
+	for _, file := range []string{"../area.geojson", "sub/../../area.geojson", filepath.Join(dir, "area.geojson"), "/etc/passwd"} {
+		code, body = post("", fmt.Sprintf(`{"providers": "osm", "minzoom": 0, "maxzoom": 4, "route": %q}`, file))
+		ast.Equal(http.StatusBadRequest, code, file)
+		ast.Contains(body, ErrInvalidFile.Error())
+		ast.NotContains(body, dir)
+	}
+
+	// the error doesn't show the path on the server
+	code, body = post("/estimate", `{"providers": "osm", "minzoom": 0, "maxzoom": 4, "areafile": "missing.geojson"}`)
+	ast.Equal(http.StatusBadRequest, code)
+	ast.Contains(body, "missing.geojson")
+	ast.NotContains(body, dir)
+}
+
+func TestJobWindow(t *testing.T) {
+	ast := assert.New(t)
+	stuck := model.Tile{Provider: "osm", Z: 0, X: 0, Y: 0}
+	f := &fakeTiles{stuck: &stuck, release: make(chan struct{})}
+	m := newTestManager(f)
+
+	s, err := m.Start(Job{Providers: "osm", MinZoom: 0, MaxZoom: 5})
+	ast.NoError(err)
+	window := windowPerWorker * m.workers
+	// the first tile hangs, the others are fetched up to the window
+	for range 200 {
+		if s, _ = m.Job(s.ID); s.Done == window-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	s, _ = m.Job(s.ID)
+	ast.Equal(window-1, s.Done)
+	tk, err := m.task(s.ID)
+	ast.NoError(err)
+	tk.tlock.Lock()
+	ast.Equal(0, tk.position)
+	ast.Len(tk.pending, window-1)
+	tk.tlock.Unlock()
+
+	close(f.release)
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(1365, s.Done)
+	ast.Empty(tk.pending)
+}
+
+func TestJobMaxZoom(t *testing.T) {
+	ast := assert.New(t)
+	m := newTestManager(&fakeTiles{})
+	do.ProvideValue(m.inj, m)
+
+	for _, z := range []int{maxJobZoom + 1, 32, 1 << 40} {
+		job := Job{Providers: "osm", MaxZoom: z, BBox: "7,50,8,51"}
+		_, err := m.Start(job)
+		ast.Error(err, z)
+		_, err = m.Estimate(job)
+		ast.Error(err, z)
+		ast.Error(m.AddSchedule(Schedule{Name: "deep", Cron: "@daily", Job: job}), z)
+	}
+	ast.Empty(m.Jobs())
+
+	_, _, err := Job{Providers: "osm", MinZoom: maxJobZoom, MaxZoom: maxJobZoom, BBox: "7,50,7.001,50.001"}.validate("")
+	ast.NoError(err)
+
+	srv := httptest.NewServer(Routes(m.inj))
+	defer srv.Close()
+	rs, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"providers": "osm", "minzoom": 0, "maxzoom": 1099511627776}`))
+	ast.NoError(err)
+	ast.Equal(http.StatusBadRequest, rs.StatusCode)
+	rs.Body.Close()
+}
+
+func TestManagerPrune(t *testing.T) {
+	ast := assert.New(t)
+	store := &fakeStore{states: make(map[string][]byte)}
+	// done jobs of an earlier run, a running job and orphaned runs of a schedule
+	start := time.Now().Add(-time.Hour)
+	for i := range maxDoneJobs + 5 {
+		s := JobStatus{ID: fmt.Sprintf("done%d", i), Job: Job{Providers: "osm"}, State: StateFinished, Started: start.Add(time.Duration(i) * time.Second)}
+		data, _ := json.Marshal(checkpoint{Status: s})
+		ast.NoError(store.SaveState(jobPrefix+s.ID, data))
+	}
+	for i := range maxRuns + 3 {
+		s := JobStatus{ID: fmt.Sprintf("run%d", i), Job: Job{Providers: "osm"}, State: StateCancelled, Schedule: "gone", Started: start.Add(time.Duration(i) * time.Second)}
+		data, _ := json.Marshal(checkpoint{Status: s})
+		ast.NoError(store.SaveState(jobPrefix+s.ID, data))
+	}
+	paused := JobStatus{ID: "paused", Job: Job{Providers: "osm", MaxZoom: 1}, State: StatePaused, Total: 5, Started: start.Add(-time.Hour)}
+	data, _ := json.Marshal(checkpoint{Status: paused})
+	ast.NoError(store.SaveState(jobPrefix+"paused", data))
+
+	m := newPersistentManager(&fakeTiles{}, store)
+	ast.NoError(m.Restore())
+	states, err := store.States(jobPrefix)
+	ast.NoError(err)
+	ast.Len(states, maxDoneJobs+maxRuns+1)
+	ast.Len(m.Jobs(), maxDoneJobs+maxRuns+1)
+	// the oldest done jobs are removed, the paused job is kept
+	_, err = m.Job("done0")
+	ast.ErrorIs(err, ErrJobNotFound)
+	_, err = m.Job("done5")
+	ast.NoError(err)
+	_, err = m.Job("run2")
+	ast.ErrorIs(err, ErrJobNotFound)
+	_, err = m.Job("paused")
+	ast.NoError(err)
+
+	// a finished job pushes out the oldest done job
+	s, err := m.Start(Job{Providers: "osm", MaxZoom: 0})
+	ast.NoError(err)
+	waitFor(m, s.ID, StateFinished)
+	for range 100 {
+		if _, err = m.Job("done5"); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ast.ErrorIs(err, ErrJobNotFound)
+	ast.Len(m.Jobs(), maxDoneJobs+maxRuns+1)
+	states, err = store.States(jobPrefix)
+	ast.NoError(err)
+	ast.NotContains(states, jobPrefix+"done5")
+
+	// a removed job isn't saved again
+	_, err = m.Cancel(s.ID)
+	ast.NoError(err)
+	m.save(&task{status: s})
+	states, err = store.States(jobPrefix)
+	ast.NoError(err)
+	ast.NotContains(states, jobPrefix+s.ID)
+}
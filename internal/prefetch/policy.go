@@ -0,0 +1,211 @@
+package prefetch
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/willie68/go_mapproxy/configs"
+)
+
+// Policy restricts the prefetching per upstream host. The patterns are host names, which match the
+// host and its subdomains, globs like *.example.com or regular expressions in slashes like /^a\.b$/.
+type Policy struct {
+	Blacklist []string     `yaml:"blacklist" json:"blacklist,omitempty"` // hosts not allowed to prefetch from, in addition to the embedded blacklist
+	Whitelist []string     `yaml:"whitelist" json:"whitelist,omitempty"` // hosts allowed to prefetch from, even if blacklisted
+	Hosts     []HostPolicy `yaml:"hosts" json:"hosts,omitempty"`         // limits per host, the first matching entry is used
+}
+
+// HostPolicy the prefetch limits of the hosts matching the pattern
+type HostPolicy struct {
+	Host    string  `yaml:"host" json:"host"`
+	MaxZoom int     `yaml:"maxzoom" json:"maxzoom,omitempty"` // max zoom prefetched from the host, 0 for unlimited
+	Rate    float64 `yaml:"rate" json:"rate,omitempty"`       // max tile requests per second to the host over all jobs, 0 for unlimited
+}
+
+// ProviderPolicy the policy applied to a provider of a job, only restricted providers are listed
+type ProviderPolicy struct {
+	Provider string  `json:"provider"`
+	Host     string  `json:"host,omitempty"`
+	Refused  string  `json:"refused,omitempty"` // the reason, why the provider isn't prefetched
+	MaxZoom  int     `json:"maxzoom,omitempty"` // max zoom prefetched, limited by the host policy
+	Rate     float64 `json:"rate,omitempty"`    // max tile requests per second to the host
+}
+
+// hostPattern a compiled host pattern, src is the pattern for the messages
+type hostPattern struct {
+	src   string
+	match func(host string) bool
+}
+
+// policy the compiled prefetch policy
+type policy struct {
+	blacklist []hostPattern
+	whitelist []hostPattern
+	hosts     []HostPolicy
+	patterns  []hostPattern // the patterns of the hosts
+	llock     sync.Mutex
+	limiters  map[string]*limiter // per host, shared by all jobs
+}
+
+// newPolicy compiles the policy, the embedded blacklist is added to the blacklist
+func newPolicy(p Policy) (*policy, error) {
+	pol := &policy{hosts: p.Hosts, limiters: make(map[string]*limiter)}
+	for _, src := range configs.PrefetchBlacklist() {
+		if strings.TrimSpace(src) == "" {
+			continue
+		}
+		hp, err := compileHostPattern(src)
+		if err != nil {
+			return nil, err
+		}
+		hp.src = fmt.Sprintf("%s (embedded blacklist)", hp.src)
+		pol.blacklist = append(pol.blacklist, hp)
+	}
+	for _, list := range []struct {
+		srcs []string
+		dst  *[]hostPattern
+	}{{p.Blacklist, &pol.blacklist}, {p.Whitelist, &pol.whitelist}} {
+		for _, src := range list.srcs {
+			hp, err := compileHostPattern(src)
+			if err != nil {
+				return nil, err
+			}
+			*list.dst = append(*list.dst, hp)
+		}
+	}
+	for _, h := range p.Hosts {
+		hp, err := compileHostPattern(h.Host)
+		if err != nil {
+			return nil, err
+		}
+		pol.patterns = append(pol.patterns, hp)
+	}
+	return pol, nil
+}
+
+func compileHostPattern(src string) (hostPattern, error) {
+	src = strings.TrimSpace(src)
+	hp := hostPattern{src: src}
+	switch {
+	case src == "":
+		return hp, fmt.Errorf("empty host pattern")
+	case len(src) > 2 && strings.HasPrefix(src, "/") && strings.HasSuffix(src, "/"):
+		re, err := regexp.Compile(src[1 : len(src)-1])
+		if err != nil {
+			return hp, fmt.Errorf("invalid host pattern %s: %v", src, err)
+		}
+		hp.match = re.MatchString
+	case strings.ContainsAny(src, "*?["):
+		glob := strings.ToLower(src)
+		if _, err := path.Match(glob, ""); err != nil {
+			return hp, fmt.Errorf("invalid host pattern %s: %v", src, err)
+		}
+		hp.match = func(host string) bool {
+			ok, _ := path.Match(glob, host)
+			return ok
+		}
+	default:
+		name := strings.ToLower(src)
+		hp.match = func(host string) bool {
+			return host == name || strings.HasSuffix(host, "."+name)
+		}
+	}
+	return hp, nil
+}
+
+// check returns the reason, why prefetching from the host is refused, nil if it is allowed.
+// Local providers have no host and are always allowed.
+func (p *policy) check(host string) error {
+	if host == "" {
+		return nil
+	}
+	for _, w := range p.whitelist {
+		if w.match(host) {
+			return nil
+		}
+	}
+	for _, b := range p.blacklist {
+		if b.match(host) {
+			return fmt.Errorf("host %s is blacklisted by %s", host, b.src)
+		}
+	}
+	return nil
+}
+
+// host the limits of the host, zero if there are none
+func (p *policy) host(host string) HostPolicy {
+	if host == "" {
+		return HostPolicy{}
+	}
+	for i, hp := range p.patterns {
+		if hp.match(host) {
+			return p.hosts[i]
+		}
+	}
+	return HostPolicy{}
+}
+
+// limiter the rate limiter of the host, nil if the rate isn't limited
+func (p *policy) limiter(host string) *limiter {
+	hp := p.host(host)
+	if hp.Rate <= 0 {
+		return nil
+	}
+	p.llock.Lock()
+	defer p.llock.Unlock()
+	l, ok := p.limiters[host]
+	if !ok {
+		l = newLimiter(hp.Rate)
+		p.limiters[host] = l
+	}
+	return l
+}
+
+// providers evaluates the policy for the providers of the job, only restricted providers are returned.
+// A provider is refused, if it can't be prefetched, its host is blacklisted or all zoom levels
+// of the job are above the max zoom of the host.
+func (m *Manager) providers(ts providerFactory, job Job, syss []string) []ProviderPolicy {
+	pols := make([]ProviderPolicy, 0)
+	for _, sys := range syss {
+		host := ts.Host(sys)
+		pp := ProviderPolicy{Provider: sys, Host: host}
+		if err := ts.CheckPrefetch(sys); err != nil {
+			pp.Refused = err.Error()
+		} else if err := m.policy.check(host); err != nil {
+			pp.Refused = err.Error()
+		}
+		hp := m.policy.host(host)
+		if pp.Refused == "" && hp.MaxZoom > 0 && hp.MaxZoom < job.MaxZoom {
+			pp.MaxZoom = hp.MaxZoom
+			if job.MinZoom > hp.MaxZoom {
+				pp.Refused = fmt.Sprintf("zoom %d-%d is above the max zoom %d of host %s", job.MinZoom, job.MaxZoom, hp.MaxZoom, host)
+			}
+		}
+		pp.Rate = hp.Rate
+		if pp.Refused != "" || pp.MaxZoom > 0 || pp.Rate > 0 {
+			pols = append(pols, pp)
+		}
+	}
+	return pols
+}
+
+// providerPolicy the policy of the provider, zero if the provider isn't restricted
+func providerPolicy(pols []ProviderPolicy, sys string) ProviderPolicy {
+	for _, pp := range pols {
+		if pp.Provider == sys {
+			return pp
+		}
+	}
+	return ProviderPolicy{Provider: sys}
+}
+
+// maxZoom the max zoom of the provider in the job
+func (pp ProviderPolicy) maxZoom(job Job) int {
+	if pp.MaxZoom > 0 {
+		return min(pp.MaxZoom, job.MaxZoom)
+	}
+	return job.MaxZoom
+}
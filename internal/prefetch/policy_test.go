@@ -0,0 +1,107 @@
+package prefetch
+
+import (
+	"testing"
+
+	"github.com/samber/do/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	ast := assert.New(t)
+	p, err := newPolicy(Policy{
+		Blacklist: []string{"*.tiles.example.com", `/^tile\d\.example\.org$/`, "example.net"},
+		Whitelist: []string{"a.tiles.example.com"},
+		Hosts:     []HostPolicy{{Host: "*.example.org", MaxZoom: 12, Rate: 5}, {Host: "example.org", Rate: 1}},
+	})
+	ast.NoError(err)
+
+	// the embedded blacklist
+	err = p.check("a.tile.openstreetmap.de")
+	ast.ErrorContains(err, "embedded blacklist")
+	ast.ErrorContains(p.check("b.tiles.example.com"), "*.tiles.example.com")
+	ast.NoError(p.check("a.tiles.example.com"))
+	ast.Error(p.check("tile1.example.org"))
+	ast.NoError(p.check("tile10.example.org"))
+	ast.Error(p.check("example.net"))
+	ast.Error(p.check("www.example.net"))
+	ast.NoError(p.check("myexample.net"))
+	ast.NoError(p.check(""))
+
+	ast.Equal(12, p.host("tile10.example.org").MaxZoom)
+	ast.Equal(1.0, p.host("example.org").Rate)
+	ast.Equal(HostPolicy{}, p.host("example.com"))
+	ast.Nil(p.limiter("example.com"))
+	ast.NotNil(p.limiter("example.org"))
+	ast.Same(p.limiter("example.org"), p.limiter("example.org"))
+
+	_, err = newPolicy(Policy{Blacklist: []string{"/[/"}})
+	ast.Error(err)
+	_, err = newPolicy(Policy{Hosts: []HostPolicy{{Host: "[a"}}})
+	ast.Error(err)
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	ast := assert.New(t)
+	inj := do.New()
+	do.ProvideValue(inj, &fakeTiles{})
+	// an invalid policy falls back to the embedded blacklist
+	m := newManager(inj, Config{Policy: Policy{
+		Whitelist: []string{"*.tile.openstreetmap.de"},
+		Blacklist: []string{"/[/"},
+	}})
+	ast.ErrorContains(m.policy.check("a.tile.openstreetmap.de"), "embedded blacklist")
+	ast.NoError(m.policy.check("example.com"))
+}
+
+func TestPolicyJob(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{}
+	inj := do.New()
+	do.ProvideValue(inj, f)
+	m := newManager(inj, Config{Workers: 2, Policy: Policy{
+		Blacklist: []string{"denied.example.com"},
+		Hosts:     []HostPolicy{{Host: "osm.example.com", MaxZoom: 1, Rate: 1000}},
+	}})
+
+	s, err := m.Start(Job{Providers: "osm,denied", MaxZoom: 2})
+	ast.NoError(err)
+	// osm only up to zoom 1
+	ast.Equal(5, s.Total)
+	ast.Len(s.Policy, 2)
+	ast.Equal(ProviderPolicy{Provider: "osm", Host: "osm.example.com", MaxZoom: 1, Rate: 1000}, s.Policy[0])
+	ast.Contains(s.Policy[1].Refused, "host denied.example.com is blacklisted")
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(5, s.Done)
+	ast.Equal(0, s.Skipped)
+
+	_, err = m.Start(Job{Providers: "denied,blocked", MaxZoom: 2})
+	ast.ErrorContains(err, "denied: host denied.example.com is blacklisted")
+	ast.ErrorContains(err, "blocked: prefetching is disabled")
+	_, err = m.Start(Job{Providers: "osm", MinZoom: 2, MaxZoom: 3})
+	ast.ErrorContains(err, "above the max zoom 1")
+
+	e, err := m.Estimate(Job{Providers: "osm", MaxZoom: 2})
+	ast.NoError(err)
+	ast.True(e.Zooms[1].Prefetchable)
+	ast.False(e.Zooms[2].Prefetchable)
+	ast.Contains(e.Zooms[2].Refused, "max zoom 1")
+}
+
+func TestPolicyResume(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{cached: map[model.Tile]bool{}}
+	inj := do.New()
+	do.ProvideValue(inj, f)
+	m := newManager(inj, Config{Workers: 2})
+
+	// a resumed job of a provider blacklisted after the start skips its tiles
+	tk := newTask(JobStatus{Job: Job{Providers: "osm,denied", MaxZoom: 1}, State: StateRunning, Total: 10})
+	m.add(tk)
+	m.policy, _ = newPolicy(Policy{Blacklist: []string{"denied.example.com"}})
+	go m.run(tk)
+	s := waitFor(m, tk.status.ID, StateFinished)
+	ast.Equal(5, s.Done)
+	ast.Equal(5, s.Skipped)
+}
@@ -1,20 +1,151 @@
 package prefetch
 
 import (
+	"errors"
 	"fmt"
 	"io"
-	"sync"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/samber/do/v2"
 	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
 	"github.com/willie68/go_mapproxy/internal/model"
 	"github.com/willie68/go_mapproxy/pkg/extstrgutils"
 )
 
 var log = logging.New("prefetch")
 
+// maxJobZoom the highest zoom level of a prefetch job
+const maxJobZoom = 24
+
 type Config struct {
-	Workers int `yaml:"workers"` // number of parallel workers
+	Workers   int        `yaml:"workers"`   // number of parallel workers of a job
+	Rate      float64    `yaml:"rate"`      // max tile requests per second of a job, 0 for unlimited
+	Samples   int        `yaml:"samples"`   // tiles per zoom level sampled by an estimation (dry run)
+	Jobs      []Job      `yaml:"jobs"`      // prefetch jobs started with the service
+	Schedules []Schedule `yaml:"schedules"` // prefetch jobs started periodically
+	Policy    Policy     `yaml:"policy"`    // restrictions of the prefetching per upstream host
+	Files     string     `yaml:"files"`     // directory of the area and route files, relative file names of the jobs are resolved against it
+}
+
+// Job a prefetch job, it fetches the tiles of the providers in the zoom range. The tiles can be
+// restricted to a bbox, the polygons of a GeoJSON file and/or the corridor along a route, without
+// any of them the whole world is fetched.
+type Job struct {
+	Providers string `yaml:"providers" json:"providers"` // provider names, csv if more than one
+	MinZoom   int    `yaml:"minzoom" json:"minzoom"`
+	MaxZoom   int    `yaml:"maxzoom" json:"maxzoom"`
+	BBox      string `yaml:"bbox" json:"bbox,omitempty"`         // west,south,east,north in degrees
+	AreaFile  string `yaml:"areafile" json:"areafile,omitempty"` // GeoJSON file with polygons or multipolygons
+	Route     string `yaml:"route" json:"route,omitempty"`       // GPX file (tracks, routes) or GeoJSON file with linestrings
+	Buffer    string `yaml:"buffer" json:"buffer,omitempty"`     // width of the corridor on each side of the route, e.g. 5nm, 10km, default unit is nm
+	Refresh   int    `yaml:"refresh" json:"refresh,omitempty"`   // in hours, cached tiles older than this are fetched again, 0 fetches only missing tiles
+}
+
+// validate checks the job, returns the providers and the areas of the job. Relative area and route
+// files are resolved against the directory dir.
+func (j Job) validate(dir string) ([]string, []area, error) {
+	syss := extstrgutils.SplitMultiValueParam(j.Providers)
+	if len(syss) == 0 {
+		return nil, nil, fmt.Errorf("prefetch job needs a provider")
+	}
+	if j.MinZoom < 0 || j.MinZoom > j.MaxZoom {
+		return nil, nil, fmt.Errorf("invalid zoom range %d-%d", j.MinZoom, j.MaxZoom)
+	}
+	if j.MaxZoom > maxJobZoom {
+		return nil, nil, fmt.Errorf("max zoom %d is above %d", j.MaxZoom, maxJobZoom)
+	}
+	if j.Refresh < 0 {
+		return nil, nil, fmt.Errorf("invalid refresh age %d", j.Refresh)
+	}
+	areas, err := j.areas(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return syss, areas, nil
+}
+
+// areas the areas of the job, empty for the whole world
+func (j Job) areas(dir string) ([]area, error) {
+	areas := make([]area, 0)
+	if j.BBox != "" {
+		bb, err := mercantile.ParseBbox(j.BBox)
+		if err != nil {
+			return nil, err
+		}
+		areas = append(areas, bboxArea(bb))
+	}
+	if j.AreaFile != "" {
+		a, err := readAreaFile(dir, j.AreaFile)
+		if err != nil {
+			return nil, err
+		}
+		areas = append(areas, a...)
+	}
+	if j.Route != "" {
+		buffer, err := ParseDistance(j.Buffer)
+		if err != nil {
+			return nil, err
+		}
+		a, err := readRouteFile(dir, j.Route, buffer)
+		if err != nil {
+			return nil, err
+		}
+		areas = append(areas, a...)
+	}
+	return areas, nil
+}
+
+// checkFiles checks the area and route files of a job posted to the REST interface, they must be
+// names in the files directory. Other files of the server can't be read this way.
+func (j Job) checkFiles(dir string) error {
+	for _, file := range []string{j.AreaFile, j.Route} {
+		if file == "" {
+			continue
+		}
+		if dir == "" {
+			return ErrFilesDisabled
+		}
+		if !filepath.IsLocal(file) {
+			return ErrInvalidFile
+		}
+	}
+	return nil
+}
+
+// readJobFile reads an area or route file, a relative file is resolved against the directory dir.
+// Errors only contain the file name of the job, not the path on the server.
+func readJobFile(dir, file string) ([]byte, error) {
+	name := file
+	if dir != "" && !filepath.IsAbs(file) {
+		name = filepath.Join(dir, file)
+	}
+	data, err := os.ReadFile(name)
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		perr.Path = file
+	}
+	return data, err
+}
+
+func (j Job) String() string {
+	s := fmt.Sprintf("providers \"%s\" with zoom %d-%d", j.Providers, j.MinZoom, j.MaxZoom)
+	if j.BBox != "" {
+		s += fmt.Sprintf(", bbox %s", j.BBox)
+	}
+	if j.AreaFile != "" {
+		s += fmt.Sprintf(", area %s", j.AreaFile)
+	}
+	if j.Route != "" {
+		s += fmt.Sprintf(", route %s (buffer %s)", j.Route, j.Buffer)
+	}
+	if j.Refresh > 0 {
+		s += fmt.Sprintf(", refreshing tiles older than %dh", j.Refresh)
+	}
+	return s
 }
 
 type pfConfig interface {
@@ -22,82 +153,57 @@ type pfConfig interface {
 }
 
 type providerFactory interface {
-	IsPrefetchable(providerName string) bool
+	CheckPrefetch(providerName string) error
+	Host(providerName string) string
 	FTile(tile model.Tile) (io.ReadCloser, error)
+	Refetch(tile model.Tile) (io.ReadCloser, error)
 }
 
 type tileCache interface {
 	Has(tile model.Tile) bool
+	Timestamp(tile model.Tile) (time.Time, bool)
 }
 
 var myinj do.Injector
 
 func Init(inj do.Injector) {
 	myinj = inj
+	cfg := do.MustInvokeAs[pfConfig](inj).GetPrefetchConfig()
+	do.ProvideValue(inj, newManager(inj, cfg))
+}
+
+// RestoreJobs resumes the prefetch jobs interrupted by the last stop of the service
+func RestoreJobs() {
+	if err := do.MustInvoke[*Manager](myinj).Restore(); err != nil {
+		log.Warn(fmt.Sprintf("prefetch jobs are not persisted: %v", err))
+	}
 }
 
-// Prefetch lädt Kacheln für die angegebenen Systeme und Zoomstufen vor.
-func Prefetch(providers string, maxzoom int) {
-	if providers != "" && maxzoom > 0 {
-		go func() {
-			log.Info(fmt.Sprintf("starting prefetch for providers \"%s\" with zoom %d", providers, maxzoom))
-			prefetch(providers, maxzoom)
-			log.Info("prefetch finnished")
-		}()
+// Prefetch startet einen Job im Manager, der Kacheln für die angegebenen Systeme, Zoomstufen und Gebiete vorlädt.
+// Ist derselbe Job nach einem Neustart schon fortgesetzt worden, wird kein neuer gestartet.
+func Prefetch(job Job) {
+	if job.Providers != "" && job.MaxZoom > 0 {
+		m := do.MustInvoke[*Manager](myinj)
+		if m.active(job) {
+			log.Info(fmt.Sprintf("prefetch for %s is already running", job.String()))
+			return
+		}
+		if _, err := m.Start(job); err != nil {
+			log.Error(fmt.Sprintf("can't start prefetch for %s: %v", job.String(), err))
+		}
 	}
 }
 
-func prefetch(providers string, maxzoom int) error {
+// PrefetchJobs starts the prefetch jobs and the schedules of the config
+func PrefetchJobs() {
 	cfg := do.MustInvokeAs[pfConfig](myinj).GetPrefetchConfig()
-	workers := 10
-	if cfg.Workers > 0 {
-		workers = cfg.Workers
-	}
-	syss := extstrgutils.SplitMultiValueParam(providers)
-	fmt.Printf("syss: %v", syss)
-	jobs := make(chan model.Tile, 1000)
-	wg := sync.WaitGroup{}
-
-	ts := do.MustInvokeAs[providerFactory](myinj)
-	cache := do.MustInvokeAs[tileCache](myinj)
-
-	// Worker starten
-	for range workers {
-		wg.Go(func() {
-			for j := range jobs {
-				if ts.IsPrefetchable(j.Provider) {
-					rd, err := ts.FTile(j)
-					if err != nil {
-						log.Error(fmt.Sprintf("error getting tile: %v", err))
-						continue
-					}
-					defer rd.Close()
-					log.Info(fmt.Sprintf("fetched tile: %v", j))
-				}
-			}
-		})
-	}
-
-	for _, sys := range syss {
-		// Jobs erzeugen
-		for z := range maxzoom + 1 {
-			rg := 1 << z
-			for x := range rg {
-				for y := range rg {
-					tile := model.Tile{
-						Provider: sys,
-						X:        x,
-						Y:        y,
-						Z:        z,
-					}
-					if !cache.Has(tile) {
-						jobs <- tile
-					}
-				}
-			}
+	for _, job := range cfg.Jobs {
+		Prefetch(job)
+	}
+	m := do.MustInvoke[*Manager](myinj)
+	for _, s := range cfg.Schedules {
+		if err := m.AddSchedule(s); err != nil {
+			log.Error(fmt.Sprintf("can't schedule prefetch %s: %v", s.Name, err))
 		}
 	}
-	close(jobs)
-	wg.Wait()
-	return nil
 }
@@ -0,0 +1,115 @@
+package prefetch
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRuns the number of runs of a schedule kept in the history
+const maxRuns = 10
+
+// Schedule a prefetch job started periodically, e.g. to refresh the cached tiles of the home waters
+type Schedule struct {
+	Name string `yaml:"name" json:"name"`
+	Cron string `yaml:"cron" json:"cron"` // minute hour day-of-month month day-of-week, e.g. "0 2 * * sun", or @hourly, @daily, @weekly, @monthly
+	Job  Job    `yaml:"job" json:"job"`
+}
+
+// ScheduleStatus a schedule with its next start and the history of its runs
+type ScheduleStatus struct {
+	Schedule
+	Next time.Time   `json:"next,omitzero"`
+	Runs []JobStatus `json:"runs"` // the last runs, the newest first
+}
+
+// schedule a schedule managed by the manager
+type schedule struct {
+	Schedule
+	cron *cronSchedule
+	next time.Time
+}
+
+// AddSchedule validates the schedule and starts its job at the times of the cron expression
+func (m *Manager) AddSchedule(s Schedule) error {
+	if s.Name == "" {
+		return fmt.Errorf("schedule needs a name")
+	}
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	if _, _, err := s.Job.validate(m.files); err != nil {
+		return err
+	}
+	sc := &schedule{Schedule: s, cron: cron}
+	m.slock.Lock()
+	for _, o := range m.sched {
+		if o.Name == s.Name {
+			m.slock.Unlock()
+			return fmt.Errorf("schedule %s already exists", s.Name)
+		}
+	}
+	m.sched = append(m.sched, sc)
+	m.slock.Unlock()
+	go m.runSchedule(sc)
+	return nil
+}
+
+// Schedules the schedules with their next start and their last runs
+func (m *Manager) Schedules() []ScheduleStatus {
+	jobs := m.Jobs()
+	m.slock.Lock()
+	defer m.slock.Unlock()
+	list := make([]ScheduleStatus, 0, len(m.sched))
+	for _, sc := range m.sched {
+		ss := ScheduleStatus{Schedule: sc.Schedule, Next: sc.next, Runs: make([]JobStatus, 0)}
+		for _, j := range jobs {
+			if j.Schedule == sc.Name {
+				ss.Runs = append(ss.Runs, j)
+			}
+		}
+		list = append(list, ss)
+	}
+	return list
+}
+
+// runSchedule waits for the next start of the schedule and runs it, until the manager is stopped
+func (m *Manager) runSchedule(sc *schedule) {
+	for {
+		next := sc.cron.next(time.Now())
+		m.slock.Lock()
+		sc.next = next
+		m.slock.Unlock()
+		if next.IsZero() {
+			log.Warn(fmt.Sprintf("schedule %s has no next start", sc.Name))
+			return
+		}
+		log.Info(fmt.Sprintf("next start of the scheduled prefetch %s: %s", sc.Name, next.Format(time.RFC3339)))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-m.done:
+			timer.Stop()
+			return
+		}
+		m.runScheduled(sc)
+	}
+}
+
+// runScheduled starts the job of the schedule, unless the last run is still active. A job, which
+// can't be started, is recorded as failed run. Only the last runs are kept.
+func (m *Manager) runScheduled(sc *schedule) {
+	if m.active(sc.Job) {
+		log.Warn(fmt.Sprintf("scheduled prefetch %s is still running, skipped", sc.Name))
+		return
+	}
+	log.Info(fmt.Sprintf("starting scheduled prefetch %s", sc.Name))
+	if _, err := m.start(sc.Job, sc.Name); err != nil {
+		log.Error(fmt.Sprintf("can't start scheduled prefetch %s: %v", sc.Name, err))
+		now := time.Now()
+		t := newTask(JobStatus{Job: sc.Job, State: StateFailed, Started: now, Finished: now, Schedule: sc.Name, Error: err.Error()})
+		m.add(t)
+		m.save(t)
+	}
+	m.prune()
+}
@@ -0,0 +1,87 @@
+package prefetch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestRefreshJob(t *testing.T) {
+	ast := assert.New(t)
+	old := time.Now().Add(-48 * time.Hour)
+	f := &fakeTiles{
+		cached: map[model.Tile]bool{{Provider: "osm", Z: 0}: true, {Provider: "osm", Z: 1}: true},
+		stamps: map[model.Tile]time.Time{{Provider: "osm", Z: 0}: old, {Provider: "osm", Z: 1}: time.Now()},
+	}
+	m := newTestManager(f)
+
+	s, err := m.Start(Job{Providers: "osm", MaxZoom: 1, Refresh: 24})
+	ast.NoError(err)
+	s = waitFor(m, s.ID, StateFinished)
+	// the old tile is fetched again, the new one is skipped
+	ast.Equal(1, f.refetched)
+	ast.Equal(3, f.fetched)
+	ast.Equal(4, s.Done)
+	ast.Equal(1, s.Skipped)
+
+	// without refresh cached tiles are skipped
+	s, err = m.Start(Job{Providers: "osm", MaxZoom: 1})
+	ast.NoError(err)
+	s = waitFor(m, s.ID, StateFinished)
+	ast.Equal(1, f.refetched)
+	ast.Equal(2, s.Skipped)
+
+	_, err = m.Start(Job{Providers: "osm", MaxZoom: 1, Refresh: -1})
+	ast.Error(err)
+}
+
+func TestSchedules(t *testing.T) {
+	ast := assert.New(t)
+	f := &fakeTiles{}
+	m := newTestManager(f)
+	defer m.Stop()
+
+	home := Schedule{Name: "home", Cron: "0 2 * * sun", Job: Job{Providers: "osm", MaxZoom: 1, Refresh: 24}}
+	ast.NoError(m.AddSchedule(home))
+	ast.Error(m.AddSchedule(home))
+	ast.Error(m.AddSchedule(Schedule{Name: "bad", Cron: "0 2 * *", Job: home.Job}))
+	ast.Error(m.AddSchedule(Schedule{Name: "bad", Cron: "@daily", Job: Job{Providers: "osm", MinZoom: 2, MaxZoom: 1}}))
+	ast.Error(m.AddSchedule(Schedule{Cron: "@daily", Job: home.Job}))
+
+	// the next start is calculated in the background
+	var list []ScheduleStatus
+	for range 100 {
+		list = m.Schedules()
+		if !list[0].Next.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ast.Len(list, 1)
+	ast.Equal(time.Sunday, list[0].Next.Weekday())
+	ast.Empty(list[0].Runs)
+
+	m.slock.Lock()
+	sc := m.sched[0]
+	m.slock.Unlock()
+	for range maxRuns + 2 {
+		m.runScheduled(sc)
+		waitFor(m, m.Schedules()[0].Runs[0].ID, StateFinished)
+	}
+	runs := m.Schedules()[0].Runs
+	ast.Len(runs, maxRuns)
+	ast.Equal("home", runs[0].Schedule)
+	ast.Equal(5, runs[0].Done)
+	ast.True(runs[0].Started.After(runs[1].Started) || runs[0].Started.Equal(runs[1].Started))
+
+	// a run is skipped while the last one is still running
+	f.gate = make(chan struct{})
+	m.runScheduled(sc)
+	id := m.Schedules()[0].Runs[0].ID
+	m.runScheduled(sc)
+	ast.Equal(id, m.Schedules()[0].Runs[0].ID)
+	close(f.gate)
+	waitFor(m, id, StateFinished)
+}
@@ -9,7 +9,6 @@ import (
 	"strings"
 
 	"github.com/samber/do/v2"
-	"github.com/willie68/go_mapproxy/configs"
 	"github.com/willie68/go_mapproxy/internal/logging"
 	"github.com/willie68/go_mapproxy/internal/model"
 )
@@ -32,6 +31,9 @@ type Config struct {
 	Path       string            `yaml:"path"` // for file based providers
 	Fallback   string            `yaml:"fallback"`
 	NoPrefetch bool              `yaml:"noprefetch"` // disable any prefetching of tiles
+	Offline    bool              `yaml:"offline"`    // don't request tiles from the upstream, serve only cached tiles
+	MaxAge     int               `yaml:"maxage"`     // in hours, max age of the cached tiles, 0 uses the cache setting, -1 never expires
+	MinAge     int               `yaml:"minage"`     // in hours, cached tiles are fresh at least this long
 }
 
 type pFactory struct {
@@ -108,20 +110,46 @@ func (f *pFactory) IsCached(providerName string) bool {
 	return !config.NoCached
 }
 
-func (f *pFactory) IsPrefetchable(providerName string) bool {
+// IsLocal true if the provider serves the tiles from a local source, like a mbtiles file
+func (f *pFactory) IsLocal(providerName string) bool {
 	config, ok := f.configs[providerName]
 	if !ok {
 		return false
 	}
-	bl := configs.PrefetchBlacklist()
-	for _, b := range bl {
-		if strings.Contains(strings.ToLower(config.URL), strings.ToLower(b)) {
-			return false
-		}
+	return config.Type == "mbtiles"
+}
+
+// IsPrefetchable false if prefetching is disabled for the provider, the hosts are checked by the prefetch policy
+func (f *pFactory) IsPrefetchable(providerName string) bool {
+	config, ok := f.configs[providerName]
+	if !ok {
+		return false
 	}
 	return !config.NoPrefetch
 }
 
+// Host the lower case host name of the upstream url of the provider, empty for local providers
+func (f *pFactory) Host(providerName string) string {
+	config, ok := f.configs[providerName]
+	if !ok || config.Type == "mbtiles" {
+		return ""
+	}
+	// the url may contain placeholders like {s}, so it isn't parsed with net/url
+	host := config.URL
+	if _, after, ok := strings.Cut(host, "://"); ok {
+		host = after
+	}
+	host, _, _ = strings.Cut(host, "/")
+	host, _, _ = strings.Cut(host, "?")
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
 func setDefaultHeaders(req *http.Request) {
 	req.Header.Set("User-Agent", "go_mapproxy/0.1")
 	req.Header.Set("Accept", "*/*")
@@ -0,0 +1,26 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFactoryHost(t *testing.T) {
+	ast := assert.New(t)
+	f := &pFactory{configs: ConfigMap{
+		"osm":     {URL: "https://{s}.Tile.OpenStreetMap.org/{z}/{x}/{y}.png", Type: "xyz"},
+		"wms":     {URL: "http://user:pw@localhost:8080/geoserver/wms?service=WMS", Type: "wms"},
+		"nopath":  {URL: "https://tiles.example.com", Type: "tms", NoPrefetch: true},
+		"mbtiles": {Path: "./world.mbtiles", Type: "mbtiles"},
+	}}
+	ast.Equal("{s}.tile.openstreetmap.org", f.Host("osm"))
+	ast.Equal("localhost", f.Host("wms"))
+	ast.Equal("tiles.example.com", f.Host("nopath"))
+	ast.Equal("", f.Host("mbtiles"))
+	ast.Equal("", f.Host("unknown"))
+
+	ast.True(f.IsPrefetchable("osm"))
+	ast.False(f.IsPrefetchable("nopath"))
+	ast.False(f.IsPrefetchable("unknown"))
+}
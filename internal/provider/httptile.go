@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+var (
+	// ErrNotModified the upstream tile has not changed since the last request (http 304)
+	ErrNotModified = errors.New("tile not modified")
+	// ErrTileNotFound the upstream has no such tile (http 404/410)
+	ErrTileNotFound = errors.New("tile not found")
+)
+
+// ConditionalService a provider, which supports conditional requests with the upstream caching headers
+type ConditionalService interface {
+	// ConditionalTile requests the tile with If-None-Match/If-Modified-Since taken from info.
+	// If the upstream tile is unchanged ErrNotModified is returned together with the new caching info.
+	ConditionalTile(tile model.Tile, info model.CacheInfo) (io.ReadCloser, model.CacheInfo, error)
+}
+
+// httpTile does the http request for a tile, setting the configured and the conditional headers
+func httpTile(cl *http.Client, log *slog.Logger, tileURL string, headers map[string]string, info model.CacheInfo) (io.ReadCloser, model.CacheInfo, error) {
+	req, err := http.NewRequest("GET", tileURL, nil)
+	if err != nil {
+		return nil, model.CacheInfo{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	setDefaultHeaders(req)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if info.ETag != "" {
+		req.Header.Set("If-None-Match", info.ETag)
+	}
+	if info.LastModified != "" {
+		req.Header.Set("If-Modified-Since", info.LastModified)
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		log.Error(fmt.Sprintf("error on tile request: %v", err))
+		return nil, model.CacheInfo{}, fmt.Errorf("Tile error: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		ni := cacheInfo(resp.Header)
+		if ni.ETag == "" {
+			ni.ETag = info.ETag
+		}
+		if ni.LastModified == "" {
+			ni.LastModified = info.LastModified
+		}
+		return nil, ni, ErrNotModified
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, model.CacheInfo{}, fmt.Errorf("Tile error: %s: %w", resp.Status, ErrTileNotFound)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		// an empty tile
+		return resp.Body, cacheInfo(resp.Header), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, model.CacheInfo{}, errors.New("read error")
+		}
+		log.Error(fmt.Sprintf("body: %s", string(bodyBytes)))
+		log.Error(fmt.Sprintf("error on tile request, status: %s", resp.Status))
+		return nil, model.CacheInfo{}, fmt.Errorf("Tile error: %s", resp.Status)
+	}
+	return resp.Body, cacheInfo(resp.Header), nil
+}
+
+// cacheInfo reads the caching headers of the response, Cache-Control max-age wins over Expires
+func cacheInfo(h http.Header) model.CacheInfo {
+	ci := model.CacheInfo{
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+	}
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(strings.ToLower(d))
+		if v, ok := strings.CutPrefix(d, "max-age="); ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				ci.Expires = time.Now().Add(time.Duration(secs) * time.Second)
+				return ci
+			}
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			ci.Expires = t
+		}
+	}
+	return ci
+}
@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestConditionalTile(t *testing.T) {
+	ast := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("tile"))
+	}))
+	defer srv.Close()
+
+	tms := &tmsProvider{
+		name:   "test",
+		log:    logging.New("test"),
+		config: Config{URL: srv.URL},
+	}
+	tile := model.Tile{Provider: "test", Z: 1, X: 1, Y: 1}
+	rd, info, err := tms.ConditionalTile(tile, model.CacheInfo{})
+	ast.NoError(err)
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	ast.NoError(err)
+	ast.Equal("tile", string(data))
+	ast.Equal(`"v1"`, info.ETag)
+	ast.WithinDuration(time.Now().Add(time.Hour), info.Expires, time.Minute)
+
+	_, info, err = tms.ConditionalTile(tile, info)
+	ast.True(errors.Is(err, ErrNotModified))
+	ast.Equal(`"v1"`, info.ETag)
+}
+
+func TestCacheInfoExpires(t *testing.T) {
+	ast := assert.New(t)
+	h := http.Header{}
+	exp := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	h.Set("Expires", exp.Format(http.TimeFormat))
+	h.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	ci := cacheInfo(h)
+	ast.True(exp.Equal(ci.Expires))
+	ast.True(ci.HasValidator())
+}
+
+func TestTileNotFound(t *testing.T) {
+	ast := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1/1/0.png" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	tms := &tmsProvider{
+		name:   "test",
+		log:    logging.New("test"),
+		config: Config{URL: srv.URL},
+	}
+	_, err := tms.Tile(model.Tile{Provider: "test", Z: 1, X: 1, Y: 1})
+	ast.ErrorIs(err, ErrTileNotFound)
+
+	rd, err := tms.Tile(model.Tile{Provider: "test", Z: 1, X: 1, Y: 0})
+	ast.NoError(err)
+	data, err := io.ReadAll(rd)
+	rd.Close()
+	ast.NoError(err)
+	ast.Empty(data)
+}
@@ -1,7 +1,6 @@
 package provider
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -19,36 +18,17 @@ type tmsProvider struct {
 }
 
 func (s *tmsProvider) Tile(tile model.Tile) (io.ReadCloser, error) {
+	rd, _, err := s.ConditionalTile(tile, model.CacheInfo{})
+	return rd, err
+}
+
+func (s *tmsProvider) ConditionalTile(tile model.Tile, info model.CacheInfo) (io.ReadCloser, model.CacheInfo, error) {
 	tmsURL := s.buildTMSUrl(tile)
 	s.log.Debug(fmt.Sprintf("Requesting TMS tile from %s", tmsURL))
 	if s.cl == nil {
 		s.cl = &http.Client{}
 	}
-	req, err := http.NewRequest("GET", tmsURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-	setDefaultHeaders(req)
-	for key, value := range s.config.Headers {
-		req.Header.Set(key, value)
-	}
-	resp, err := s.cl.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		if resp != nil {
-			if resp.Body != nil {
-				defer resp.Body.Close()
-				bodyBytes, err := io.ReadAll(resp.Body)
-				if err != nil {
-					return nil, errors.New("read error")
-				}
-				bodyString := string(bodyBytes)
-				s.log.Error(fmt.Sprintf("body: %s", bodyString))
-			}
-			s.log.Error(fmt.Sprintf("error on wms request, status: %s: %v", resp.Status, err))
-		}
-		return nil, fmt.Errorf("Tile error: %v", err)
-	}
-	return resp.Body, nil
+	return httpTile(s.cl, s.log, tmsURL, s.config.Headers, info)
 }
 
 func (s *tmsProvider) buildTMSUrl(tile model.Tile) string {
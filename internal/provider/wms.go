@@ -1,7 +1,6 @@
 package provider
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -20,37 +19,18 @@ type wmsProvider struct {
 }
 
 func (s *wmsProvider) Tile(tile model.Tile) (io.ReadCloser, error) {
+	rd, _, err := s.ConditionalTile(tile, model.CacheInfo{})
+	return rd, err
+}
+
+func (s *wmsProvider) ConditionalTile(tile model.Tile, info model.CacheInfo) (io.ReadCloser, model.CacheInfo, error) {
 	wmsURL := s.buildWMSUrl(s.tileToBBox(tile))
 	s.log.Debug(fmt.Sprintf("Requesting WMS tile from %s", wmsURL))
 
 	if s.cl == nil {
 		s.cl = &http.Client{}
 	}
-	req, err := http.NewRequest("GET", wmsURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	setDefaultHeaders(req)
-	for key, value := range s.config.Headers {
-		req.Header.Set(key, value)
-	}
-
-	resp, err := s.cl.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		if resp.Body != nil {
-			defer resp.Body.Close()
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, errors.New("read error")
-			}
-			bodyString := string(bodyBytes)
-			s.log.Error(fmt.Sprintf("body: %s", bodyString))
-		}
-		s.log.Error(fmt.Sprintf("error on wms request, status: %s: %v", resp.Status, err))
-		return nil, errors.New("Tile error")
-	}
-	return resp.Body, nil
+	return httpTile(s.cl, s.log, wmsURL, s.config.Headers, info)
 }
 
 func (s *wmsProvider) buildWMSUrl(bb mercantile.Bbox) string {
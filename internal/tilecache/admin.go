@@ -0,0 +1,146 @@
+package tilecache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// ProviderStats the statistics of the cached tiles of a provider
+type ProviderStats struct {
+	Tiles  int       `json:"tiles"`
+	Bytes  int64     `json:"bytes"` // size of the content, shared content is counted once
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+// TileEntry the entry of a cached tile
+type TileEntry struct {
+	Provider     string    `json:"provider"`
+	Variant      string    `json:"variant,omitempty"`
+	Z            int       `json:"z"`
+	X            int       `json:"x"`
+	Y            int       `json:"y"`
+	Hash         string    `json:"hash,omitempty"`
+	Size         int64     `json:"size"`
+	Timestamp    time.Time `json:"timestamp"`
+	Expires      time.Time `json:"expires,omitzero"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Accessed     time.Time `json:"accessed,omitzero"`
+	Hits         uint32    `json:"hits"`
+	FreshUntil   time.Time `json:"freshUntil,omitzero"`
+	Stale        bool      `json:"stale"`
+	Uniform      string    `json:"uniform,omitempty"` // color of a uniform tile as #rrggbbaa
+}
+
+// TileFilter selects tiles of the cache, empty fields match all tiles
+type TileFilter struct {
+	Provider string
+	MinZoom  int
+	MaxZoom  int // 0 for all zoom levels above MinZoom
+	BBox     *mercantile.Bbox
+}
+
+// match true if the tile is selected by the filter
+func (f TileFilter) match(tile model.Tile) bool {
+	if tile.Z < f.MinZoom || (f.MaxZoom > 0 && tile.Z > f.MaxZoom) {
+		return false
+	}
+	if f.BBox != nil {
+		return f.BBox.Intersects(mercantile.ULBounds(mercantile.TileID{X: tile.X, Y: tile.Y, Z: tile.Z}))
+	}
+	return true
+}
+
+// Stats returns the statistics of all cached providers
+func (c *Cache) Stats() (map[string]ProviderStats, error) {
+	stats := make(map[string]ProviderStats)
+	seen := make(map[string]map[string]bool)
+	err := c.Walk("", func(tile model.Tile, e dbEntry) error {
+		ps := stats[tile.Provider]
+		ps.Tiles++
+		if e.Hash == "" {
+			ps.Bytes += e.Size
+		} else {
+			if seen[tile.Provider] == nil {
+				seen[tile.Provider] = make(map[string]bool)
+			}
+			if !seen[tile.Provider][e.Hash] {
+				seen[tile.Provider][e.Hash] = true
+				ps.Bytes += e.Size
+			}
+		}
+		if ps.Oldest.IsZero() || e.Timestamp.Before(ps.Oldest) {
+			ps.Oldest = e.Timestamp
+		}
+		if e.Timestamp.After(ps.Newest) {
+			ps.Newest = e.Timestamp
+		}
+		stats[tile.Provider] = ps
+		return nil
+	})
+	return stats, err
+}
+
+// Entry returns the entry of a cached tile, ErrNotCached if the tile is not in the cache
+func (c *Cache) Entry(tile model.Tile) (TileEntry, error) {
+	e, err := c.DBGet(tile)
+	if err != nil {
+		return TileEntry{}, err
+	}
+	te := TileEntry{
+		Provider:     tile.Provider,
+		Variant:      tile.Variant,
+		Z:            tile.Z,
+		X:            tile.X,
+		Y:            tile.Y,
+		Hash:         e.Hash,
+		Size:         e.Size,
+		Timestamp:    e.Timestamp,
+		Expires:      e.Expires,
+		ETag:         e.ETag,
+		LastModified: e.LastModified,
+		Accessed:     e.Accessed,
+		Hits:         e.Hits,
+		FreshUntil:   c.freshUntil(tile, e),
+		Stale:        c.isStale(tile, e),
+	}
+	if u := e.Uniform; u != nil {
+		te.Uniform = fmt.Sprintf("#%02x%02x%02x%02x", u.Color.R, u.Color.G, u.Color.B, u.Color.A)
+	}
+	return te, nil
+}
+
+// Purge removes all tiles selected by the filter, returns the number of removed tiles
+func (c *Cache) Purge(f TileFilter) (int, error) {
+	tiles := make([]model.Tile, 0)
+	err := c.Walk(f.Provider, func(tile model.Tile, e dbEntry) error {
+		if f.match(tile) {
+			tiles = append(tiles, tile)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, tile := range tiles {
+		if _, err := c.DBDelete(tile); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	c.log.Info(fmt.Sprintf("purged %d tiles", removed))
+	return removed, nil
+}
+
+// ValueLogGC runs the garbage collection of the badger value log
+func (c *Cache) ValueLogGC() error {
+	if vs, ok := c.store.(valueLogStorage); ok {
+		return vs.ValueLogGC()
+	}
+	return ErrNotSupported
+}
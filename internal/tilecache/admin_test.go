@@ -0,0 +1,103 @@
+package tilecache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samber/do/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestAdminPurge(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.maxage = 24
+	for z := 1; z <= 5; z++ {
+		for x := range 2 {
+			tile := model.Tile{Provider: "osm", Z: z, X: x, Y: 0}
+			ast.NoError(c.Save(tile, strings.NewReader(fmt.Sprintf("%0200d", z*10+x))))
+		}
+	}
+	ast.NoError(c.Save(model.Tile{Provider: "osm", Z: 3, X: 0, Y: 1}, strings.NewReader(fmt.Sprintf("%0200d", 31))))
+	ast.NoError(c.Save(model.Tile{Provider: "gebco", Z: 1, X: 0, Y: 0}, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+
+	stats, err := c.Stats()
+	ast.NoError(err)
+	ast.Equal(11, stats["osm"].Tiles)
+	// tile 3/0/1 shares its content with 3/1/0
+	ast.Equal(int64(200*10), stats["osm"].Bytes)
+	ast.Equal(1, stats["gebco"].Tiles)
+	ast.False(stats["osm"].Oldest.After(stats["osm"].Newest))
+
+	e, err := c.Entry(model.Tile{Provider: "osm", Z: 3, X: 1, Y: 0})
+	ast.NoError(err)
+	ast.Equal(int64(200), e.Size)
+	ast.False(e.Stale)
+	_, err = c.Entry(model.Tile{Provider: "osm", Z: 3, X: 3, Y: 0})
+	ast.ErrorIs(err, ErrNotCached)
+
+	// the western hemisphere in the zoom levels 4 and 5
+	removed, err := c.Purge(TileFilter{Provider: "osm", MinZoom: 4, MaxZoom: 5, BBox: &mercantile.Bbox{Left: -179, Bottom: 0, Right: -1, Top: 85}})
+	ast.NoError(err)
+	ast.Equal(4, removed)
+	ast.False(c.DBHas(model.Tile{Provider: "osm", Z: 5, X: 1, Y: 0}))
+	ast.True(c.DBHas(model.Tile{Provider: "osm", Z: 3, X: 1, Y: 0}))
+
+	// a bbox crossing the antimeridian
+	removed, err = c.Purge(TileFilter{Provider: "osm", MinZoom: 3, MaxZoom: 3, BBox: &mercantile.Bbox{Left: 170, Bottom: 0, Right: -170, Top: 85}})
+	ast.NoError(err)
+	ast.Equal(2, removed)
+	ast.False(c.DBHas(model.Tile{Provider: "osm", Z: 3, X: 0, Y: 1}))
+	ast.True(c.DBHas(model.Tile{Provider: "osm", Z: 3, X: 1, Y: 0}))
+
+	removed, err = c.Purge(TileFilter{Provider: "osm"})
+	ast.NoError(err)
+	ast.Equal(5, removed)
+	ast.True(c.DBHas(model.Tile{Provider: "gebco", Z: 1, X: 0, Y: 0}))
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	inj := do.New()
+	do.ProvideValue(inj, c)
+	tile := model.Tile{Provider: "osm", Z: 2, X: 1, Y: 1}
+	ast.NoError(c.Save(tile, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+	srv := httptest.NewServer(Routes(inj))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/osm/2/1/1")
+	ast.NoError(err)
+	ast.Equal(http.StatusOK, resp.StatusCode)
+	var e TileEntry
+	ast.NoError(json.NewDecoder(resp.Body).Decode(&e))
+	resp.Body.Close()
+	ast.Equal(int64(200), e.Size)
+
+	resp, err = http.Get(srv.URL + "/osm/2/0/1")
+	ast.NoError(err)
+	ast.Equal(http.StatusNotFound, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/osm?bbox=10,a,20,30", nil)
+	resp, err = http.DefaultClient.Do(req)
+	ast.NoError(err)
+	ast.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/osm?minzoom=2", nil)
+	resp, err = http.DefaultClient.Do(req)
+	ast.NoError(err)
+	var pr purgeResponse
+	ast.NoError(json.NewDecoder(resp.Body).Decode(&pr))
+	resp.Body.Close()
+	ast.Equal(1, pr.Removed)
+
+	resp, err = http.Post(srv.URL+"/gc", "application/json", nil)
+	ast.NoError(err)
+	ast.Equal(http.StatusOK, resp.StatusCode)
+}
@@ -1,69 +1,110 @@
 package tilecache
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
-	"encoding/hex"
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
-	"path/filepath"
-	"sync"
+	"reflect"
 	"time"
 
-	badger "github.com/dgraph-io/badger/v4"
 	"github.com/samber/do/v2"
 	"github.com/willie68/go_mapproxy/internal/logging"
 	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
 )
 
 type Config struct {
-	Path   string `yaml:"path"`
-	Active bool   `yaml:"active"`
-	MaxAge int    `yaml:"maxage"` // in hours
+	Path                 string         `yaml:"path"`
+	Active               bool           `yaml:"active"`
+	Backend              string         `yaml:"backend"`              // badger (default), mbtiles, xyz or s3
+	S3                   S3Config       `yaml:"s3"`                   // object store of the s3 backend
+	MaxAge               int            `yaml:"maxage"`               // in hours
+	MaxStale             int            `yaml:"maxstale"`             // in hours, stale tiles are kept this long after maxage, -1 keeps them forever
+	StaleWhileRevalidate bool           `yaml:"stalewhilerevalidate"` // serve stale tiles immediately and refresh them in the background
+	StaleOnError         bool           `yaml:"staleonerror"`         // serve stale tiles if the upstream fails
+	MaxSize              int64          `yaml:"maxsize"`              // in bytes, max size of the cache, 0 for unlimited
+	MaxTiles             int            `yaml:"maxtiles"`             // max number of cached tiles, 0 for unlimited
+	LowWater             int            `yaml:"lowwater"`             // in percent of maxsize/maxtiles, eviction stops below this mark
+	Eviction             string         `yaml:"eviction"`             // lru or lfu
+	Writer               WriterConfig   `yaml:"writer"`               // asynchronous cache writer
+	Memory               MemoryConfig   `yaml:"memory"`               // in memory tier for hot tiles
+	Negative             NegativeConfig `yaml:"negative"`             // negative caching of tiles missing at the upstream
+	Compress             CompressConfig `yaml:"compress"`             // compression of the tile content
 }
 
 type Cache struct {
-	log    *slog.Logger
-	path   string
-	active bool
-	maxage int // in hours
-
-	flock sync.RWMutex
-	db    *badger.DB
+	log          *slog.Logger
+	active       bool
+	maxage       int // in hours
+	policies     map[string]Policy
+	maxstale     int // in hours
+	swr          bool
+	staleOnError bool
+	maxsize      int64
+	maxtiles     int
+	lowwater     int
+	eviction     string
+	access       *accessTracker
+	memory       *memoryCache
+	negative     *negativeCache
+	compression  CompressConfig
+	metrics      *measurement.Service
+
+	store  Storage
+	writer *writer
 }
 
 type tcConfig interface {
 	GetCacheConfig() Config
 }
 
-type dbEntry struct {
-	Hash      string
-	Timestamp time.Time
-}
-
 func Init(inj do.Injector) {
 	cfg := do.MustInvokeAs[tcConfig](inj).GetCacheConfig()
 	c := &Cache{
 		log:    logging.New("tilecache"),
-		path:   cfg.Path,
 		active: cfg.Active,
 		maxage: cfg.MaxAge,
-		flock:  sync.RWMutex{},
+
+		maxstale:     cfg.MaxStale,
+		swr:          cfg.StaleWhileRevalidate,
+		staleOnError: cfg.StaleOnError,
+		maxsize:      cfg.MaxSize,
+		maxtiles:     cfg.MaxTiles,
+		lowwater:     cfg.LowWater,
+		eviction:     cfg.Eviction,
+		access:       newAccessTracker(),
+		compression:  cfg.Compress,
+	}
+	if c.lowwater <= 0 || c.lowwater > 100 {
+		c.lowwater = defaultLowWater
 	}
+	c.initPolicies(inj)
 	if c.active {
-		c.startCacheCleanupJob()
+		store, err := openStorage(cfg)
+		if err != nil {
+			c.log.Error(fmt.Sprintf("failed to open cache backend, cache is disabled: %v", err))
+			c.active = false
+		}
+		c.store = store
+		if _, ok := store.(uniformStorage); c.compression.Uniform && !ok {
+			c.log.Warn(fmt.Sprintf("the cache backend %s can't store uniform tiles as marker", cfg.Backend))
+			c.compression.Uniform = false
+		}
 	}
 	do.ProvideValue(inj, c)
 	if c.active {
-		db, err := badger.Open(badger.DefaultOptions(c.getDBPath()).WithValueLogFileSize(100 * 1024 * 1024))
-		if err != nil {
-			c.log.Error(fmt.Sprintf("failed to open badger db: %v", err))
+		c.startCacheCleanupJob()
+		c.startEvictionJob()
+		c.metrics = do.MustInvoke[*measurement.Service](inj)
+		if cfg.Memory.MaxSize > 0 {
+			c.memory = newMemoryCache(cfg.Memory.MaxSize)
 		}
-		c.db = db
-		c.startValueLogGCTicker()
+		c.negative = newNegativeCache(cfg.Negative)
+		c.writer = newWriter(cfg.Writer, c.metrics, func(tile model.Tile, data []byte, info model.CacheInfo) error {
+			return c.SaveWithInfo(tile, bytes.NewReader(data), info)
+		})
+		c.writer.start()
 	}
 }
 
@@ -73,7 +114,7 @@ func (c *Cache) startCacheCleanupJob() {
 		defer ticker.Stop()
 		for {
 			<-ticker.C
-			err := c.CleanupOldFiles(time.Duration(c.maxage) * time.Hour)
+			err := c.Cleanup()
 			if err != nil {
 				c.log.Error(fmt.Sprintf("cache cleanup error: %v", err))
 			} else {
@@ -83,22 +124,6 @@ func (c *Cache) startCacheCleanupJob() {
 	}()
 }
 
-func (c *Cache) startValueLogGCTicker() {
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for {
-			<-ticker.C
-			err := c.db.RunValueLogGC(0.5)
-			if err != nil {
-				c.log.Error(fmt.Sprintf("value log GC error: %v", err))
-			} else {
-				c.log.Info(fmt.Sprintf("value log GC completed"))
-			}
-		}
-	}()
-}
-
 func (c *Cache) IsActive() bool {
 	return c.active
 }
@@ -107,317 +132,261 @@ func (c *Cache) Has(tile model.Tile) bool {
 	if !c.active {
 		return false
 	}
-	// Check if DB has entry
-	ok := c.DBHas(tile)
-	if !ok {
-		return false
-	}
-	db, err := c.DBGet(tile)
-	if err != nil || db == nil {
-		return false
-	}
-	_, file := c.getFilename(db.Hash)
-	if _, err := os.Stat(file); err != nil {
-		return false
-	}
-	return true
+	return c.store.Has(tile)
 }
 
 func (c *Cache) Tile(tile model.Tile) (io.ReadCloser, bool) {
+	return c.tile(tile, false)
+}
+
+// StaleTile returns the cached tile, even if it's stale
+func (c *Cache) StaleTile(tile model.Tile) (io.ReadCloser, bool) {
+	return c.tile(tile, true)
+}
+
+// StaleWhileRevalidate true if stale tiles should be served while refreshing them in the background
+func (c *Cache) StaleWhileRevalidate() bool {
+	return c.active && c.swr
+}
+
+// StaleOnError true if stale tiles should be served, when the upstream fails
+func (c *Cache) StaleOnError() bool {
+	return c.active && c.staleOnError
+}
+
+func (c *Cache) tile(tile model.Tile, stale bool) (io.ReadCloser, bool) {
 	if !c.active {
 		return nil, false
 	}
-	if !c.DBHas(tile) {
-		return nil, false
+	if c.memory != nil {
+		if item, ok := c.memory.get(tile); ok && (stale || !item.isStale()) {
+			c.metrics.Point("memoryCacheHit").Inc(1)
+			c.access.hit(tile)
+			return io.NopCloser(bytes.NewReader(item.data)), true
+		}
+		c.metrics.Point("memoryCacheMiss").Inc(1)
 	}
 	db, err := c.DBGet(tile)
 	if err != nil || db == nil {
 		return nil, false
 	}
-	_, file := c.getFilename(db.Hash)
-	c.flock.RLock()
-	defer c.flock.RUnlock()
-	fi, err := os.Stat(file)
-	if err != nil {
-		c.log.Error(fmt.Sprintf("cache file %s not found", file))
+	if !stale && c.isStale(tile, db) {
+		c.log.Debug(fmt.Sprintf("cache entry is stale: %s", tile.String()))
 		return nil, false
 	}
-	if c.isRejected(fi) {
-		err := os.Remove(file)
-		if err != nil {
-			c.log.Error(fmt.Sprintf("error removing rejected cache file %s: %v", file, err))
-		}
-		c.log.Error(fmt.Sprintf("cache file %s is rejected", file))
+	f, err := c.open(tile, db)
+	if err != nil {
+		c.log.Error(fmt.Sprintf("can't open cached tile %s: %v", tile.String(), err))
 		return nil, false
 	}
-	if fi.Size() < 100 {
-		c.log.Error(fmt.Sprintf("cache file %s is too small", file))
-		return nil, false
+	c.access.hit(tile)
+	if c.memory == nil {
+		return f, true
 	}
-	f, err := os.Open(file)
+	defer f.Close()
+	data, err := io.ReadAll(f)
 	if err != nil {
 		return nil, false
 	}
-	return f, true
+	c.memory.put(memoryItem{tile: tile, data: data, freshUntil: c.freshUntil(tile, db)})
+	return io.NopCloser(bytes.NewReader(data)), true
 }
 
-func (c *Cache) Save(tile model.Tile, data io.Reader) error {
-	if !c.active {
-		return nil
+// CacheInfo returns the upstream caching info of a cached tile, false if there is no cached tile
+// which can be revalidated with the upstream
+func (c *Cache) CacheInfo(tile model.Tile) (model.CacheInfo, bool) {
+	if !c.Has(tile) {
+		return model.CacheInfo{}, false
 	}
-	orgHash := ""
-	if c.DBHas(tile) {
-		db, err := c.DBGet(tile)
-		if err != nil {
-			return err
-		}
-		if db != nil {
-			orgHash = db.Hash
-			_, file := c.getFilename(db.Hash)
-			if _, err := os.Stat(file); err == nil {
-				// File with same hash already exists
-				return nil
-			}
-		}
-	}
-	// Create temporary file to calculate hash
-	tmpFile, err := os.CreateTemp("", "tile_cache_*.tmp")
-	if err != nil {
-		return err
+	db, err := c.DBGet(tile)
+	if err != nil || db == nil {
+		return model.CacheInfo{}, false
 	}
-	tmpPath := tmpFile.Name()
-	defer os.Remove(tmpPath)
-
-	// Copy data to temp file and calculate hash
-	h := sha256.New()
-	multiWriter := io.MultiWriter(tmpFile, h)
-	_, err = io.Copy(multiWriter, data)
-	tmpFile.Close()
-	if err != nil {
-		return err
+	info := model.CacheInfo{
+		ETag:         db.ETag,
+		LastModified: db.LastModified,
+		Expires:      db.Expires,
 	}
+	return info, info.HasValidator()
+}
 
-	// Generate hash-based path
-	hash := hex.EncodeToString(h.Sum(nil))
-	hashDir, hashFile := c.getFilename(hash)
-
-	// Check if hash-based file already exists
-	if _, err := os.Stat(hashFile); errors.Is(err, os.ErrNotExist) {
-		// Create hash-based directory structure
-		if err := os.MkdirAll(hashDir, 0o755); err != nil {
-			return err
-		}
-
-		// Move temp file to final hash-based location
-		c.flock.Lock()
-		defer c.flock.Unlock()
-		err = oscrossRename(tmpPath, hashFile)
-		if err != nil {
-			return err
-		}
+// Timestamp the time the tile was cached or revalidated the last time, false if it's not cached
+func (c *Cache) Timestamp(tile model.Tile) (time.Time, bool) {
+	if !c.active {
+		return time.Time{}, false
 	}
-
-	// File already exists, no need to save again
-	if !c.DBHas(tile) || (hash != orgHash) {
-		err = c.DBSet(tile, dbEntry{Hash: hash, Timestamp: time.Now()})
-		if err != nil {
-			return err
-		}
+	db, err := c.DBGet(tile)
+	if err != nil || db == nil {
+		return time.Time{}, false
 	}
-	return nil
+	return db.Timestamp, true
 }
 
-func oscrossRename(tmpPath string, hashFile string) error {
-	err := os.Rename(tmpPath, hashFile)
-	if err != nil {
-		// Fallback: copy if rename fails (cross-device link)
-		src, err := os.Open(tmpPath)
-		if err != nil {
-			return err
+// Refresh marks a cached tile as fresh again, used if the upstream tile is not modified
+func (c *Cache) Refresh(tile model.Tile, info model.CacheInfo) error {
+	if !c.active {
+		return nil
+	}
+	return c.updateEntry(tile, func(db *dbEntry) {
+		db.Timestamp = time.Now()
+		db.Expires = info.Expires
+		if info.ETag != "" {
+			db.ETag = info.ETag
 		}
-		defer src.Close()
-
-		dst, err := os.Create(hashFile)
-		if err != nil {
-			return err
+		if info.LastModified != "" {
+			db.LastModified = info.LastModified
 		}
-		defer dst.Close()
+	})
+}
 
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+func (c *Cache) Save(tile model.Tile, data io.Reader) error {
+	return c.SaveWithInfo(tile, data, model.CacheInfo{})
 }
 
-// CleanupOldFiles deletes cache files older than the given duration.
-func (c *Cache) CleanupOldFiles(olderThan time.Duration) error {
-	root := c.getTilesPath()
-	now := time.Now()
-	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+// SaveWithInfo saves the tile together with the upstream caching info
+func (c *Cache) SaveWithInfo(tile model.Tile, data io.Reader, info model.CacheInfo) error {
+	if !c.active {
+		return nil
+	}
+	e := dbEntry{
+		Timestamp:    time.Now(),
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+		Expires:      info.Expires,
+	}
+	// keep the access statistics of the old entry
+	if old, err := c.DBGet(tile); err == nil {
+		e.Accessed = old.Accessed
+		e.Hits = old.Hits
+	}
+	c.forget(tile)
+	if c.compression.Uniform || c.compression.PNG {
+		content, err := io.ReadAll(data)
 		if err != nil {
 			return err
 		}
-		if !info.Mode().IsRegular() {
-			return nil
+		content, u := c.compress(content)
+		if u != nil {
+			e.Uniform = u
+			return c.store.(uniformStorage).SaveUniform(tile, e)
 		}
-		modTime := info.ModTime()
-		if now.Sub(modTime) > olderThan {
-			c.log.Debug(fmt.Sprintf("removing old cache file: %s", path))
-			c.deleteFile(path)
-		}
-		return nil
-	})
+		data = bytes.NewReader(content)
+	}
+	return c.store.Save(tile, data, e)
 }
 
-func (c *Cache) deleteFile(path string) {
-	c.flock.Lock()
-	defer c.flock.Unlock()
-	err := os.Remove(path)
-	if err != nil {
-		c.log.Error(fmt.Sprintf("error removing file %s: %v", path, err))
+// SaveAsync queues the tile for saving into the cache, returns false if the tile was dropped
+func (c *Cache) SaveAsync(tile model.Tile, data []byte, info model.CacheInfo) bool {
+	if !c.active || c.writer == nil {
+		return false
 	}
+	return c.writer.enqueue(tile, data, info)
 }
 
-func (c *Cache) GetFileHash(fileStr string) string {
-	f, err := os.Open(fileStr)
-	if err != nil {
-		c.log.Error(fmt.Sprintf("error opening file: %v", err))
+// QueueDepth returns the number of tiles waiting to be written into the cache
+func (c *Cache) QueueDepth() int {
+	if c.writer == nil {
+		return 0
 	}
-	defer f.Close()
+	return c.writer.depth()
+}
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		c.log.Error(fmt.Sprintf("error building hash: %v", err))
+// Flush waits until all queued tiles are written, after that no more tiles will be queued
+func (c *Cache) Flush() {
+	if c.writer != nil {
+		c.writer.flush()
 	}
-	return hex.EncodeToString(h.Sum(nil))
 }
 
 func (c *Cache) Close() error {
-	if c.db != nil {
-		c.db.Close()
+	c.Flush()
+	c.flushAccesses()
+	if c.store != nil {
+		return c.store.Close()
 	}
 	return nil
 }
 
-func (c *Cache) DBKey(tile model.Tile) []byte {
-	providerBytes := []byte(tile.Provider)
-	key := make([]byte, 9+len(providerBytes)) // 1+4+4 for Z,X,Y + provider
-
-	// Store Z as uint8, X, Y as binary integers
-	key[0] = uint8(tile.Z)
-	binary.LittleEndian.PutUint16(key[1:3], uint16(tile.X))
-	binary.LittleEndian.PutUint16(key[4:6], uint16(tile.Y))
-
-	// Store provider string at the end without length
-	copy(key[9:], providerBytes)
-
-	return key
+// forget removes the tile from the memory tier and the negative cache
+func (c *Cache) forget(tile model.Tile) {
+	if c.memory != nil {
+		c.memory.remove(tile)
+	}
+	if c.negative != nil {
+		c.negative.remove(tile)
+	}
 }
 
+// DBSet replaces the entry of the tile, the tile is only removed from the memory tier if its content changes
 func (c *Cache) DBSet(tile model.Tile, data dbEntry) error {
-	if c.db == nil {
-		return fmt.Errorf("badger db is not initialized")
+	if c.store == nil {
+		return ErrNotCached
 	}
-	val, err := data.Marshal()
-	if err != nil {
-		return err
+	if old, err := c.store.Entry(tile); err != nil || old.Hash != data.Hash || !reflect.DeepEqual(old.Uniform, data.Uniform) {
+		c.forget(tile)
 	}
-	return c.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(c.DBKey(tile), val)
-	})
+	return c.store.SetEntry(tile, data)
 }
 
-func (c *Cache) DBGet(tile model.Tile) (*dbEntry, error) {
-	if c.db == nil {
-		return nil, fmt.Errorf("badger db is not initialized")
+// updateEntry changes the metadata of the entry of the tile, the content isn't changed. Backends
+// sharing the content of equal tiles update the entry in one transaction.
+func (c *Cache) updateEntry(tile model.Tile, fn func(e *dbEntry)) error {
+	if c.store == nil {
+		return ErrNotCached
 	}
-	var valCopy []byte
-	err := c.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(c.DBKey(tile))
-		if err != nil {
-			return err
-		}
-		val, err := item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
-		valCopy = val
-		return nil
-	})
-	if err != nil {
-		return nil, err
+	if eu, ok := c.store.(entryUpdater); ok {
+		return eu.UpdateEntry(tile, fn)
 	}
-	var entry dbEntry
-	err = entry.Unmarshal(valCopy)
+	e, err := c.store.Entry(tile)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &entry, nil
+	fn(e)
+	return c.store.SetEntry(tile, *e)
 }
 
-func (c *Cache) DBHas(tile model.Tile) bool {
-	if c.db == nil {
-		return false
+func (c *Cache) DBGet(tile model.Tile) (*dbEntry, error) {
+	if c.store == nil {
+		return nil, ErrNotCached
 	}
-	err := c.db.View(func(txn *badger.Txn) error {
-		_, err := txn.Get(c.DBKey(tile))
-		return err
-	})
-	return err == nil
+	return c.store.Entry(tile)
 }
 
-func (c *Cache) getTilesPath() string {
-	return filepath.Join(c.path, "tiles")
-}
-
-func (c *Cache) getDBPath() string {
-	return filepath.Join(c.path, "badger")
+func (c *Cache) DBHas(tile model.Tile) bool {
+	_, err := c.DBGet(tile)
+	return err == nil
 }
 
-func (c *Cache) getFilename(hash string) (string, string) {
-	hashDir := filepath.Join(c.getTilesPath(), hash[:3], hash[3:6])
-	hashFile := filepath.Join(hashDir, hash+".png")
-	return hashDir, hashFile
+// DBDelete removes the tile from the cache, returns true if the space of its content is freed
+func (c *Cache) DBDelete(tile model.Tile) (bool, error) {
+	if c.store == nil {
+		return false, ErrNotCached
+	}
+	c.forget(tile)
+	return c.store.Delete(tile)
 }
 
-func (c *Cache) isRejected(fi os.FileInfo) bool {
-	if c.maxage <= 0 {
-		return false
-	}
-	age := time.Since(fi.ModTime())
-	if age > time.Duration(c.maxage)*time.Hour {
-		return true
+// Walk calls fn for every cached tile of the provider, an empty provider walks over all tiles
+func (c *Cache) Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error {
+	if c.store == nil {
+		return ErrNotCached
 	}
-	return false
+	return c.store.Walk(providerName, fn)
 }
 
-func (d dbEntry) Marshal() ([]byte, error) {
-	tsBytes, err := d.Timestamp.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	hashBytes := []byte(d.Hash)
-	result := make([]byte, 4+len(hashBytes)+len(tsBytes))
-	binary.LittleEndian.PutUint32(result[0:4], uint32(len(hashBytes)))
-	copy(result[4:4+len(hashBytes)], hashBytes)
-	copy(result[4+len(hashBytes):], tsBytes)
-	return result, nil
+// GC collects the garbage of the backend, if the backend needs this
+func (c *Cache) GC() (GCResult, error) {
+	if gs, ok := c.store.(gcStorage); ok {
+		return gs.GC()
+	}
+	return GCResult{}, nil
 }
 
-func (d *dbEntry) Unmarshal(data []byte) error {
-	if len(data) < 4 {
-		return fmt.Errorf("data too short to unmarshal")
-	}
-	hashLen := binary.LittleEndian.Uint32(data[0:4])
-	if len(data) < int(4+hashLen) {
-		return fmt.Errorf("data too short for hash")
+// Verify checks all entries and the content of the cache, with repair the problems found are removed.
+// Only the badger backend supports this.
+func (c *Cache) Verify(repair bool) (VerifyReport, error) {
+	if vs, ok := c.store.(verifyStorage); ok {
+		return vs.Verify(repair)
 	}
-	d.Hash = string(data[4 : 4+hashLen])
-	err := d.Timestamp.UnmarshalBinary(data[4+hashLen:])
-	if err != nil {
-		return err
-	}
-	return nil
+	return VerifyReport{}, ErrNotSupported
 }
@@ -0,0 +1,138 @@
+package tilecache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// entryVersion marks the field list format of a dbEntry. Older entries start with the length of the hash
+// followed by the timestamp and will be read as well.
+const entryVersion uint32 = 0xFFFF0002
+
+type dbEntry struct {
+	Hash         string
+	Timestamp    time.Time
+	ETag         string
+	LastModified string
+	Expires      time.Time    // upstream expiry, zero if not given
+	Size         int64        // size of the content file in bytes
+	Accessed     time.Time    // last read access, zero if never read
+	Hits         uint32       // number of read accesses
+	Uniform      *uniformTile // a tile of a single color, stored without content file
+}
+
+// LastAccess the last read access, or the timestamp if the tile was never read
+func (d dbEntry) LastAccess() time.Time {
+	if d.Accessed.IsZero() {
+		return d.Timestamp
+	}
+	return d.Accessed
+}
+
+// Marshal writes the entry as list of length prefixed fields. New fields are only appended,
+// so older entries can still be read.
+func (d dbEntry) Marshal() ([]byte, error) {
+	fields := make([][]byte, 0, 9)
+	fields = append(fields, []byte(d.Hash))
+	for _, t := range []time.Time{d.Timestamp, d.Expires} {
+		tsBytes, err := t.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, tsBytes)
+	}
+	fields = append(fields, []byte(d.ETag), []byte(d.LastModified))
+	fields = append(fields, binary.LittleEndian.AppendUint64(nil, uint64(d.Size)))
+	acBytes, err := d.Accessed.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	fields = append(fields, acBytes)
+	fields = append(fields, binary.LittleEndian.AppendUint32(nil, d.Hits))
+	fields = append(fields, d.Uniform.marshal())
+
+	size := 4
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	result := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(result[0:4], entryVersion)
+	for _, f := range fields {
+		result = binary.LittleEndian.AppendUint32(result, uint32(len(f)))
+		result = append(result, f...)
+	}
+	return result, nil
+}
+
+func (d *dbEntry) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short to unmarshal")
+	}
+	if binary.LittleEndian.Uint32(data[0:4]) != entryVersion {
+		return d.unmarshalV1(data)
+	}
+	fields := make([][]byte, 0, 8)
+	pos := 4
+	for pos < len(data) {
+		if len(data) < pos+4 {
+			return fmt.Errorf("data too short for field length")
+		}
+		l := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if len(data) < pos+l {
+			return fmt.Errorf("data too short for field")
+		}
+		fields = append(fields, data[pos:pos+l])
+		pos += l
+	}
+	// unknown trailing fields are ignored, missing fields stay empty
+	field := func(i int) []byte {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return nil
+	}
+	d.Hash = string(field(0))
+	if err := unmarshalTime(&d.Timestamp, field(1)); err != nil {
+		return err
+	}
+	if err := unmarshalTime(&d.Expires, field(2)); err != nil {
+		return err
+	}
+	d.ETag = string(field(3))
+	d.LastModified = string(field(4))
+	if f := field(5); len(f) == 8 {
+		d.Size = int64(binary.LittleEndian.Uint64(f))
+	}
+	if err := unmarshalTime(&d.Accessed, field(6)); err != nil {
+		return err
+	}
+	if f := field(7); len(f) == 4 {
+		d.Hits = binary.LittleEndian.Uint32(f)
+	}
+	d.Uniform = unmarshalUniform(field(8))
+	return nil
+}
+
+// unmarshalV1 reads the old format: hash length, hash, timestamp
+func (d *dbEntry) unmarshalV1(data []byte) error {
+	hashLen := binary.LittleEndian.Uint32(data[0:4])
+	if len(data) < int(4+hashLen) {
+		return fmt.Errorf("data too short for hash")
+	}
+	d.Hash = string(data[4 : 4+hashLen])
+	err := d.Timestamp.UnmarshalBinary(data[4+hashLen:])
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func unmarshalTime(t *time.Time, data []byte) error {
+	if len(data) == 0 {
+		*t = time.Time{}
+		return nil
+	}
+	return t.UnmarshalBinary(data)
+}
@@ -0,0 +1,51 @@
+package tilecache
+
+import (
+	"encoding/binary"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryMarshal(t *testing.T) {
+	ast := assert.New(t)
+	e := dbEntry{
+		Hash:         "2f2e1bd7ff7a2bd1b4c44a0e0d31ec4a0b1a7d1b6b0b4ddf1ea2b6c8a1c23ef0",
+		Timestamp:    time.Now().Round(0),
+		ETag:         `"abc"`,
+		LastModified: "Wed, 21 Oct 2015 07:28:00 GMT",
+		Expires:      time.Now().Add(time.Hour).Round(0),
+		Uniform:      &uniformTile{Color: color.NRGBA{R: 170, G: 211, B: 223, A: 255}, Width: 256, Height: 256},
+	}
+	data, err := e.Marshal()
+	ast.NoError(err)
+
+	var d dbEntry
+	ast.NoError(d.Unmarshal(data))
+	ast.Equal(e.Hash, d.Hash)
+	ast.True(e.Timestamp.Equal(d.Timestamp))
+	ast.True(e.Expires.Equal(d.Expires))
+	ast.Equal(e.ETag, d.ETag)
+	ast.Equal(e.LastModified, d.LastModified)
+	ast.Equal(e.Uniform, d.Uniform)
+}
+
+func TestEntryUnmarshalV1(t *testing.T) {
+	ast := assert.New(t)
+	hash := "2f2e1bd7ff7a2bd1b4c44a0e0d31ec4a0b1a7d1b6b0b4ddf1ea2b6c8a1c23ef0"
+	ts := time.Now().Round(0)
+	tsBytes, err := ts.MarshalBinary()
+	ast.NoError(err)
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(hash)))
+	data = append(data, []byte(hash)...)
+	data = append(data, tsBytes...)
+
+	var d dbEntry
+	ast.NoError(d.Unmarshal(data))
+	ast.Equal(hash, d.Hash)
+	ast.True(ts.Equal(d.Timestamp))
+	ast.True(d.Expires.IsZero())
+	ast.Empty(d.ETag)
+}
@@ -0,0 +1,170 @@
+package tilecache
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+const (
+	// EvictLRU removes the least recently used tiles first
+	EvictLRU = "lru"
+	// EvictLFU removes the least frequently used tiles first
+	EvictLFU = "lfu"
+
+	defaultLowWater = 90 // in percent
+)
+
+// access the read accesses of a tile, not yet written into the db
+type access struct {
+	last time.Time
+	hits uint32
+}
+
+// accessTracker collects read accesses in memory, they are written into the db periodically
+type accessTracker struct {
+	alock    sync.Mutex
+	accesses map[model.Tile]access
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{
+		accesses: make(map[model.Tile]access),
+	}
+}
+
+func (a *accessTracker) hit(tile model.Tile) {
+	a.alock.Lock()
+	defer a.alock.Unlock()
+	ac := a.accesses[tile]
+	ac.last = time.Now()
+	ac.hits++
+	a.accesses[tile] = ac
+}
+
+// take returns all collected accesses and resets the tracker
+func (a *accessTracker) take() map[model.Tile]access {
+	a.alock.Lock()
+	defer a.alock.Unlock()
+	acs := a.accesses
+	a.accesses = make(map[model.Tile]access)
+	return acs
+}
+
+func (c *Cache) startEvictionJob() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		runs := 0
+		for {
+			<-ticker.C
+			c.flushAccesses()
+			runs++
+			if runs%10 != 0 || (c.maxsize <= 0 && c.maxtiles <= 0) {
+				continue
+			}
+			err := c.Evict()
+			if err != nil {
+				c.log.Error(fmt.Sprintf("cache eviction error: %v", err))
+			}
+		}
+	}()
+}
+
+// flushAccesses writes the collected read accesses into the db
+func (c *Cache) flushAccesses() {
+	if c.access == nil || c.store == nil {
+		return
+	}
+	for tile, ac := range c.access.take() {
+		err := c.updateEntry(tile, func(e *dbEntry) {
+			e.Accessed = ac.last
+			e.Hits += ac.hits
+		})
+		if err != nil && !errors.Is(err, ErrNotCached) {
+			c.log.Error(fmt.Sprintf("error saving access of %s: %v", tile.String(), err))
+		}
+	}
+}
+
+type evictCandidate struct {
+	tile model.Tile
+	e    dbEntry
+}
+
+// Evict removes the least recently (or frequently) used tiles, if the cache is larger than maxsize or maxtiles,
+// until the cache is below the low water mark. Content files are removed with their last reference.
+func (c *Cache) Evict() error {
+	if c.store == nil {
+		return nil
+	}
+	c.flushAccesses()
+	candidates := make([]evictCandidate, 0)
+	seen := make(map[string]bool)
+	var total int64
+	err := c.Walk("", func(tile model.Tile, e dbEntry) error {
+		// only the badger backend shares the content of equal tiles
+		if e.Hash == "" {
+			total += e.Size
+		} else if !seen[e.Hash] {
+			seen[e.Hash] = true
+			total += e.Size
+		}
+		candidates = append(candidates, evictCandidate{tile: tile, e: e})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	count := len(candidates)
+	if !c.overLimit(total, count, 100) {
+		return nil
+	}
+	c.log.Info(fmt.Sprintf("cache limit reached (%d bytes, %d tiles), evicting tiles", total, count))
+
+	if c.eviction == EvictLFU {
+		slices.SortFunc(candidates, func(a, b evictCandidate) int {
+			if a.e.Hits != b.e.Hits {
+				return int(a.e.Hits) - int(b.e.Hits)
+			}
+			return a.e.LastAccess().Compare(b.e.LastAccess())
+		})
+	} else {
+		slices.SortFunc(candidates, func(a, b evictCandidate) int {
+			return a.e.LastAccess().Compare(b.e.LastAccess())
+		})
+	}
+
+	removed := 0
+	for _, cd := range candidates {
+		if !c.overLimit(total, count, c.lowwater) {
+			break
+		}
+		blobRemoved, err := c.DBDelete(cd.tile)
+		if err != nil {
+			return err
+		}
+		count--
+		removed++
+		if blobRemoved {
+			total -= cd.e.Size
+		}
+	}
+	c.log.Info(fmt.Sprintf("evicted %d tiles, cache now %d bytes, %d tiles", removed, total, count))
+	return nil
+}
+
+// overLimit true if size or count is above percent of the configured maximum
+func (c *Cache) overLimit(size int64, count int, percent int) bool {
+	if c.maxsize > 0 && size > c.maxsize*int64(percent)/100 {
+		return true
+	}
+	if c.maxtiles > 0 && count > c.maxtiles*percent/100 {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package tilecache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestEvictLRU(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.maxtiles = 10
+	c.lowwater = 50
+	c.eviction = EvictLRU
+
+	tiles := make([]model.Tile, 0)
+	for x := range 12 {
+		tile := model.Tile{Provider: "osm", Z: 4, X: x, Y: 1}
+		tiles = append(tiles, tile)
+		// every tile has its own content, only tile 11 shares the content with tile 0
+		content := fmt.Sprintf("%0200d", x%11)
+		ast.NoError(c.Save(tile, bytes.NewReader([]byte(content))))
+	}
+	// read the first tile, so it's the most recently used
+	rd, ok := c.Tile(tiles[0])
+	ast.True(ok)
+	rd.Close()
+
+	ast.NoError(c.Evict())
+
+	ast.True(c.DBHas(tiles[0]))
+	ast.False(c.DBHas(tiles[1]))
+	count := 0
+	ast.NoError(c.Walk("", func(tile model.Tile, e dbEntry) error {
+		count++
+		_, file := badgerOf(c).getFilename(e.Hash)
+		_, err := os.Stat(file)
+		ast.NoError(err)
+		return nil
+	}))
+	ast.Equal(5, count)
+}
+
+func TestFlushAccesses(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	tile := model.Tile{Provider: "osm", Z: 4, X: 1, Y: 1}
+	ast.NoError(c.Save(tile, bytes.NewReader([]byte(fmt.Sprintf("%0200d", 0)))))
+
+	// saves running together with the flush of the accesses are not overwritten
+	for i := range 50 {
+		rd, ok := c.Tile(tile)
+		ast.True(ok)
+		rd.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ast.NoError(c.Save(tile, bytes.NewReader([]byte(fmt.Sprintf("%0200d", i+1)))))
+		}()
+		c.flushAccesses()
+		<-done
+	}
+	c.flushAccesses()
+
+	e, err := c.DBGet(tile)
+	ast.NoError(err)
+	ast.Equal(1, badgerOf(c).RefCount(e.Hash))
+	_, file := badgerOf(c).getFilename(e.Hash)
+	ast.FileExists(file)
+	ast.Greater(e.Hits, uint32(0))
+
+	// the metadata update keeps the content
+	ast.NoError(c.updateEntry(tile, func(u *dbEntry) {
+		u.Hash = "other"
+		u.Hits = 100
+	}))
+	u, err := c.DBGet(tile)
+	ast.NoError(err)
+	ast.Equal(e.Hash, u.Hash)
+	ast.Equal(uint32(100), u.Hits)
+	ast.Equal(1, badgerOf(c).RefCount(e.Hash))
+}
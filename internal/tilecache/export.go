@@ -0,0 +1,159 @@
+package tilecache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// ExportResult the result of an export into a MBTiles file
+type ExportResult struct {
+	File    string          `json:"file"`
+	Tiles   int             `json:"tiles"`
+	Bytes   int64           `json:"bytes"`
+	Format  string          `json:"format"`
+	MinZoom int             `json:"minzoom"`
+	MaxZoom int             `json:"maxzoom"`
+	Bounds  mercantile.Bbox `json:"bounds"`
+}
+
+// Export writes the cached tiles of the provider selected by the filter into a new MBTiles file,
+// which can be served by the mbtiles provider. Only tiles of the given variant are exported, an
+// existing file is replaced.
+func (c *Cache) Export(file string, variant string, f TileFilter) (ExportResult, error) {
+	res := ExportResult{File: file, MinZoom: math.MaxInt}
+	if f.Provider == "" {
+		return res, fmt.Errorf("export needs a provider")
+	}
+	tiles := make([]model.Tile, 0)
+	err := c.Walk(f.Provider, func(tile model.Tile, e dbEntry) error {
+		if tile.Variant == variant && f.match(tile) {
+			tiles = append(tiles, tile)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if len(tiles) == 0 {
+		return res, fmt.Errorf("no tiles of %s to export: %w", f.Provider, ErrNotCached)
+	}
+
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return res, err
+	}
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(file))
+	if err != nil {
+		return res, err
+	}
+	defer db.Close()
+	if _, err := db.Exec(mbtilesSchema); err != nil {
+		return res, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return res, err
+	}
+	defer stmt.Close()
+
+	for _, tile := range tiles {
+		data, err := c.content(tile)
+		if err != nil {
+			// the tile may be removed in the meantime
+			c.log.Error(fmt.Sprintf("can't export %s: %v", tile.String(), err))
+			continue
+		}
+		if _, err := stmt.Exec(tile.Z, tile.X, tmsRow(tile.Z, tile.Y), data); err != nil {
+			return res, err
+		}
+		if res.Format == "" {
+			res.Format = tileFormat(data)
+		}
+		tb := mercantile.ULBounds(mercantile.TileID{X: tile.X, Y: tile.Y, Z: tile.Z})
+		if res.Tiles == 0 {
+			res.Bounds = tb
+		} else {
+			res.Bounds = union(res.Bounds, tb)
+		}
+		res.MinZoom = min(res.MinZoom, tile.Z)
+		res.MaxZoom = max(res.MaxZoom, tile.Z)
+		res.Tiles++
+		res.Bytes += int64(len(data))
+	}
+	if res.Tiles == 0 {
+		return res, fmt.Errorf("no tiles of %s exported: %w", f.Provider, ErrNotCached)
+	}
+	if f.BBox != nil && !f.BBox.CrossesAntimeridian() {
+		// the bounds of the MBTiles metadata can't cross the antimeridian, they stay the bounds of the tiles
+		res.Bounds = intersection(res.Bounds, *f.BBox)
+	}
+
+	meta := map[string]string{
+		"name":        f.Provider,
+		"format":      res.Format,
+		"type":        "baselayer",
+		"version":     "1.0",
+		"description": fmt.Sprintf("tiles of %s exported by go_mapproxy on %s", f.Provider, time.Now().Format(time.RFC3339)),
+		"bounds":      fmt.Sprintf("%f,%f,%f,%f", res.Bounds.Left, res.Bounds.Bottom, res.Bounds.Right, res.Bounds.Top),
+		"minzoom":     strconv.Itoa(res.MinZoom),
+		"maxzoom":     strconv.Itoa(res.MaxZoom),
+	}
+	for name, value := range meta {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			return res, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	c.log.Info(fmt.Sprintf("exported %d tiles of %s into %s", res.Tiles, f.Provider, file))
+	return res, nil
+}
+
+// content reads the content of a cached tile
+func (c *Cache) content(tile model.Tile) ([]byte, error) {
+	e, err := c.DBGet(tile)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := c.open(tile, e)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+// tileFormat the MBTiles format of the tile content
+func tileFormat(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/webp":
+		return "webp"
+	}
+	return defaultExt
+}
+
+func union(a, b mercantile.Bbox) mercantile.Bbox {
+	return mercantile.Bbox{Left: min(a.Left, b.Left), Bottom: min(a.Bottom, b.Bottom), Right: max(a.Right, b.Right), Top: max(a.Top, b.Top)}
+}
+
+func intersection(a, b mercantile.Bbox) mercantile.Bbox {
+	return mercantile.Bbox{Left: max(a.Left, b.Left), Bottom: max(a.Bottom, b.Bottom), Right: min(a.Right, b.Right), Top: min(a.Top, b.Top)}
+}
@@ -0,0 +1,55 @@
+package tilecache
+
+import (
+	"bytes"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/i0tool5/mbtiles-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestExportMBTiles(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	white := testPNG(t, color.White)
+	for z := 2; z <= 4; z++ {
+		for x := range 4 {
+			ast.NoError(c.Save(model.Tile{Provider: "osm", Z: z, X: x, Y: 1}, bytes.NewReader(testPNG(t, color.Gray{Y: uint8(z*10 + x)}))))
+		}
+	}
+	ast.NoError(c.Save(model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}, bytes.NewReader(white)))
+	ast.NoError(c.Save(model.Tile{Provider: "gebco", Z: 3, X: 1, Y: 2}, bytes.NewReader(white)))
+
+	file := filepath.Join(t.TempDir(), "osm.mbtiles")
+	res, err := c.Export(file, "", TileFilter{Provider: "osm", MinZoom: 3, BBox: &mercantile.Bbox{Left: -180, Bottom: -85, Right: -1, Top: 85}})
+	ast.NoError(err)
+	// zoom 3: x 0..3 are west, zoom 4: x 0..3 are west as well
+	ast.Equal(9, res.Tiles)
+	ast.Equal("png", res.Format)
+	ast.Equal(3, res.MinZoom)
+	ast.Equal(4, res.MaxZoom)
+	ast.Equal(-1.0, res.Bounds.Right)
+
+	db, err := mbtiles.Open(file)
+	ast.NoError(err)
+	defer db.Close()
+	meta, err := db.ReadMetadata()
+	ast.NoError(err)
+	ast.Equal("osm", meta["name"])
+	ast.Equal("png", meta["format"])
+	ast.Equal(3, meta["minzoom"])
+	ast.Equal(4, meta["maxzoom"])
+	ast.Len(meta["bounds"], 4)
+
+	var data []byte
+	// the mbtiles rows are in TMS order
+	ast.NoError(db.ReadTile(3, 1, int64(tmsRow(3, 2)), &data))
+	ast.Equal(white, data)
+
+	_, err = c.Export(file, "", TileFilter{Provider: "sea"})
+	ast.ErrorIs(err, ErrNotCached)
+}
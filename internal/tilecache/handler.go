@@ -0,0 +1,244 @@
+package tilecache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/mercantile"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+type purgeResponse struct {
+	Removed int `json:"removed"`
+}
+
+// Routes the admin routes of the cache
+func Routes(inj do.Injector) *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/", GetStatsHandler(inj))
+	router.Post("/cleanup", PostCleanupHandler(inj))
+	router.Post("/gc", PostGCHandler(inj))
+	router.Get("/{provider}", GetProviderStatsHandler(inj))
+	router.Delete("/{provider}", DeleteProviderHandler(inj))
+	router.Get("/{provider}/export", GetExportHandler(inj))
+	router.Get("/{provider}/{z}/{x}/{y}", GetTileHandler(inj))
+	return router
+}
+
+// activeCache returns the cache, if it's not active an error is written
+func activeCache(inj do.Injector, w http.ResponseWriter) (*Cache, bool) {
+	c := do.MustInvoke[*Cache](inj)
+	if !c.IsActive() {
+		http.Error(w, "cache is not active", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return c, true
+}
+
+func GetStatsHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		stats, err := c.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, stats)
+	})
+}
+
+func GetProviderStatsHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		name := chi.URLParam(r, "provider")
+		stats, err := c.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ps, ok := stats[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no cached tiles of provider %s", name), http.StatusNotFound)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, ps)
+	})
+}
+
+func GetTileHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		tile := model.Tile{
+			Provider: chi.URLParam(r, "provider"),
+			Variant:  r.URL.Query().Get("variant"),
+		}
+		var err error
+		for _, p := range []struct {
+			name string
+			v    *int
+		}{{"z", &tile.Z}, {"x", &tile.X}, {"y", &tile.Y}} {
+			if *p.v, err = strconv.Atoi(chi.URLParam(r, p.name)); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %v", p.name, err), http.StatusBadRequest)
+				return
+			}
+		}
+		e, err := c.Entry(tile)
+		if errors.Is(err, ErrNotCached) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, e)
+	})
+}
+
+// DeleteProviderHandler purges the tiles of the provider, optional restricted by the query
+// parameters minzoom, maxzoom and bbox (west,south,east,north)
+func DeleteProviderHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		f, err := tileFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		removed, err := c.Purge(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, purgeResponse{Removed: removed})
+	})
+}
+
+func tileFilter(r *http.Request) (TileFilter, error) {
+	f := TileFilter{Provider: chi.URLParam(r, "provider")}
+	q := r.URL.Query()
+	var err error
+	if v := q.Get("minzoom"); v != "" {
+		if f.MinZoom, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf("invalid minzoom: %v", err)
+		}
+	}
+	if v := q.Get("maxzoom"); v != "" {
+		if f.MaxZoom, err = strconv.Atoi(v); err != nil {
+			return f, fmt.Errorf("invalid maxzoom: %v", err)
+		}
+	}
+	if v := q.Get("bbox"); v != "" {
+		bb, err := mercantile.ParseBbox(v)
+		if err != nil {
+			return f, err
+		}
+		f.BBox = &bb
+	}
+	return f, nil
+}
+
+// GetExportHandler exports the tiles of the provider into a MBTiles file, which is sent as download.
+// The tiles can be restricted by the query parameters variant, minzoom, maxzoom and bbox.
+func GetExportHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		f, err := tileFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmp, err := os.MkdirTemp("", "tile_export_*")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(tmp)
+		res, err := c.Export(filepath.Join(tmp, "export.mbtiles"), r.URL.Query().Get("variant"), f)
+		if errors.Is(err, ErrNotCached) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Provider+mbtilesExt))
+		http.ServeFile(w, r, res.File)
+	})
+}
+
+// PostCleanupHandler removes the expired tiles, returns the stats after the cleanup
+func PostCleanupHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		if err := c.Cleanup(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats, err := c.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, stats)
+	})
+}
+
+// PostGCHandler runs the garbage collection and the value log GC of the backend
+func PostGCHandler(inj do.Injector) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := activeCache(inj, w)
+		if !ok {
+			return
+		}
+		res, err := c.GC()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := c.ValueLogGC(); err != nil && !errors.Is(err, ErrNotSupported) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, res)
+	})
+}
@@ -0,0 +1,199 @@
+package tilecache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// importProgressStep the number of tiles between two progress reports
+const importProgressStep = 1000
+
+// importMaxZoom the highest zoom level of an imported tile
+const importMaxZoom = 30
+
+// ImportResult the result (and the progress) of an import into the cache
+type ImportResult struct {
+	Source   string `json:"source"`
+	Provider string `json:"provider"`
+	Total    int    `json:"total"`    // tiles found in the source
+	Done     int    `json:"done"`     // tiles processed so far
+	Imported int    `json:"imported"` // tiles saved into the cache
+	Skipped  int    `json:"skipped"`  // tiles already cached with the same content or not selected by the filter
+	Failed   int    `json:"failed"`
+	Bytes    int64  `json:"bytes"`  // size of the imported tiles
+	Unique   int    `json:"unique"` // different contents of the imported tiles
+}
+
+// ImportOptions the options of an import
+type ImportOptions struct {
+	// Filter selects the imported tiles, the provider of the filter is ignored
+	Filter TileFilter
+	// TMS the rows of a tile directory are in TMS order (y flipped), MBTiles files are always in TMS order
+	TMS bool
+	// Progress is called every importProgressStep tiles and at the end of the import
+	Progress func(res ImportResult)
+}
+
+// Import seeds the cache for the provider with the tiles of a MBTiles file or a z/x/y tile directory.
+// Tiles already cached with the same content are skipped, equal tiles share their content in the
+// content store of the badger backend.
+func (c *Cache) Import(source, providerName string, opts ImportOptions) (ImportResult, error) {
+	res := ImportResult{Source: source, Provider: providerName}
+	if providerName == "" {
+		return res, fmt.Errorf("import needs a provider")
+	}
+	if !c.active {
+		return res, fmt.Errorf("cache is not active")
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return res, err
+	}
+	imp := &importer{c: c, res: &res, opts: opts, hashes: make(map[string]bool)}
+	if fi.IsDir() {
+		err = imp.directory(source, providerName)
+	} else {
+		err = imp.mbtiles(source, providerName)
+	}
+	if opts.Progress != nil {
+		opts.Progress(res)
+	}
+	if err != nil {
+		return res, err
+	}
+	c.log.Info(fmt.Sprintf("imported %d of %d tiles from %s into %s, skipped: %d, failed: %d", res.Imported, res.Total, source, providerName, res.Skipped, res.Failed))
+	return res, nil
+}
+
+type importer struct {
+	c      *Cache
+	res    *ImportResult
+	opts   ImportOptions
+	hashes map[string]bool
+}
+
+// mbtiles imports the tiles of a MBTiles file
+func (i *importer) mbtiles(file, providerName string) error {
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(file)+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.QueryRow("SELECT COUNT(*) FROM tiles").Scan(&i.res.Total); err != nil {
+		return fmt.Errorf("%s is not a MBTiles file: %w", file, err)
+	}
+	rows, err := db.Query("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tile model.Tile
+		var data []byte
+		if err := rows.Scan(&tile.Z, &tile.X, &tile.Y, &data); err != nil {
+			return err
+		}
+		tile.Provider = providerName
+		i.tile(tile, true, data)
+	}
+	return rows.Err()
+}
+
+// directory imports the tiles of a z/x/y.ext directory
+func (i *importer) directory(dir, providerName string) error {
+	files := make(map[model.Tile]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		tile, err := parseXYZPath(providerName + "/" + filepath.ToSlash(rel))
+		// sidecar and temporary files like 12.png.meta are no tiles
+		if err != nil || strings.Contains(tile.Variant, ".") {
+			return nil
+		}
+		tile.Variant = ""
+		files[tile] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i.res.Total = len(files)
+	for tile, p := range files {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			i.res.Done++
+			i.failed(tile, err)
+			continue
+		}
+		i.tile(tile, i.opts.TMS, data)
+	}
+	return nil
+}
+
+// tile imports a single tile, with tms the row is in TMS order and flipped after the coordinates are checked
+func (i *importer) tile(tile model.Tile, tms bool, data []byte) {
+	defer i.progress()
+	i.res.Done++
+	if tile.Z < 0 || tile.Z > importMaxZoom || tile.X < 0 || tile.Y < 0 || tile.X >= 1<<tile.Z || tile.Y >= 1<<tile.Z {
+		i.failed(tile, fmt.Errorf("invalid tile coordinates"))
+		return
+	}
+	if tms {
+		tile.Y = tmsRow(tile.Z, tile.Y)
+	}
+	if !i.opts.Filter.match(tile) || i.cached(tile, data) {
+		i.res.Skipped++
+		return
+	}
+	if err := i.c.Save(tile, bytes.NewReader(data)); err != nil {
+		i.failed(tile, err)
+		return
+	}
+	h := sha256.Sum256(data)
+	if hash := hex.EncodeToString(h[:]); !i.hashes[hash] {
+		i.hashes[hash] = true
+		i.res.Unique++
+	}
+	i.res.Imported++
+	i.res.Bytes += int64(len(data))
+}
+
+// cached true if the tile is already cached with the same content
+func (i *importer) cached(tile model.Tile, data []byte) bool {
+	e, err := i.c.DBGet(tile)
+	if err != nil || e.Size != int64(len(data)) {
+		return false
+	}
+	if e.Hash != "" {
+		h := sha256.Sum256(data)
+		return e.Hash == hex.EncodeToString(h[:])
+	}
+	// backends without content hash
+	old, err := i.c.content(tile)
+	return err == nil && bytes.Equal(old, data)
+}
+
+func (i *importer) failed(tile model.Tile, err error) {
+	i.res.Failed++
+	i.c.log.Error(fmt.Sprintf("can't import %s: %v", tile.String(), err))
+}
+
+func (i *importer) progress() {
+	if i.opts.Progress != nil && i.res.Done%importProgressStep == 0 {
+		i.opts.Progress(*i.res)
+	}
+}
@@ -0,0 +1,98 @@
+package tilecache
+
+import (
+	"bytes"
+	"database/sql"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestImportMBTiles(t *testing.T) {
+	ast := assert.New(t)
+	src := newTestCache(t)
+	white := testPNG(t, color.White)
+	for x := range 4 {
+		ast.NoError(src.Save(model.Tile{Provider: "osm", Z: 2, X: x, Y: 1}, bytes.NewReader(white)))
+	}
+	gray := testPNG(t, color.Gray{Y: 128})
+	ast.NoError(src.Save(model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}, bytes.NewReader(gray)))
+	file := filepath.Join(t.TempDir(), "osm.mbtiles")
+	_, err := src.Export(file, "", TileFilter{Provider: "osm"})
+	ast.NoError(err)
+
+	c := newTestCache(t)
+	progress := 0
+	res, err := c.Import(file, "sea", ImportOptions{Progress: func(res ImportResult) { progress++ }})
+	ast.NoError(err)
+	ast.Equal(5, res.Total)
+	ast.Equal(5, res.Imported)
+	ast.Equal(2, res.Unique)
+	ast.Equal(1, progress)
+	// the TMS rows are flipped back
+	data, err := c.content(model.Tile{Provider: "sea", Z: 3, X: 1, Y: 2})
+	ast.NoError(err)
+	ast.Equal(gray, data)
+	// equal tiles share their content
+	e, err := c.DBGet(model.Tile{Provider: "sea", Z: 2, X: 0, Y: 1})
+	ast.NoError(err)
+	ast.Equal(4, badgerOf(c).RefCount(e.Hash))
+
+	// a second import skips the already cached tiles
+	res, err = c.Import(file, "sea", ImportOptions{})
+	ast.NoError(err)
+	ast.Equal(0, res.Imported)
+	ast.Equal(5, res.Skipped)
+}
+
+func TestImportMBTilesInvalidZoom(t *testing.T) {
+	ast := assert.New(t)
+	src := newTestCache(t)
+	white := testPNG(t, color.White)
+	ast.NoError(src.Save(model.Tile{Provider: "osm", Z: 2, X: 1, Y: 1}, bytes.NewReader(white)))
+	file := filepath.Join(t.TempDir(), "osm.mbtiles")
+	_, err := src.Export(file, "", TileFilter{Provider: "osm"})
+	ast.NoError(err)
+
+	// a corrupt file with zoom levels out of range
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(file))
+	ast.NoError(err)
+	for _, z := range []int{-1, -64, 31, 64} {
+		_, err = db.Exec("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, 0, 0, ?)", z, white)
+		ast.NoError(err)
+	}
+	ast.NoError(db.Close())
+
+	c := newTestCache(t)
+	res, err := c.Import(file, "sea", ImportOptions{})
+	ast.NoError(err)
+	ast.Equal(5, res.Total)
+	ast.Equal(1, res.Imported)
+	ast.Equal(4, res.Failed)
+}
+
+func TestImportDirectory(t *testing.T) {
+	ast := assert.New(t)
+	dir := t.TempDir()
+	white := testPNG(t, color.White)
+	for _, p := range []string{"1/0/0.png", "1/1/0.jpg", "2/3/1.png", "2/3/1.png.meta", "readme.txt"} {
+		ast.NoError(os.MkdirAll(filepath.Dir(filepath.Join(dir, p)), 0o755))
+		ast.NoError(os.WriteFile(filepath.Join(dir, p), white, 0o644))
+	}
+
+	c := newTestCache(t)
+	res, err := c.Import(dir, "osm", ImportOptions{TMS: true})
+	ast.NoError(err)
+	ast.Equal(3, res.Total)
+	ast.Equal(3, res.Imported)
+	ast.True(c.DBHas(model.Tile{Provider: "osm", Z: 1, X: 0, Y: 1}))
+	ast.True(c.DBHas(model.Tile{Provider: "osm", Z: 1, X: 1, Y: 1}))
+	ast.True(c.DBHas(model.Tile{Provider: "osm", Z: 2, X: 3, Y: 2}))
+
+	_, err = c.Import(filepath.Join(dir, "missing"), "osm", ImportOptions{})
+	ast.Error(err)
+}
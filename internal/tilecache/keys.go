@@ -0,0 +1,152 @@
+package tilecache
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// Layout of the tile keys (version 2):
+//
+//	't' | len(provider) | provider | len(variant) | variant | z (uint8) | x (uint32 BE) | y (uint32 BE)
+//
+// All tiles of a provider share the same prefix, so they can be enumerated with a prefix scan.
+// The coordinates are big endian, so the keys of a provider are sorted by z, x, y.
+const (
+	tilePrefix  byte = 't'
+	metaPrefix  byte = 'm'
+	statePrefix byte = 's' // states of other services, e.g. the prefetch jobs
+
+	keyVersion = 2
+)
+
+var keyVersionKey = []byte{metaPrefix, 'k', 'e', 'y', 'v'}
+
+// DBKey builds the badger key of the tile
+func (s *badgerStore) DBKey(tile model.Tile) []byte {
+	key := providerPrefix(tile.Provider)
+	key = append(key, uint8(len(tile.Variant)))
+	key = append(key, tile.Variant...)
+	key = append(key, uint8(tile.Z))
+	key = binary.BigEndian.AppendUint32(key, uint32(tile.X))
+	key = binary.BigEndian.AppendUint32(key, uint32(tile.Y))
+	return key
+}
+
+// providerPrefix the key prefix of all tiles of the provider
+func providerPrefix(provider string) []byte {
+	key := make([]byte, 0, 2+len(provider)+11)
+	key = append(key, tilePrefix, uint8(len(provider)))
+	key = append(key, provider...)
+	return key
+}
+
+// parseKey is the reverse of DBKey
+func parseKey(key []byte) (model.Tile, error) {
+	var tile model.Tile
+	if len(key) < 2 || key[0] != tilePrefix {
+		return tile, fmt.Errorf("not a tile key")
+	}
+	pos := 1
+	pl := int(key[pos])
+	pos++
+	if len(key) < pos+pl+1 {
+		return tile, fmt.Errorf("tile key too short for provider")
+	}
+	tile.Provider = string(key[pos : pos+pl])
+	pos += pl
+	vl := int(key[pos])
+	pos++
+	if len(key) != pos+vl+9 {
+		return tile, fmt.Errorf("invalid tile key length")
+	}
+	tile.Variant = string(key[pos : pos+vl])
+	pos += vl
+	tile.Z = int(key[pos])
+	tile.X = int(binary.BigEndian.Uint32(key[pos+1 : pos+5]))
+	tile.Y = int(binary.BigEndian.Uint32(key[pos+5 : pos+9]))
+	return tile, nil
+}
+
+// parseKeyV1 reads the old key layout: z (uint8), x (uint16 LE at 1), y (uint16 LE at 4), provider at 9
+func parseKeyV1(key []byte) (model.Tile, error) {
+	var tile model.Tile
+	if len(key) < 10 {
+		return tile, fmt.Errorf("v1 key too short")
+	}
+	tile.Z = int(key[0])
+	tile.X = int(binary.LittleEndian.Uint16(key[1:3]))
+	tile.Y = int(binary.LittleEndian.Uint16(key[4:6]))
+	tile.Provider = string(key[9:])
+	return tile, nil
+}
+
+// migrateKeys rewrites all entries with the old key layout into the actual one. This is done only once,
+// the key version is stored in the db. Old keys of zoom levels above 16 are ambiguous and will be removed.
+func (s *badgerStore) migrateKeys() error {
+	version := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(keyVersionKey)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) > 0 {
+				version = int(val[0])
+			}
+			return nil
+		})
+	})
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	if version >= keyVersion {
+		return nil
+	}
+
+	s.log.Info("migrating cache keys to the actual layout")
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	migrated, removed := 0, 0
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			if key[0] == tilePrefix || key[0] == metaPrefix || key[0] == statePrefix {
+				continue
+			}
+			if err := wb.Delete(key); err != nil {
+				return err
+			}
+			tile, err := parseKeyV1(key)
+			if err != nil || tile.Z > 16 {
+				removed++
+				continue
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := wb.Set(s.DBKey(tile), val); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Set(keyVersionKey, []byte{keyVersion}); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	s.log.Info(fmt.Sprintf("cache keys migrated: %d, removed: %d", migrated, removed))
+	return nil
+}
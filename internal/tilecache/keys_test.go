@@ -0,0 +1,106 @@
+package tilecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newTestCacheWith(&badgerStore{
+		log:  logging.New("tilecache"),
+		path: t.TempDir(),
+		db:   db,
+	})
+}
+
+func newTestCacheWith(store Storage) *Cache {
+	return &Cache{
+		log:    logging.New("tilecache"),
+		active: true,
+		store:  store,
+		access: newAccessTracker(),
+	}
+}
+
+// badgerOf the badger backend of a test cache
+func badgerOf(c *Cache) *badgerStore {
+	return c.store.(*badgerStore)
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	ast := assert.New(t)
+	s := &badgerStore{}
+	tiles := []model.Tile{
+		{Provider: "gebco", Z: 0, X: 0, Y: 0},
+		{Provider: "osm", Variant: "jpg", Z: 18, X: 140000, Y: 91000},
+		{Provider: "gebco", Z: 18, X: 65536, Y: 65536},
+	}
+	for _, tile := range tiles {
+		key := s.DBKey(tile)
+		ast.True(bytes.HasPrefix(key, providerPrefix(tile.Provider)))
+		pt, err := parseKey(key)
+		ast.NoError(err)
+		ast.Equal(tile, pt)
+	}
+	// no more collisions above zoom 16
+	ast.NotEqual(s.DBKey(tiles[2]), s.DBKey(model.Tile{Provider: "gebco", Z: 18, X: 0, Y: 0}))
+}
+
+func TestMigrateKeys(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	s := badgerOf(c)
+
+	v1Key := func(tile model.Tile) []byte {
+		key := make([]byte, 9+len(tile.Provider))
+		key[0] = uint8(tile.Z)
+		binary.LittleEndian.PutUint16(key[1:3], uint16(tile.X))
+		binary.LittleEndian.PutUint16(key[4:6], uint16(tile.Y))
+		copy(key[9:], tile.Provider)
+		return key
+	}
+	old := model.Tile{Provider: "gebco", Z: 5, X: 17, Y: 11}
+	ambiguous := model.Tile{Provider: "gebco", Z: 17, X: 70000, Y: 11}
+	entry, err := dbEntry{Hash: "abc", Timestamp: time.Now()}.Marshal()
+	ast.NoError(err)
+	err = s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(v1Key(old), entry); err != nil {
+			return err
+		}
+		return txn.Set(v1Key(ambiguous), entry)
+	})
+	ast.NoError(err)
+
+	ast.NoError(s.migrateKeys())
+	ast.True(c.DBHas(old))
+	ast.False(c.DBHas(ambiguous))
+
+	count := 0
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	ast.NoError(err)
+	// migrated tile and the key version
+	ast.Equal(2, count)
+
+	// second run does nothing
+	ast.NoError(s.migrateKeys())
+	ast.True(c.DBHas(old))
+}
@@ -0,0 +1,85 @@
+package tilecache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// MemoryConfig configuration of the in memory tier in front of the disk cache
+type MemoryConfig struct {
+	MaxSize int64 `yaml:"maxsize"` // in bytes, 0 disables the memory tier
+}
+
+type memoryItem struct {
+	tile       model.Tile
+	data       []byte
+	freshUntil time.Time // zero, if the tile never gets stale
+}
+
+func (m memoryItem) isStale() bool {
+	return !m.freshUntil.IsZero() && time.Now().After(m.freshUntil)
+}
+
+// memoryCache a size bounded LRU of tile data
+type memoryCache struct {
+	mlock   sync.Mutex
+	maxsize int64
+	size    int64
+	lru     *list.List
+	items   map[model.Tile]*list.Element
+}
+
+func newMemoryCache(maxsize int64) *memoryCache {
+	return &memoryCache{
+		maxsize: maxsize,
+		lru:     list.New(),
+		items:   make(map[model.Tile]*list.Element),
+	}
+}
+
+func (m *memoryCache) get(tile model.Tile) (memoryItem, bool) {
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	el, ok := m.items[tile]
+	if !ok {
+		return memoryItem{}, false
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(memoryItem), true
+}
+
+// put adds the tile, the least recently used tiles are removed, if the max size is reached
+func (m *memoryCache) put(item memoryItem) {
+	if int64(len(item.data)) > m.maxsize {
+		return
+	}
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	if el, ok := m.items[item.tile]; ok {
+		m.size -= int64(len(el.Value.(memoryItem).data))
+		el.Value = item
+		m.lru.MoveToFront(el)
+	} else {
+		m.items[item.tile] = m.lru.PushFront(item)
+	}
+	m.size += int64(len(item.data))
+	for m.size > m.maxsize {
+		el := m.lru.Back()
+		old := m.lru.Remove(el).(memoryItem)
+		delete(m.items, old.tile)
+		m.size -= int64(len(old.data))
+	}
+}
+
+func (m *memoryCache) remove(tile model.Tile) {
+	m.mlock.Lock()
+	defer m.mlock.Unlock()
+	if el, ok := m.items[tile]; ok {
+		old := m.lru.Remove(el).(memoryItem)
+		delete(m.items, tile)
+		m.size -= int64(len(old.data))
+	}
+}
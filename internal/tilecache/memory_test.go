@@ -0,0 +1,100 @@
+package tilecache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
+)
+
+func TestMemoryLRU(t *testing.T) {
+	ast := assert.New(t)
+	m := newMemoryCache(300)
+	for x := range 4 {
+		m.put(memoryItem{tile: model.Tile{Provider: "osm", X: x}, data: make([]byte, 100)})
+		if x == 2 {
+			// tile 0 is used again, so tile 1 is the least recently used one
+			_, ok := m.get(model.Tile{Provider: "osm", X: 0})
+			ast.True(ok)
+		}
+	}
+	_, ok := m.get(model.Tile{Provider: "osm", X: 1})
+	ast.False(ok)
+	_, ok = m.get(model.Tile{Provider: "osm", X: 0})
+	ast.True(ok)
+	ast.Equal(int64(300), m.size)
+
+	m.remove(model.Tile{Provider: "osm", X: 0})
+	ast.Equal(int64(200), m.size)
+	m.put(memoryItem{tile: model.Tile{Provider: "osm", X: 9}, data: make([]byte, 400)})
+	_, ok = m.get(model.Tile{Provider: "osm", X: 9})
+	ast.False(ok)
+}
+
+func TestMemoryTier(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.memory = newMemoryCache(1024 * 1024)
+	c.metrics = measurement.New(true)
+	tile := model.Tile{Provider: "osm", Z: 2, X: 1, Y: 1}
+	content := []byte(fmt.Sprintf("%0200d", 1))
+	ast.NoError(c.Save(tile, bytes.NewReader(content)))
+
+	for range 3 {
+		rd, ok := c.Tile(tile)
+		ast.True(ok)
+		data, err := io.ReadAll(rd)
+		rd.Close()
+		ast.NoError(err)
+		ast.Equal(content, data)
+	}
+	ast.Equal(2, c.metrics.Point("memoryCacheHit").Data().Count)
+	ast.Equal(1, c.metrics.Point("memoryCacheMiss").Data().Count)
+
+	// a new save invalidates the memory tier
+	content = []byte(fmt.Sprintf("%0200d", 2))
+	ast.NoError(c.Save(tile, bytes.NewReader(content)))
+	rd, ok := c.Tile(tile)
+	ast.True(ok)
+	data, _ := io.ReadAll(rd)
+	ast.Equal(content, data)
+}
+
+func TestMemoryTierAccesses(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.memory = newMemoryCache(1024 * 1024)
+	c.metrics = measurement.New(true)
+	tile := model.Tile{Provider: "osm", Z: 2, X: 1, Y: 1}
+	ast.NoError(c.Save(tile, bytes.NewReader([]byte(fmt.Sprintf("%0200d", 1)))))
+	for range 2 {
+		rd, ok := c.Tile(tile)
+		ast.True(ok)
+		rd.Close()
+	}
+	ast.Equal(1, c.metrics.Point("memoryCacheHit").Data().Count)
+
+	// writing the access stats and refreshing the metadata keep the tile in memory
+	c.flushAccesses()
+	rd, ok := c.Tile(tile)
+	ast.True(ok)
+	rd.Close()
+	ast.Equal(2, c.metrics.Point("memoryCacheHit").Data().Count)
+	ast.NoError(c.Refresh(tile, model.CacheInfo{ETag: `"v2"`}))
+	e, err := c.DBGet(tile)
+	ast.NoError(err)
+	e.Hits = 5
+	ast.NoError(c.DBSet(tile, *e))
+	_, ok = c.memory.get(tile)
+	ast.True(ok)
+
+	// a deleted tile is removed
+	_, err = c.DBDelete(tile)
+	ast.NoError(err)
+	_, ok = c.memory.get(tile)
+	ast.False(ok)
+}
@@ -0,0 +1,123 @@
+package tilecache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// defaultMaxMisses the default max number of negative entries
+const defaultMaxMisses = 100000
+
+// NegativeConfig configuration of the negative cache, which remembers tiles missing at the upstream
+type NegativeConfig struct {
+	NotFoundTTL int `yaml:"notfoundttl"` // in seconds, 0 disables the negative caching of not found tiles (http 404)
+	EmptyTTL    int `yaml:"emptyttl"`    // in seconds, 0 disables the negative caching of empty tiles
+	ErrorTTL    int `yaml:"errorttl"`    // in seconds, 0 disables the negative caching of upstream errors
+	MaxEntries  int `yaml:"maxentries"`  // max number of negative entries, default 100000
+}
+
+type missItem struct {
+	tile   model.Tile
+	status model.MissStatus
+	until  time.Time
+}
+
+// negativeCache a size bounded LRU of the tiles missing at the upstream, the entries expire after the ttl of their status
+type negativeCache struct {
+	nlock      sync.Mutex
+	ttls       map[model.MissStatus]time.Duration
+	maxentries int
+	lru        *list.List
+	items      map[model.Tile]*list.Element
+}
+
+// newNegativeCache creates the negative cache, nil if no ttl is configured
+func newNegativeCache(cfg NegativeConfig) *negativeCache {
+	if cfg.NotFoundTTL <= 0 && cfg.EmptyTTL <= 0 && cfg.ErrorTTL <= 0 {
+		return nil
+	}
+	n := &negativeCache{
+		ttls: map[model.MissStatus]time.Duration{
+			model.MissNotFound: time.Duration(cfg.NotFoundTTL) * time.Second,
+			model.MissEmpty:    time.Duration(cfg.EmptyTTL) * time.Second,
+			model.MissError:    time.Duration(cfg.ErrorTTL) * time.Second,
+		},
+		maxentries: cfg.MaxEntries,
+		lru:        list.New(),
+		items:      make(map[model.Tile]*list.Element),
+	}
+	if n.maxentries <= 0 {
+		n.maxentries = defaultMaxMisses
+	}
+	return n
+}
+
+func (n *negativeCache) get(tile model.Tile) (model.MissStatus, bool) {
+	n.nlock.Lock()
+	defer n.nlock.Unlock()
+	el, ok := n.items[tile]
+	if !ok {
+		return 0, false
+	}
+	item := el.Value.(missItem)
+	if time.Now().After(item.until) {
+		n.lru.Remove(el)
+		delete(n.items, tile)
+		return 0, false
+	}
+	n.lru.MoveToFront(el)
+	return item.status, true
+}
+
+// put adds the tile, statuses without ttl are ignored
+func (n *negativeCache) put(tile model.Tile, status model.MissStatus) {
+	ttl := n.ttls[status]
+	if ttl <= 0 {
+		return
+	}
+	item := missItem{tile: tile, status: status, until: time.Now().Add(ttl)}
+	n.nlock.Lock()
+	defer n.nlock.Unlock()
+	if el, ok := n.items[tile]; ok {
+		el.Value = item
+		n.lru.MoveToFront(el)
+		return
+	}
+	n.items[tile] = n.lru.PushFront(item)
+	for n.lru.Len() > n.maxentries {
+		old := n.lru.Remove(n.lru.Back()).(missItem)
+		delete(n.items, old.tile)
+	}
+}
+
+func (n *negativeCache) remove(tile model.Tile) {
+	n.nlock.Lock()
+	defer n.nlock.Unlock()
+	if el, ok := n.items[tile]; ok {
+		n.lru.Remove(el)
+		delete(n.items, tile)
+	}
+}
+
+// Miss returns the status of a tile, which is known to be missing at the upstream
+func (c *Cache) Miss(tile model.Tile) (model.MissStatus, bool) {
+	if !c.active || c.negative == nil {
+		return 0, false
+	}
+	status, ok := c.negative.get(tile)
+	if ok {
+		c.metrics.Point("negativeCacheHit").Inc(1)
+	}
+	return status, ok
+}
+
+// SaveMiss remembers that the upstream has no tile, until the ttl of the status is reached
+func (c *Cache) SaveMiss(tile model.Tile, status model.MissStatus) {
+	if !c.active || c.negative == nil {
+		return
+	}
+	c.negative.put(tile, status)
+}
@@ -0,0 +1,54 @@
+package tilecache
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
+)
+
+func TestNegativeCache(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.metrics = measurement.New(true)
+	c.negative = newNegativeCache(NegativeConfig{NotFoundTTL: 60, ErrorTTL: 60, MaxEntries: 2})
+	sea := model.Tile{Provider: "osm", Z: 5, X: 1, Y: 1}
+	land := model.Tile{Provider: "osm", Z: 5, X: 2, Y: 1}
+	down := model.Tile{Provider: "osm", Z: 5, X: 3, Y: 1}
+
+	_, ok := c.Miss(sea)
+	ast.False(ok)
+	c.SaveMiss(sea, model.MissNotFound)
+	// empty tiles have no ttl
+	c.SaveMiss(land, model.MissEmpty)
+	status, ok := c.Miss(sea)
+	ast.True(ok)
+	ast.Equal(model.MissNotFound, status)
+	_, ok = c.Miss(land)
+	ast.False(ok)
+	ast.Equal(1, c.metrics.Point("negativeCacheHit").Data().Count)
+
+	// a saved tile removes the negative entry
+	ast.NoError(c.Save(sea, bytes.NewReader(testPNG(t, color.White))))
+	_, ok = c.Miss(sea)
+	ast.False(ok)
+
+	// the least recently used entries are removed
+	c.SaveMiss(sea, model.MissNotFound)
+	c.SaveMiss(land, model.MissError)
+	c.SaveMiss(down, model.MissError)
+	_, ok = c.Miss(sea)
+	ast.False(ok)
+	_, ok = c.Miss(down)
+	ast.True(ok)
+
+	// expired entries are removed
+	c.negative.items[down].Value = missItem{tile: down, status: model.MissError, until: time.Now().Add(-time.Second)}
+	_, ok = c.Miss(down)
+	ast.False(ok)
+	ast.Nil(newNegativeCache(NegativeConfig{}))
+}
@@ -0,0 +1,112 @@
+package tilecache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/provider"
+)
+
+// Policy the caching policy of a provider
+type Policy struct {
+	MaxAge int // in hours, <= 0 the tiles never expire
+	MinAge int // in hours, the tiles are fresh at least this long, regardless of the upstream expiry
+}
+
+type providerConfig interface {
+	GetProviderConfig() provider.ConfigMap
+}
+
+// initPolicies builds the policies of all providers, provider settings win over the cache settings
+func (c *Cache) initPolicies(inj do.Injector) {
+	c.policies = make(map[string]Policy)
+	pc, err := do.InvokeAs[providerConfig](inj)
+	if err != nil {
+		return
+	}
+	for name, cfg := range pc.GetProviderConfig() {
+		p := Policy{
+			MaxAge: c.maxage,
+			MinAge: cfg.MinAge,
+		}
+		if cfg.MaxAge != 0 {
+			p.MaxAge = cfg.MaxAge
+		}
+		c.policies[name] = p
+	}
+}
+
+// Policy returns the caching policy of the provider
+func (c *Cache) Policy(providerName string) Policy {
+	if p, ok := c.policies[providerName]; ok {
+		return p
+	}
+	return Policy{MaxAge: c.maxage}
+}
+
+// isStale true if the tile has to be revalidated or refetched from the upstream,
+// either the upstream expiry or the max age of the provider is reached
+func (c *Cache) isStale(tile model.Tile, db *dbEntry) bool {
+	fu := c.freshUntil(tile, db)
+	return !fu.IsZero() && time.Now().After(fu)
+}
+
+// freshUntil the time the tile gets stale, zero if it never gets stale. This is the earlier of
+// the upstream expiry and the max age, but not before the min age of the provider.
+func (c *Cache) freshUntil(tile model.Tile, db *dbEntry) time.Time {
+	p := c.Policy(tile.Provider)
+	fu := db.Expires
+	if p.MaxAge > 0 {
+		maxAge := db.Timestamp.Add(time.Duration(p.MaxAge) * time.Hour)
+		if fu.IsZero() || maxAge.Before(fu) {
+			fu = maxAge
+		}
+	}
+	if fu.IsZero() {
+		return fu
+	}
+	if p.MinAge > 0 {
+		minAge := db.Timestamp.Add(time.Duration(p.MinAge) * time.Hour)
+		if minAge.After(fu) {
+			fu = minAge
+		}
+	}
+	return fu
+}
+
+// isExpired true if the entry should be removed from the cache, this is maxstale hours after the max age
+func (c *Cache) isExpired(tile model.Tile, db *dbEntry) bool {
+	p := c.Policy(tile.Provider)
+	if p.MaxAge <= 0 || c.maxstale < 0 {
+		return false
+	}
+	return time.Since(db.Timestamp) > time.Duration(p.MaxAge+c.maxstale)*time.Hour
+}
+
+// Cleanup removes all entries expired by the policy of their provider together with their content
+func (c *Cache) Cleanup() error {
+	if c.store == nil {
+		return nil
+	}
+	expired := make([]model.Tile, 0)
+	err := c.Walk("", func(tile model.Tile, e dbEntry) error {
+		if c.isExpired(tile, &e) {
+			expired = append(expired, tile)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, tile := range expired {
+		if _, err := c.DBDelete(tile); err != nil {
+			return err
+		}
+	}
+	c.log.Info(fmt.Sprintf("removed %d expired cache entries", len(expired)))
+
+	_, err = c.GC()
+	return err
+}
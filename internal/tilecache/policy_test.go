@@ -0,0 +1,66 @@
+package tilecache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestPolicyStale(t *testing.T) {
+	ast := assert.New(t)
+	c := &Cache{
+		maxage: 24,
+		policies: map[string]Policy{
+			"osm":   {MaxAge: 24},
+			"gebco": {MaxAge: -1},
+			"sea":   {MaxAge: 24, MinAge: 48},
+		},
+	}
+	old := &dbEntry{Timestamp: time.Now().Add(-36 * time.Hour)}
+	expired := &dbEntry{Timestamp: time.Now().Add(-36 * time.Hour), Expires: time.Now().Add(-time.Hour)}
+
+	ast.True(c.isStale(model.Tile{Provider: "osm"}, old))
+	ast.False(c.isStale(model.Tile{Provider: "gebco"}, old))
+	ast.True(c.isStale(model.Tile{Provider: "gebco"}, expired))
+	ast.False(c.isStale(model.Tile{Provider: "sea"}, expired))
+	ast.True(c.isStale(model.Tile{Provider: "unknown"}, old))
+}
+
+func TestPolicyCleanup(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.maxage = 24
+	c.policies = map[string]Policy{
+		"osm":   {MaxAge: 24},
+		"gebco": {MaxAge: -1},
+	}
+	osm := model.Tile{Provider: "osm", Z: 1, X: 1, Y: 1}
+	gebco := model.Tile{Provider: "gebco", Z: 1, X: 1, Y: 1}
+	for _, tile := range []model.Tile{osm, gebco} {
+		ast.NoError(c.Save(tile, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+		e, err := c.DBGet(tile)
+		ast.NoError(err)
+		e.Timestamp = time.Now().Add(-36 * time.Hour)
+		ast.NoError(c.DBSet(tile, *e))
+	}
+	old, err := c.DBGet(osm)
+	ast.NoError(err)
+
+	count := 0
+	ast.NoError(c.Walk("osm", func(tile model.Tile, e dbEntry) error {
+		ast.Equal(osm, tile)
+		ast.Equal(old.Hash, e.Hash)
+		count++
+		return nil
+	}))
+	ast.Equal(1, count)
+
+	ast.NoError(c.Cleanup())
+	ast.False(c.DBHas(osm))
+	ast.True(c.DBHas(gebco))
+	ast.Equal(1, badgerOf(c).RefCount(old.Hash))
+}
@@ -0,0 +1,296 @@
+package tilecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// The content files are referenced by the hash in the tile entries. For every hash the number of
+// referencing tiles is stored with the key 'r' | hash. A content file is deleted with its last reference.
+const (
+	refPrefix byte = 'r'
+
+	// orphanGrace content files without reference are only removed after this time, to not interfere with running saves
+	orphanGrace = time.Hour
+)
+
+var refsBuiltKey = []byte{metaPrefix, 'r', 'e', 'f', 's'}
+
+// GCResult the result of a garbage collection run
+type GCResult struct {
+	DanglingKeys int `json:"danglingKeys"` // removed tile entries without content file
+	OrphanBlobs  int `json:"orphanBlobs"`  // removed content files without reference
+}
+
+func refKey(hash string) []byte {
+	return append([]byte{refPrefix}, hash...)
+}
+
+// update runs fn in a read/write transaction, retrying on conflicts
+func (s *badgerStore) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := s.db.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+// addRef adds delta to the reference count of the hash and returns the new count
+func addRef(txn *badger.Txn, hash string, delta int) (int, error) {
+	count := 0
+	item, err := txn.Get(refKey(hash))
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			if len(val) == 4 {
+				count = int(binary.LittleEndian.Uint32(val))
+			}
+			return nil
+		})
+	}
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, err
+	}
+	count = max(count+delta, 0)
+	if count == 0 {
+		return 0, txn.Delete(refKey(hash))
+	}
+	return count, txn.Set(refKey(hash), binary.LittleEndian.AppendUint32(nil, uint32(count)))
+}
+
+// oldHash the hash of the actual entry of the key, empty if there is no entry
+func oldHash(txn *badger.Txn, key []byte) (string, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var e dbEntry
+	err = item.Value(func(val []byte) error {
+		return e.Unmarshal(val)
+	})
+	return e.Hash, err
+}
+
+// setEntry saves the entry and updates the reference counts, returns the hash which is no longer referenced
+func (s *badgerStore) setEntry(tile model.Tile, e dbEntry) (string, error) {
+	val, err := e.Marshal()
+	if err != nil {
+		return "", err
+	}
+	key := s.DBKey(tile)
+	unref := ""
+	err = s.update(func(txn *badger.Txn) error {
+		unref = ""
+		old, err := oldHash(txn, key)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(key, val); err != nil {
+			return err
+		}
+		if old == e.Hash {
+			return nil
+		}
+		if e.Hash != "" {
+			// uniform tiles have no content
+			if _, err := addRef(txn, e.Hash, 1); err != nil {
+				return err
+			}
+		}
+		if old != "" {
+			n, err := addRef(txn, old, -1)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				unref = old
+			}
+		}
+		return nil
+	})
+	return unref, err
+}
+
+// deleteEntry removes the entry and updates the reference count, returns the hash if it's no longer referenced
+func (s *badgerStore) deleteEntry(tile model.Tile) (string, error) {
+	key := s.DBKey(tile)
+	unref := ""
+	err := s.update(func(txn *badger.Txn) error {
+		unref = ""
+		old, err := oldHash(txn, key)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if old == "" {
+			// uniform tiles have no content
+			return nil
+		}
+		n, err := addRef(txn, old, -1)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			unref = old
+		}
+		return nil
+	})
+	return unref, err
+}
+
+// Delete removes the tile from the cache, the content file is removed with its last reference.
+// Returns true if the content file was removed.
+func (s *badgerStore) Delete(tile model.Tile) (bool, error) {
+	unref, err := s.deleteEntry(tile)
+	if err != nil || unref == "" {
+		return false, err
+	}
+	return s.removeBlob(unref), nil
+}
+
+// RefCount the number of tiles referencing the content with this hash
+func (s *badgerStore) RefCount(hash string) int {
+	count := 0
+	_ = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(refKey(hash))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 4 {
+				count = int(binary.LittleEndian.Uint32(val))
+			}
+			return nil
+		})
+	})
+	return count
+}
+
+// removeBlob deletes the content file, if it's still unreferenced
+func (s *badgerStore) removeBlob(hash string) bool {
+	s.flock.Lock()
+	defer s.flock.Unlock()
+	if s.RefCount(hash) > 0 {
+		return false
+	}
+	_, file := s.getFilename(hash)
+	err := os.Remove(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.log.Error(fmt.Sprintf("error removing file %s: %v", file, err))
+		return false
+	}
+	return true
+}
+
+// initRefs builds the reference counts of an existing cache, this is done only once
+func (s *badgerStore) initRefs() error {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(refsBuiltKey)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	s.log.Info("building reference counts of the cache content")
+	refs := make(map[string]int)
+	err = s.Walk("", func(tile model.Tile, e dbEntry) error {
+		if e.Hash != "" {
+			refs[e.Hash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for hash, count := range refs {
+		if err := wb.Set(refKey(hash), binary.LittleEndian.AppendUint32(nil, uint32(count))); err != nil {
+			return err
+		}
+	}
+	if err := wb.Set(refsBuiltKey, []byte{1}); err != nil {
+		return err
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	s.log.Info(fmt.Sprintf("reference counts of %d content files built", len(refs)))
+	return nil
+}
+
+// GC removes tile entries whose content file is missing and content files without reference
+func (s *badgerStore) GC() (GCResult, error) {
+	var res GCResult
+	dangling := make([]model.Tile, 0)
+	err := s.Walk("", func(tile model.Tile, e dbEntry) error {
+		if e.Uniform != nil {
+			return nil
+		}
+		_, file := s.getFilename(e.Hash)
+		if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+			dangling = append(dangling, tile)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	for _, tile := range dangling {
+		s.log.Debug(fmt.Sprintf("removing dangling cache entry: %s", tile.String()))
+		if _, err := s.deleteEntry(tile); err != nil {
+			return res, err
+		}
+		res.DanglingKeys++
+	}
+	res.OrphanBlobs, err = s.removeOrphans(orphanGrace)
+	if err != nil {
+		return res, err
+	}
+	s.log.Info(fmt.Sprintf("cache gc completed, dangling keys: %d, orphan files: %d", res.DanglingKeys, res.OrphanBlobs))
+	return res, nil
+}
+
+// removeOrphans deletes all content files without reference, which are older than the given duration
+func (s *badgerStore) removeOrphans(olderThan time.Duration) (int, error) {
+	root := s.getTilesPath()
+	now := time.Now()
+	removed := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || now.Sub(info.ModTime()) <= olderThan {
+			return nil
+		}
+		hash := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		if s.RefCount(hash) > 0 {
+			return nil
+		}
+		s.log.Debug(fmt.Sprintf("removing orphan cache file: %s", path))
+		if s.removeBlob(hash) {
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
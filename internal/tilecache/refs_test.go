@@ -0,0 +1,73 @@
+package tilecache
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestRefCounting(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	t1 := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 1}
+	t2 := model.Tile{Provider: "osm", Z: 3, X: 2, Y: 1}
+	ocean := fmt.Sprintf("%0200d", 0)
+
+	ast.NoError(c.Save(t1, strings.NewReader(ocean)))
+	ast.NoError(c.Save(t2, strings.NewReader(ocean)))
+	e, err := c.DBGet(t1)
+	ast.NoError(err)
+	hash := e.Hash
+	ast.Equal(2, badgerOf(c).RefCount(hash))
+	_, file := badgerOf(c).getFilename(hash)
+
+	// saving the same content again doesn't change the count
+	ast.NoError(c.Save(t1, strings.NewReader(ocean)))
+	ast.Equal(2, badgerOf(c).RefCount(hash))
+
+	removed, err := c.DBDelete(t1)
+	ast.NoError(err)
+	ast.False(removed)
+	ast.FileExists(file)
+
+	// new content for t2, the old content is no longer referenced
+	ast.NoError(c.Save(t2, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+	ast.Equal(0, badgerOf(c).RefCount(hash))
+	ast.NoFileExists(file)
+}
+
+func TestGC(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	t1 := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 1}
+	t2 := model.Tile{Provider: "osm", Z: 3, X: 2, Y: 1}
+	ast.NoError(c.Save(t1, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+	ast.NoError(c.Save(t2, strings.NewReader(fmt.Sprintf("%0200d", 2))))
+
+	// content file of t1 is lost
+	e, err := c.DBGet(t1)
+	ast.NoError(err)
+	_, file := badgerOf(c).getFilename(e.Hash)
+	ast.NoError(os.Remove(file))
+
+	// orphan content file
+	hash := strings.Repeat("ab", 32)
+	dir, orphan := badgerOf(c).getFilename(hash)
+	ast.NoError(os.MkdirAll(dir, 0o755))
+	ast.NoError(os.WriteFile(orphan, []byte("orphan"), 0o644))
+	old := time.Now().Add(-2 * orphanGrace)
+	ast.NoError(os.Chtimes(orphan, old, old))
+
+	res, err := c.GC()
+	ast.NoError(err)
+	ast.Equal(1, res.DanglingKeys)
+	ast.Equal(1, res.OrphanBlobs)
+	ast.False(c.DBHas(t1))
+	ast.True(c.DBHas(t2))
+	ast.NoFileExists(orphan)
+}
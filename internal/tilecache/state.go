@@ -0,0 +1,40 @@
+package tilecache
+
+// SaveState stores the state of another service, like the checkpoint of a prefetch job, together
+// with the tiles. ErrNotSupported if the backend can't store states.
+func (c *Cache) SaveState(key string, data []byte) error {
+	ss, err := c.stateStore()
+	if err != nil {
+		return err
+	}
+	return ss.SaveState(key, data)
+}
+
+// States all stored states with keys starting with the prefix
+func (c *Cache) States(prefix string) (map[string][]byte, error) {
+	ss, err := c.stateStore()
+	if err != nil {
+		return nil, err
+	}
+	return ss.States(prefix)
+}
+
+// DeleteState removes the state of the key
+func (c *Cache) DeleteState(key string) error {
+	ss, err := c.stateStore()
+	if err != nil {
+		return err
+	}
+	return ss.DeleteState(key)
+}
+
+func (c *Cache) stateStore() (stateStorage, error) {
+	if !c.active {
+		return nil, ErrNotSupported
+	}
+	ss, ok := c.store.(stateStorage)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return ss, nil
+}
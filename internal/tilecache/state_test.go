@@ -0,0 +1,41 @@
+package tilecache
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestStates(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	ast.NoError(c.Save(model.Tile{Provider: "osm", Z: 1, X: 1, Y: 1}, bytes.NewReader(testPNG(t, color.White))))
+
+	ast.NoError(c.SaveState("prefetch/a", []byte("1")))
+	ast.NoError(c.SaveState("prefetch/b", []byte("2")))
+	ast.NoError(c.SaveState("other", []byte("3")))
+	states, err := c.States("prefetch/")
+	ast.NoError(err)
+	ast.Equal(map[string][]byte{"prefetch/a": []byte("1"), "prefetch/b": []byte("2")}, states)
+
+	// states are not tiles
+	n := 0
+	ast.NoError(c.Walk("", func(tile model.Tile, e dbEntry) error {
+		n++
+		return nil
+	}))
+	ast.Equal(1, n)
+
+	ast.NoError(c.DeleteState("prefetch/a"))
+	states, err = c.States("prefetch/")
+	ast.NoError(err)
+	ast.Len(states, 1)
+
+	xyz, err := openXYZStore(t.TempDir())
+	ast.NoError(err)
+	_, err = newTestCacheWith(xyz).States("")
+	ast.ErrorIs(err, ErrNotSupported)
+}
@@ -0,0 +1,94 @@
+package tilecache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+const (
+	// BackendBadger the tile entries are stored in a badger db, the content in a file tree addressed by its hash (default)
+	BackendBadger = "badger"
+	// BackendMBTiles every provider is stored in its own MBTiles (sqlite) file
+	BackendMBTiles = "mbtiles"
+	// BackendXYZ the tiles are stored as plain files in a z/x/y directory layout
+	BackendXYZ = "xyz"
+	// BackendS3 the tiles are stored in a S3 compatible object store
+	BackendS3 = "s3"
+)
+
+var (
+	// ErrNotCached the tile is not stored in the cache
+	ErrNotCached = errors.New("tile not cached")
+	// ErrNotSupported the operation is not supported by the storage backend
+	ErrNotSupported = errors.New("not supported by the cache backend")
+)
+
+// Storage the backend of the cache, it stores the content of the tiles together with their entries.
+// Freshness, eviction, the memory tier and the asynchronous writer are handled by the cache itself.
+type Storage interface {
+	// Entry returns the entry of the tile, ErrNotCached if the tile is not stored
+	Entry(tile model.Tile) (*dbEntry, error)
+	// Open opens the content of the stored tile
+	Open(tile model.Tile, e *dbEntry) (io.ReadCloser, error)
+	// Has true if the tile and its content are stored
+	Has(tile model.Tile) bool
+	// Save stores the content and the entry of the tile, hash and size of the entry are set by the storage
+	Save(tile model.Tile, data io.Reader, e dbEntry) error
+	// SetEntry updates the entry of a stored tile
+	SetEntry(tile model.Tile, e dbEntry) error
+	// Delete removes the tile, returns true if the space of the content is freed
+	Delete(tile model.Tile) (bool, error)
+	// Walk calls fn for every stored tile of the provider, an empty provider walks over all tiles
+	Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error
+	Close() error
+}
+
+// gcStorage a storage, which has to collect its garbage
+type gcStorage interface {
+	GC() (GCResult, error)
+}
+
+// valueLogStorage a storage with a value log, which has to be compacted
+type valueLogStorage interface {
+	ValueLogGC() error
+}
+
+// uniformStorage a storage, which can store uniform tiles as entry without content
+type uniformStorage interface {
+	SaveUniform(tile model.Tile, e dbEntry) error
+}
+
+// stateStorage a storage, which can store the states of other services beside the tiles
+type stateStorage interface {
+	SaveState(key string, data []byte) error
+	States(prefix string) (map[string][]byte, error)
+	DeleteState(key string) error
+}
+
+// entryUpdater a storage, which can change the metadata of an entry atomically
+type entryUpdater interface {
+	UpdateEntry(tile model.Tile, fn func(e *dbEntry)) error
+}
+
+// verifyStorage a storage, which can verify and repair its content
+type verifyStorage interface {
+	Verify(repair bool) (VerifyReport, error)
+}
+
+// openStorage opens the storage backend selected in the config
+func openStorage(cfg Config) (Storage, error) {
+	switch cfg.Backend {
+	case "", BackendBadger:
+		return openBadgerStore(cfg.Path)
+	case BackendMBTiles:
+		return openMBTilesStore(cfg.Path)
+	case BackendXYZ:
+		return openXYZStore(cfg.Path)
+	case BackendS3:
+		return openS3Store(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", cfg.Backend)
+}
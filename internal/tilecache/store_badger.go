@@ -0,0 +1,377 @@
+package tilecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// badgerStore stores the tile entries in a badger db and the content in a file tree addressed by the
+// hash of the content, so equal tiles share their content file.
+type badgerStore struct {
+	log   *slog.Logger
+	path  string
+	flock sync.RWMutex
+	db    *badger.DB
+}
+
+func openBadgerStore(path string) (*badgerStore, error) {
+	s := &badgerStore{
+		log:   logging.New("tilecache"),
+		path:  path,
+		flock: sync.RWMutex{},
+	}
+	db, err := badger.Open(badger.DefaultOptions(s.getDBPath()).WithValueLogFileSize(100 * 1024 * 1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open badger db: %v", err)
+	}
+	s.db = db
+	if err := s.migrateKeys(); err != nil {
+		s.log.Error(fmt.Sprintf("failed to migrate cache keys: %v", err))
+	}
+	if err := s.initRefs(); err != nil {
+		s.log.Error(fmt.Sprintf("failed to build reference counts: %v", err))
+	}
+	s.startValueLogGCTicker()
+	return s, nil
+}
+
+func (s *badgerStore) startValueLogGCTicker() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			<-ticker.C
+			err := s.ValueLogGC()
+			if err != nil {
+				s.log.Error(fmt.Sprintf("value log GC error: %v", err))
+			} else {
+				s.log.Info(fmt.Sprintf("value log GC completed"))
+			}
+		}
+	}()
+}
+
+// ValueLogGC compacts the value log of the badger db, it's ok if there is nothing to compact
+func (s *badgerStore) ValueLogGC() error {
+	err := s.db.RunValueLogGC(0.5)
+	if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrGCInMemoryMode) {
+		return nil
+	}
+	return err
+}
+
+func (s *badgerStore) Entry(tile model.Tile) (*dbEntry, error) {
+	var valCopy []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(s.DBKey(tile))
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		valCopy = val
+		return nil
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry dbEntry
+	err = entry.Unmarshal(valCopy)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *badgerStore) Open(tile model.Tile, e *dbEntry) (io.ReadCloser, error) {
+	_, file := s.getFilename(e.Hash)
+	s.flock.RLock()
+	defer s.flock.RUnlock()
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, fmt.Errorf("cache file %s not found", file)
+	}
+	if fi.Size() < 100 {
+		return nil, fmt.Errorf("cache file %s is too small", file)
+	}
+	return os.Open(file)
+}
+
+func (s *badgerStore) Has(tile model.Tile) bool {
+	e, err := s.Entry(tile)
+	if err != nil {
+		return false
+	}
+	if e.Uniform != nil {
+		return true
+	}
+	_, file := s.getFilename(e.Hash)
+	if _, err := os.Stat(file); err != nil {
+		return false
+	}
+	return true
+}
+
+func (s *badgerStore) Save(tile model.Tile, data io.Reader, e dbEntry) error {
+	// Create temporary file to calculate hash
+	tmpFile, err := os.CreateTemp("", "tile_cache_*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	// Copy data to temp file and calculate hash
+	h := sha256.New()
+	multiWriter := io.MultiWriter(tmpFile, h)
+	size, err := io.Copy(multiWriter, data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	// Generate hash-based path
+	e.Hash = hex.EncodeToString(h.Sum(nil))
+	e.Size = size
+	hashDir, hashFile := s.getFilename(e.Hash)
+
+	// file and reference are changed together, so an unreferenced file can't be removed in between
+	s.flock.Lock()
+	// Check if hash-based file already exists
+	if _, err := os.Stat(hashFile); errors.Is(err, os.ErrNotExist) {
+		// Create hash-based directory structure
+		if err := os.MkdirAll(hashDir, 0o755); err != nil {
+			s.flock.Unlock()
+			return err
+		}
+
+		// Move temp file to final hash-based location
+		err = oscrossRename(tmpPath, hashFile)
+		if err != nil {
+			s.flock.Unlock()
+			return err
+		}
+	} else {
+		// File already exists, no need to save again, but it's fresh now
+		s.touchFile(hashFile)
+	}
+	unref, err := s.setEntry(tile, e)
+	s.flock.Unlock()
+	if err != nil {
+		return err
+	}
+	if unref != "" {
+		s.removeBlob(unref)
+	}
+	return nil
+}
+
+// SaveUniform stores the entry of a uniform tile, there is no content file
+func (s *badgerStore) SaveUniform(tile model.Tile, e dbEntry) error {
+	e.Hash = ""
+	e.Size = 0
+	return s.SetEntry(tile, e)
+}
+
+func (s *badgerStore) SetEntry(tile model.Tile, e dbEntry) error {
+	unref, err := s.setEntry(tile, e)
+	if err != nil {
+		return err
+	}
+	if unref != "" {
+		s.removeBlob(unref)
+	}
+	return nil
+}
+
+// UpdateEntry changes the metadata of the entry of a stored tile in one transaction, so a concurrent
+// save isn't overwritten. The content hash and the size are kept, fn can't change them.
+func (s *badgerStore) UpdateEntry(tile model.Tile, fn func(e *dbEntry)) error {
+	key := s.DBKey(tile)
+	return s.update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return ErrNotCached
+		}
+		if err != nil {
+			return err
+		}
+		var e dbEntry
+		if err := item.Value(func(val []byte) error {
+			return e.Unmarshal(val)
+		}); err != nil {
+			return err
+		}
+		hash, size, uniform := e.Hash, e.Size, e.Uniform
+		fn(&e)
+		e.Hash, e.Size, e.Uniform = hash, size, uniform
+		val, err := e.Marshal()
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, val)
+	})
+}
+
+func (s *badgerStore) Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error {
+	prefix := []byte{tilePrefix}
+	if providerName != "" {
+		prefix = providerPrefix(providerName)
+	}
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			tile, err := parseKey(item.Key())
+			if err != nil {
+				s.log.Error(fmt.Sprintf("invalid cache key %x: %v", item.Key(), err))
+				continue
+			}
+			var e dbEntry
+			err = item.Value(func(val []byte) error {
+				return e.Unmarshal(val)
+			})
+			if err != nil {
+				s.log.Error(fmt.Sprintf("invalid cache entry of %s: %v", tile.String(), err))
+				continue
+			}
+			if e.Size == 0 && e.Uniform == nil {
+				// entries of older versions have no size
+				e.Size = s.fileSize(e.Hash)
+			}
+			if err := fn(tile, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveState stores the state under the key
+func (s *badgerStore) SaveState(key string, data []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append([]byte{statePrefix}, key...), data)
+	})
+}
+
+// States all states with keys starting with the prefix
+func (s *badgerStore) States(prefix string) (map[string][]byte, error) {
+	states := make(map[string][]byte)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = append([]byte{statePrefix}, prefix...)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			states[string(item.Key()[1:])] = val
+		}
+		return nil
+	})
+	return states, err
+}
+
+// DeleteState removes the state of the key
+func (s *badgerStore) DeleteState(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append([]byte{statePrefix}, key...))
+	})
+}
+
+func (s *badgerStore) Close() error {
+	return s.db.Close()
+}
+
+func oscrossRename(tmpPath string, hashFile string) error {
+	err := os.Rename(tmpPath, hashFile)
+	if err != nil {
+		// Fallback: copy if rename fails (cross-device link)
+		src, err := os.Open(tmpPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		dst, err := os.Create(hashFile)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touchFile sets the modification time of the file to now, so the orphan removal will not take it
+func (s *badgerStore) touchFile(path string) {
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if err != nil {
+		s.log.Error(fmt.Sprintf("error touching file %s: %v", path, err))
+	}
+}
+
+func (s *badgerStore) getFileHash(fileStr string) string {
+	f, err := os.Open(fileStr)
+	if err != nil {
+		s.log.Error(fmt.Sprintf("error opening file: %v", err))
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		s.log.Error(fmt.Sprintf("error building hash: %v", err))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *badgerStore) fileSize(hash string) int64 {
+	_, file := s.getFilename(hash)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (s *badgerStore) getTilesPath() string {
+	return filepath.Join(s.path, "tiles")
+}
+
+func (s *badgerStore) getDBPath() string {
+	return filepath.Join(s.path, "badger")
+}
+
+func (s *badgerStore) getFilename(hash string) (string, string) {
+	hashDir := filepath.Join(s.getTilesPath(), hash[:3], hash[3:6])
+	hashFile := filepath.Join(hashDir, hash+".png")
+	return hashDir, hashFile
+}
@@ -0,0 +1,291 @@
+package tilecache
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+	_ "modernc.org/sqlite" // register the sqlite driver
+)
+
+// Every provider (and variant) is stored in its own MBTiles file provider.mbtiles (provider@variant.mbtiles).
+// The tiles table follows the MBTiles spec, so the rows are in TMS order (y flipped). The entries of the tiles
+// are stored in the additional table tile_entries, MBTiles readers simply ignore this table.
+const (
+	mbtilesExt = ".mbtiles"
+
+	// mbtilesSchema the tables of the MBTiles spec
+	mbtilesSchema = `
+CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT);
+CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB,
+	PRIMARY KEY (zoom_level, tile_column, tile_row));`
+	entriesSchema = `
+CREATE TABLE IF NOT EXISTS tile_entries (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, entry BLOB,
+	PRIMARY KEY (zoom_level, tile_column, tile_row));`
+)
+
+// mbtilesStore stores the tiles of every provider in a single MBTiles (sqlite) file
+type mbtilesStore struct {
+	log   *slog.Logger
+	path  string
+	dlock sync.Mutex
+	dbs   map[string]*mbtilesFile
+}
+
+// mbtilesFile an opened MBTiles file
+type mbtilesFile struct {
+	db      *sql.DB
+	modTime time.Time // modification time of the file on opening, the timestamp of tiles without entry
+}
+
+func openMBTilesStore(path string) (*mbtilesStore, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	return &mbtilesStore{
+		log:  logging.New("tilecache"),
+		path: path,
+		dbs:  make(map[string]*mbtilesFile),
+	}, nil
+}
+
+// mbtilesName the name of the MBTiles file of the tile without extension
+func mbtilesName(tile model.Tile) string {
+	if tile.Variant != "" {
+		return tile.Provider + "@" + tile.Variant
+	}
+	return tile.Provider
+}
+
+// tmsRow the MBTiles row of the tile, which is counted from the bottom
+func tmsRow(z, y int) int {
+	return (1 << z) - 1 - y
+}
+
+// database returns the MBTiles file, with create false a missing file is not created
+func (s *mbtilesStore) database(name string, create bool) (*mbtilesFile, error) {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	if mf, ok := s.dbs[name]; ok {
+		return mf, nil
+	}
+	file := filepath.Join(s.path, name+mbtilesExt)
+	mf := &mbtilesFile{modTime: time.Now()}
+	fi, err := os.Stat(file)
+	if err == nil {
+		mf.modTime = fi.ModTime()
+	} else if !create {
+		return nil, ErrNotCached
+	}
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(file)+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	mf.db = db
+	if _, err := db.Exec(mbtilesSchema + entriesSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create MBTiles schema in %s: %v", file, err)
+	}
+	provider, format, _ := strings.Cut(name, "@")
+	if format == "" {
+		format = defaultExt
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO metadata (name, value) VALUES ('name', ?), ('format', ?), ('type', 'baselayer')", provider, format)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.dbs[name] = mf
+	return mf, nil
+}
+
+func (s *mbtilesStore) Entry(tile model.Tile) (*dbEntry, error) {
+	mf, err := s.database(mbtilesName(tile), false)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	var val []byte
+	err = mf.db.QueryRow(`SELECT length(t.tile_data), e.entry FROM tiles t LEFT JOIN tile_entries e
+		ON e.zoom_level = t.zoom_level AND e.tile_column = t.tile_column AND e.tile_row = t.tile_row
+		WHERE t.zoom_level = ? AND t.tile_column = ? AND t.tile_row = ?`, tile.Z, tile.X, tmsRow(tile.Z, tile.Y)).Scan(&size, &val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.entry(mf, size, val), nil
+}
+
+// entry builds the entry of a tile, tiles without entry (not written by the cache) are fresh since
+// the last modification of the file
+func (s *mbtilesStore) entry(mf *mbtilesFile, size int64, val []byte) *dbEntry {
+	e := dbEntry{Timestamp: mf.modTime}
+	if len(val) > 0 {
+		if err := e.Unmarshal(val); err != nil {
+			s.log.Error(fmt.Sprintf("invalid tile entry: %v", err))
+			e = dbEntry{Timestamp: mf.modTime}
+		}
+	}
+	e.Size = size
+	return &e
+}
+
+func (s *mbtilesStore) Open(tile model.Tile, e *dbEntry) (io.ReadCloser, error) {
+	mf, err := s.database(mbtilesName(tile), false)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = mf.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		tile.Z, tile.X, tmsRow(tile.Z, tile.Y)).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *mbtilesStore) Has(tile model.Tile) bool {
+	_, err := s.Entry(tile)
+	return err == nil
+}
+
+func (s *mbtilesStore) Save(tile model.Tile, data io.Reader, e dbEntry) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	e.Hash = ""
+	e.Size = int64(len(content))
+	val, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	mf, err := s.database(mbtilesName(tile), true)
+	if err != nil {
+		return err
+	}
+	tx, err := mf.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	row := tmsRow(tile.Z, tile.Y)
+	_, err = tx.Exec("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)", tile.Z, tile.X, row, content)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO tile_entries (zoom_level, tile_column, tile_row, entry) VALUES (?, ?, ?, ?)", tile.Z, tile.X, row, val)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mbtilesStore) SetEntry(tile model.Tile, e dbEntry) error {
+	if !s.Has(tile) {
+		return ErrNotCached
+	}
+	mf, err := s.database(mbtilesName(tile), false)
+	if err != nil {
+		return err
+	}
+	val, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = mf.db.Exec("INSERT OR REPLACE INTO tile_entries (zoom_level, tile_column, tile_row, entry) VALUES (?, ?, ?, ?)",
+		tile.Z, tile.X, tmsRow(tile.Z, tile.Y), val)
+	return err
+}
+
+func (s *mbtilesStore) Delete(tile model.Tile) (bool, error) {
+	mf, err := s.database(mbtilesName(tile), false)
+	if errors.Is(err, ErrNotCached) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	row := tmsRow(tile.Z, tile.Y)
+	if _, err := mf.db.Exec("DELETE FROM tile_entries WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", tile.Z, tile.X, row); err != nil {
+		return false, err
+	}
+	res, err := mf.db.Exec("DELETE FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", tile.Z, tile.X, row)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *mbtilesStore) Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error {
+	files, err := filepath.Glob(filepath.Join(s.path, "*"+mbtilesExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), mbtilesExt)
+		provider, variant, _ := strings.Cut(name, "@")
+		if providerName != "" && provider != providerName {
+			continue
+		}
+		if err := s.walkFile(model.Tile{Provider: provider, Variant: variant}, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkFile walks over all tiles of one MBTiles file, base holds provider and variant of the file
+func (s *mbtilesStore) walkFile(base model.Tile, fn func(tile model.Tile, e dbEntry) error) error {
+	mf, err := s.database(mbtilesName(base), false)
+	if err != nil {
+		return err
+	}
+	rows, err := mf.db.Query(`SELECT t.zoom_level, t.tile_column, t.tile_row, length(t.tile_data), e.entry FROM tiles t LEFT JOIN tile_entries e
+		ON e.zoom_level = t.zoom_level AND e.tile_column = t.tile_column AND e.tile_row = t.tile_row`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tile := base
+		var row int
+		var size int64
+		var val []byte
+		if err := rows.Scan(&tile.Z, &tile.X, &row, &size, &val); err != nil {
+			return err
+		}
+		tile.Y = tmsRow(tile.Z, row)
+		if err := fn(tile, *s.entry(mf, size, val)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *mbtilesStore) Close() error {
+	s.dlock.Lock()
+	defer s.dlock.Unlock()
+	var errs []error
+	for name, mf := range s.dbs {
+		errs = append(errs, mf.db.Close())
+		delete(s.dbs, name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,326 @@
+package tilecache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// S3Config the object store of the s3 backend, the objects are addressed path style (endpoint/bucket/key)
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`  // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region    string `yaml:"region"`    // default us-east-1
+	Bucket    string `yaml:"bucket"`    // the bucket has to exist
+	Prefix    string `yaml:"prefix"`    // optional prefix of all keys
+	AccessKey string `yaml:"accesskey"` // without access key the requests are not signed
+	SecretKey string `yaml:"secretkey"`
+}
+
+const (
+	s3EntryHeader   = "X-Amz-Meta-Tile-Entry"
+	s3DefaultRegion = "us-east-1"
+)
+
+// s3Store stores the tiles as objects in a S3 compatible object store, the layout is the same as of the
+// xyz backend. The entry of a tile is stored as object metadata, so walking over the tiles needs a
+// request for every tile.
+type s3Store struct {
+	log *slog.Logger
+	cfg S3Config
+	cl  *http.Client
+}
+
+func openS3Store(cfg S3Config) (*s3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 backend needs endpoint and bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &s3Store{
+		log: logging.New("tilecache"),
+		cfg: cfg,
+		cl:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *s3Store) key(tile model.Tile) string {
+	return path.Join(s.cfg.Prefix, xyzPath(tile))
+}
+
+// request does a signed request to the object store, key is empty for bucket requests
+func (s *s3Store) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.cfg.Endpoint + "/" + s.cfg.Bucket
+	if key != "" {
+		u += "/" + key
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	return s.cl.Do(req)
+}
+
+// sign signs the request with AWS signature version 4, the payload is not signed
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	if s.cfg.AccessKey == "" {
+		return
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	names := []string{"host"}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+		}
+	}
+	slices.Sort(names)
+	var ch strings.Builder
+	for _, n := range names {
+		v := req.URL.Host
+		if n != "host" {
+			v = strings.TrimSpace(req.Header.Get(n))
+		}
+		ch.WriteString(n + ":" + v + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, ch.String(), signed, "UNSIGNED-PAYLOAD"}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + s.cfg.SecretKey)
+	for _, p := range []string{date, s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, p)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.cfg.AccessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Error builds the error of a failed request and closes the response
+func s3Error(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotCached
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 error: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// entry builds the entry of a tile from the object headers, objects without entry are fresh since their last modification
+func (s *s3Store) entry(resp *http.Response) *dbEntry {
+	var e dbEntry
+	if val, err := base64.StdEncoding.DecodeString(resp.Header.Get(s3EntryHeader)); err == nil && len(val) > 0 {
+		if err := e.Unmarshal(val); err != nil {
+			s.log.Error(fmt.Sprintf("invalid tile entry: %v", err))
+			e = dbEntry{}
+		}
+	}
+	if e.Timestamp.IsZero() {
+		if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			e.Timestamp = lm
+		}
+	}
+	e.Size = max(resp.ContentLength, 0)
+	return &e
+}
+
+func (s *s3Store) entryHeader(e dbEntry) (http.Header, error) {
+	val, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	h := http.Header{}
+	h.Set(s3EntryHeader, base64.StdEncoding.EncodeToString(val))
+	return h, nil
+}
+
+func (s *s3Store) Entry(tile model.Tile) (*dbEntry, error) {
+	return s.head(s.key(tile))
+}
+
+func (s *s3Store) head(key string) (*dbEntry, error) {
+	resp, err := s.request(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	resp.Body.Close()
+	return s.entry(resp), nil
+}
+
+func (s *s3Store) Open(tile model.Tile, e *dbEntry) (io.ReadCloser, error) {
+	resp, err := s.request(http.MethodGet, s.key(tile), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Has(tile model.Tile) bool {
+	_, err := s.Entry(tile)
+	return err == nil
+}
+
+func (s *s3Store) Save(tile model.Tile, data io.Reader, e dbEntry) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	e.Hash = ""
+	e.Size = int64(len(content))
+	h, err := s.entryHeader(e)
+	if err != nil {
+		return err
+	}
+	h.Set("Content-Type", http.DetectContentType(content))
+	resp, err := s.request(http.MethodPut, s.key(tile), nil, h, content)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// SetEntry replaces the metadata of the object by copying the object onto itself
+func (s *s3Store) SetEntry(tile model.Tile, e dbEntry) error {
+	h, err := s.entryHeader(e)
+	if err != nil {
+		return err
+	}
+	key := s.key(tile)
+	h.Set("X-Amz-Copy-Source", "/"+s.cfg.Bucket+"/"+key)
+	h.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err := s.request(http.MethodPut, key, nil, h, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Delete(tile model.Tile) (bool, error) {
+	if !s.Has(tile) {
+		return false, nil
+	}
+	resp, err := s.request(http.MethodDelete, s.key(tile), nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return false, s3Error(resp)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// s3ListResult the result of a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3Store) Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error {
+	prefix := ""
+	if s.cfg.Prefix != "" {
+		prefix = s.cfg.Prefix + "/"
+	}
+	listPrefix := prefix
+	if providerName != "" {
+		listPrefix += providerName + "/"
+	}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", listPrefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3Error(resp)
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range res.Contents {
+			tile, err := parseXYZPath(strings.TrimPrefix(obj.Key, prefix))
+			if err != nil {
+				s.log.Debug(fmt.Sprintf("skipping object %s: %v", obj.Key, err))
+				continue
+			}
+			e, err := s.head(obj.Key)
+			if errors.Is(err, ErrNotCached) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(tile, *e); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3Store) Close() error {
+	return nil
+}
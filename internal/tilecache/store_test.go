@@ -0,0 +1,252 @@
+package tilecache
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// fakeS3 a minimal in memory stand-in of a S3 compatible object store
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	meta     http.Header
+	modified time.Time
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	f := &fakeS3{objects: make(map[string]fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "tiles" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if key == "" {
+		f.list(w, r)
+		return
+	}
+	obj, ok := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		meta := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				meta[k] = v
+			}
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			obj, ok = f.objects[strings.TrimPrefix(src, "/tiles/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		} else {
+			obj.data, _ = io.ReadAll(r.Body)
+		}
+		obj.meta = meta
+		obj.modified = time.Now()
+		f.objects[key] = obj
+	case http.MethodGet, http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list lists the objects, two keys per page to test the continuation
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	keys := make([]string, 0)
+	for k := range f.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := min(start+2, len(keys))
+	type content struct {
+		Key string `xml:"Key"`
+	}
+	res := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	for _, k := range keys[start:end] {
+		res.Contents = append(res.Contents, content{Key: k})
+	}
+	if end < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func testStores(t *testing.T) map[string]Storage {
+	xyz, err := openXYZStore(filepath.Join(t.TempDir(), "xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbt, err := openMBTilesStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mbt.Close() })
+	s3, err := openS3Store(S3Config{Endpoint: newFakeS3(t).URL, Bucket: "tiles", Prefix: "cache", AccessKey: "minio", SecretKey: "minio123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Storage{
+		BackendBadger:  badgerOf(newTestCache(t)),
+		BackendXYZ:     xyz,
+		BackendMBTiles: mbt,
+		BackendS3:      s3,
+	}
+}
+
+func TestStorages(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ast := assert.New(t)
+			c := newTestCacheWith(store)
+			c.maxage = 24
+			tile := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}
+			jpg := model.Tile{Provider: "osm", Variant: "jpg", Z: 3, X: 1, Y: 2}
+			other := model.Tile{Provider: "gebco", Z: 4, X: 5, Y: 6}
+			content := []byte(fmt.Sprintf("%0200d", 1))
+
+			ast.False(c.Has(tile))
+			_, err := c.DBGet(tile)
+			ast.ErrorIs(err, ErrNotCached)
+
+			ast.NoError(c.SaveWithInfo(tile, strings.NewReader(string(content)), model.CacheInfo{ETag: `"v1"`}))
+			ast.NoError(c.Save(jpg, strings.NewReader(fmt.Sprintf("%0300d", 2))))
+			ast.NoError(c.Save(other, strings.NewReader(fmt.Sprintf("%0200d", 3))))
+			ast.True(c.Has(tile))
+
+			rd, ok := c.Tile(tile)
+			ast.True(ok)
+			data, err := io.ReadAll(rd)
+			rd.Close()
+			ast.NoError(err)
+			ast.Equal(content, data)
+
+			info, ok := c.CacheInfo(tile)
+			ast.True(ok)
+			ast.Equal(`"v1"`, info.ETag)
+
+			e, err := c.DBGet(tile)
+			ast.NoError(err)
+			ast.Equal(int64(200), e.Size)
+			e.Hits = 7
+			ast.NoError(c.DBSet(tile, *e))
+			e, err = c.DBGet(tile)
+			ast.NoError(err)
+			ast.Equal(uint32(7), e.Hits)
+			ast.Equal(`"v1"`, e.ETag)
+
+			tiles := make([]model.Tile, 0)
+			ast.NoError(c.Walk("osm", func(tile model.Tile, e dbEntry) error {
+				tiles = append(tiles, tile)
+				return nil
+			}))
+			ast.ElementsMatch([]model.Tile{tile, jpg}, tiles)
+			count := 0
+			ast.NoError(c.Walk("", func(tile model.Tile, e dbEntry) error {
+				count++
+				return nil
+			}))
+			ast.Equal(3, count)
+
+			removed, err := c.DBDelete(tile)
+			ast.NoError(err)
+			ast.True(removed)
+			ast.False(c.Has(tile))
+			ast.True(c.Has(jpg))
+			_, ok = c.Tile(tile)
+			ast.False(ok)
+		})
+	}
+}
+
+func TestXYZLayout(t *testing.T) {
+	ast := assert.New(t)
+	root := t.TempDir()
+	s, err := openXYZStore(root)
+	ast.NoError(err)
+	c := newTestCacheWith(s)
+	tile := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}
+	ast.NoError(c.Save(tile, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+	ast.FileExists(filepath.Join(root, "osm", "3", "1", "2.png"))
+
+	// plain tiles without meta file are taken as well
+	plain := filepath.Join(root, "osm", "4", "1", "2.png")
+	ast.NoError(os.MkdirAll(filepath.Dir(plain), 0o755))
+	ast.NoError(os.WriteFile(plain, []byte(fmt.Sprintf("%0200d", 2)), 0o644))
+	e, err := c.DBGet(model.Tile{Provider: "osm", Z: 4, X: 1, Y: 2})
+	ast.NoError(err)
+	ast.Equal(int64(200), e.Size)
+	ast.False(e.Timestamp.IsZero())
+}
+
+func TestMBTilesLayout(t *testing.T) {
+	ast := assert.New(t)
+	s, err := openMBTilesStore(t.TempDir())
+	ast.NoError(err)
+	defer s.Close()
+	c := newTestCacheWith(s)
+	tile := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}
+	ast.NoError(c.Save(tile, strings.NewReader(fmt.Sprintf("%0200d", 1))))
+
+	mf, err := s.database("osm", false)
+	ast.NoError(err)
+	var row int
+	// rows of MBTiles are counted from the bottom
+	ast.NoError(mf.db.QueryRow("SELECT tile_row FROM tiles WHERE zoom_level = 3 AND tile_column = 1").Scan(&row))
+	ast.Equal(5, row)
+	var format string
+	ast.NoError(mf.db.QueryRow("SELECT value FROM metadata WHERE name = 'format'").Scan(&format))
+	ast.Equal("png", format)
+}
@@ -0,0 +1,208 @@
+package tilecache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// Layout of the xyz and the s3 backend:
+//
+//	provider/z/x/y.png
+//
+// the variant of a tile is used as extension instead of png. The entry of the tile is stored
+// beside the content in a file with the additional extension .meta (xyz) or as object metadata (s3).
+const (
+	defaultExt = "png"
+	metaExt    = ".meta"
+)
+
+// xyzPath the slash separated path of the tile
+func xyzPath(tile model.Tile) string {
+	ext := defaultExt
+	if tile.Variant != "" {
+		ext = tile.Variant
+	}
+	return fmt.Sprintf("%s/%d/%d/%d.%s", tile.Provider, tile.Z, tile.X, tile.Y, ext)
+}
+
+// parseXYZPath is the reverse of xyzPath
+func parseXYZPath(p string) (model.Tile, error) {
+	var tile model.Tile
+	parts := strings.Split(p, "/")
+	if len(parts) != 4 {
+		return tile, fmt.Errorf("not a tile path: %s", p)
+	}
+	ys, ext, ok := strings.Cut(parts[3], ".")
+	if !ok {
+		return tile, fmt.Errorf("tile path without extension: %s", p)
+	}
+	var err error
+	tile.Provider = parts[0]
+	if ext != defaultExt {
+		tile.Variant = ext
+	}
+	if tile.Z, err = strconv.Atoi(parts[1]); err != nil {
+		return tile, err
+	}
+	if tile.X, err = strconv.Atoi(parts[2]); err != nil {
+		return tile, err
+	}
+	tile.Y, err = strconv.Atoi(ys)
+	return tile, err
+}
+
+// xyzStore stores the tiles as plain files in a z/x/y directory layout, so the cache can be served
+// by any static web server. Equal tiles are stored for every tile.
+type xyzStore struct {
+	log  *slog.Logger
+	path string
+}
+
+func openXYZStore(path string) (*xyzStore, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	return &xyzStore{
+		log:  logging.New("tilecache"),
+		path: path,
+	}, nil
+}
+
+func (s *xyzStore) filename(tile model.Tile) string {
+	return filepath.Join(s.path, filepath.FromSlash(xyzPath(tile)))
+}
+
+func (s *xyzStore) Entry(tile model.Tile) (*dbEntry, error) {
+	file := s.filename(tile)
+	fi, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.entry(file, fi), nil
+}
+
+// entry reads the entry of the tile file, plain files without meta file are fresh since their last modification
+func (s *xyzStore) entry(file string, fi fs.FileInfo) *dbEntry {
+	e := dbEntry{Timestamp: fi.ModTime()}
+	if data, err := os.ReadFile(file + metaExt); err == nil {
+		if err := e.Unmarshal(data); err != nil {
+			s.log.Error(fmt.Sprintf("invalid meta file %s: %v", file+metaExt, err))
+			e = dbEntry{Timestamp: fi.ModTime()}
+		}
+	}
+	e.Size = fi.Size()
+	return &e
+}
+
+func (s *xyzStore) Open(tile model.Tile, e *dbEntry) (io.ReadCloser, error) {
+	return os.Open(s.filename(tile))
+}
+
+func (s *xyzStore) Has(tile model.Tile) bool {
+	_, err := os.Stat(s.filename(tile))
+	return err == nil
+}
+
+func (s *xyzStore) Save(tile model.Tile, data io.Reader, e dbEntry) error {
+	file := s.filename(tile)
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// the content is written into a temporary file beside the tile, so readers never see a partial tile
+	tmpFile, err := os.CreateTemp(dir, "tile_cache_*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+	size, err := io.Copy(tmpFile, data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, file); err != nil {
+		return err
+	}
+	e.Hash = ""
+	e.Size = size
+	return s.writeMeta(file, e)
+}
+
+func (s *xyzStore) SetEntry(tile model.Tile, e dbEntry) error {
+	file := s.filename(tile)
+	if _, err := os.Stat(file); err != nil {
+		return ErrNotCached
+	}
+	return s.writeMeta(file, e)
+}
+
+func (s *xyzStore) writeMeta(file string, e dbEntry) error {
+	data, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file+metaExt, data, 0o644)
+}
+
+func (s *xyzStore) Delete(tile model.Tile) (bool, error) {
+	file := s.filename(tile)
+	if err := os.Remove(file + metaExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	err := os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *xyzStore) Walk(providerName string, fn func(tile model.Tile, e dbEntry) error) error {
+	root := s.path
+	if providerName != "" {
+		root = filepath.Join(s.path, providerName)
+	}
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(file, metaExt) || strings.HasSuffix(file, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.path, file)
+		if err != nil {
+			return err
+		}
+		tile, err := parseXYZPath(filepath.ToSlash(rel))
+		if err != nil {
+			s.log.Debug(fmt.Sprintf("skipping file %s: %v", file, err))
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(tile, *s.entry(file, fi))
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *xyzStore) Close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package tilecache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// CompressConfig configuration of the content compression of the cache
+type CompressConfig struct {
+	Uniform bool `yaml:"uniform"` // store png tiles of a single color as color marker without content file
+	PNG     bool `yaml:"png"`     // re-encode png tiles with the best compression, if they get smaller
+}
+
+// uniformTile a tile of a single color, e.g. open sea or a fully transparent tile
+type uniformTile struct {
+	Color  color.NRGBA
+	Width  int
+	Height int
+}
+
+// uniformPNGs the encoded png of the uniform tiles, a map holds only a few colors
+var uniformPNGs sync.Map
+
+func (u *uniformTile) marshal() []byte {
+	if u == nil {
+		return nil
+	}
+	data := []byte{u.Color.R, u.Color.G, u.Color.B, u.Color.A}
+	data = binary.LittleEndian.AppendUint16(data, uint16(u.Width))
+	return binary.LittleEndian.AppendUint16(data, uint16(u.Height))
+}
+
+func unmarshalUniform(data []byte) *uniformTile {
+	if len(data) != 8 {
+		return nil
+	}
+	return &uniformTile{
+		Color:  color.NRGBA{R: data[0], G: data[1], B: data[2], A: data[3]},
+		Width:  int(binary.LittleEndian.Uint16(data[4:6])),
+		Height: int(binary.LittleEndian.Uint16(data[6:8])),
+	}
+}
+
+// png the tile encoded as png
+func (u uniformTile) png() ([]byte, error) {
+	if data, ok := uniformPNGs.Load(u); ok {
+		return data.([]byte), nil
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, u.Width, u.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(u.Color), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	uniformPNGs.Store(u, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// detectUniform checks if all pixels of the image have the same color, all fully transparent
+// pixels are the same color
+func detectUniform(img image.Image) (*uniformTile, bool) {
+	b := img.Bounds()
+	if b.Empty() || b.Dx() > 0xFFFF || b.Dy() > 0xFFFF {
+		return nil, false
+	}
+	first := nrgba(img.At(b.Min.X, b.Min.Y))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if nrgba(img.At(x, y)) != first {
+				return nil, false
+			}
+		}
+	}
+	return &uniformTile{Color: first, Width: b.Dx(), Height: b.Dy()}, true
+}
+
+func nrgba(c color.Color) color.NRGBA {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A == 0 {
+		return color.NRGBA{}
+	}
+	return n
+}
+
+// compress prepares the content of a tile for saving. Uniform png tiles are returned as marker,
+// other png tiles are re-encoded with the best compression, if configured.
+func (c *Cache) compress(data []byte) ([]byte, *uniformTile) {
+	if !c.compression.Uniform && !c.compression.PNG {
+		return data, nil
+	}
+	if http.DetectContentType(data) != "image/png" {
+		return data, nil
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, nil
+	}
+	if c.compression.Uniform {
+		if u, ok := detectUniform(img); ok {
+			return nil, u
+		}
+	}
+	if c.compression.PNG {
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(&buf, img); err == nil && buf.Len() < len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+	return data, nil
+}
+
+// open opens the content of the cached tile, uniform tiles are encoded on the fly
+func (c *Cache) open(tile model.Tile, e *dbEntry) (io.ReadCloser, error) {
+	if e.Uniform != nil {
+		data, err := e.Uniform.png()
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return c.store.Open(tile, e)
+}
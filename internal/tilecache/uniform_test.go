@@ -0,0 +1,133 @@
+package tilecache
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func uniformPNG(t *testing.T, c color.Color, level png.CompressionLevel) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: level}
+	if err := enc.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectUniform(t *testing.T) {
+	ast := assert.New(t)
+	sea := color.NRGBA{R: 170, G: 211, B: 223, A: 255}
+	img, err := png.Decode(bytes.NewReader(uniformPNG(t, sea, png.DefaultCompression)))
+	ast.NoError(err)
+	u, ok := detectUniform(img)
+	ast.True(ok)
+	ast.Equal(uniformTile{Color: sea, Width: 256, Height: 256}, *u)
+
+	// all transparent pixels are equal
+	img = image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.(*image.NRGBA).Set(1, 1, color.NRGBA{R: 255})
+	u, ok = detectUniform(img)
+	ast.True(ok)
+	ast.Equal(color.NRGBA{}, u.Color)
+
+	img, err = png.Decode(bytes.NewReader(testPNG(t, color.White)))
+	ast.NoError(err)
+	_, ok = detectUniform(img)
+	ast.False(ok)
+
+	ast.Equal(u, unmarshalUniform(u.marshal()))
+	ast.Nil(unmarshalUniform((*uniformTile)(nil).marshal()))
+}
+
+func TestUniformTiles(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.compression = CompressConfig{Uniform: true}
+	sea := model.Tile{Provider: "osm", Z: 5, X: 1, Y: 1}
+	land := model.Tile{Provider: "osm", Z: 5, X: 2, Y: 1}
+	ast.NoError(c.Save(land, bytes.NewReader(testPNG(t, color.White))))
+	ast.NoError(c.Save(sea, bytes.NewReader(uniformPNG(t, color.White, png.DefaultCompression))))
+
+	e, err := c.DBGet(sea)
+	ast.NoError(err)
+	ast.NotNil(e.Uniform)
+	ast.Empty(e.Hash)
+	ast.True(c.Has(sea))
+	rd, ok := c.Tile(sea)
+	ast.True(ok)
+	data, err := io.ReadAll(rd)
+	ast.NoError(err)
+	img, err := png.Decode(bytes.NewReader(data))
+	ast.NoError(err)
+	ast.Equal(image.Rect(0, 0, 256, 256), img.Bounds())
+	ast.Equal(color.NRGBA{R: 255, G: 255, B: 255, A: 255}, color.NRGBAModel.Convert(img.At(10, 20)))
+
+	te, err := c.Entry(sea)
+	ast.NoError(err)
+	ast.Equal("#ffffffff", te.Uniform)
+
+	// uniform tiles have no content file, but aren't dangling or missing
+	res, err := c.GC()
+	ast.NoError(err)
+	ast.Equal(0, res.DanglingKeys)
+	r, err := c.Verify(false)
+	ast.NoError(err)
+	ast.True(r.OK())
+	ast.Equal(2, r.Entries)
+
+	// a uniform tile replacing a tile frees its content
+	e, err = c.DBGet(land)
+	ast.NoError(err)
+	ast.NoError(c.Save(land, bytes.NewReader(uniformPNG(t, color.Black, png.DefaultCompression))))
+	ast.Equal(0, badgerOf(c).RefCount(e.Hash))
+
+	removed, err := c.Purge(TileFilter{Provider: "osm"})
+	ast.NoError(err)
+	ast.Equal(2, removed)
+	ast.False(c.DBHas(sea))
+}
+
+func TestCompressPNG(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	c.compression = CompressConfig{PNG: true}
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for x := range 256 {
+		for y := range 256 {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y / 64), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	ast.NoError(enc.Encode(&buf, img))
+	raw := buf.Bytes()
+	tile := model.Tile{Provider: "osm", Z: 5, X: 1, Y: 1}
+	ast.NoError(c.Save(tile, bytes.NewReader(raw)))
+
+	e, err := c.DBGet(tile)
+	ast.NoError(err)
+	ast.Nil(e.Uniform)
+	ast.Less(e.Size, int64(len(raw)))
+	data, err := c.content(tile)
+	ast.NoError(err)
+	dec, err := png.Decode(bytes.NewReader(data))
+	ast.NoError(err)
+	ast.Equal(img.At(100, 200), color.NRGBAModel.Convert(dec.At(100, 200)))
+
+	// other formats are stored as they are
+	jpg := []byte("\xff\xd8\xff\xe0 not really a jpeg")
+	ast.NoError(c.Save(tile, bytes.NewReader(jpg)))
+	e, err = c.DBGet(tile)
+	ast.NoError(err)
+	ast.Equal(int64(len(jpg)), e.Size)
+}
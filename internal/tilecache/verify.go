@@ -0,0 +1,207 @@
+package tilecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // register jpeg decoder
+	_ "image/png"  // register png decoder
+	"os"
+	"path/filepath"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// VerifyReport the result of a cache verification
+type VerifyReport struct {
+	Entries     int      `json:"entries"`     // number of tile entries
+	Files       int      `json:"files"`       // number of content files
+	Valid       int      `json:"valid"`       // number of valid content files
+	Missing     []string `json:"missing"`     // tiles whose content file is missing
+	Corrupt     []string `json:"corrupt"`     // content files not matching their hash
+	Undecodable []string `json:"undecodable"` // content files which can't be decoded as image
+	Orphans     []string `json:"orphans"`     // content files without any tile
+	RefsFixed   int      `json:"refsFixed"`   // wrong reference counts
+	Repaired    bool     `json:"repaired"`    // true if the problems are repaired
+}
+
+// OK true if no problems are found
+func (r VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.Undecodable) == 0 && len(r.Orphans) == 0 && r.RefsFixed == 0
+}
+
+// Verify checks all entries and content files of the cache. Every content file is hashed again
+// and decoded as image (if the format is known). With repair broken files and their tiles,
+// orphan files and tiles without content are removed and the reference counts are corrected.
+func (s *badgerStore) Verify(repair bool) (VerifyReport, error) {
+	r := VerifyReport{
+		Missing:     make([]string, 0),
+		Corrupt:     make([]string, 0),
+		Undecodable: make([]string, 0),
+		Orphans:     make([]string, 0),
+		Repaired:    repair,
+	}
+	refs := make(map[string][]model.Tile)
+	err := s.Walk("", func(tile model.Tile, e dbEntry) error {
+		r.Entries++
+		if e.Uniform != nil {
+			// uniform tiles have no content file
+			return nil
+		}
+		refs[e.Hash] = append(refs[e.Hash], tile)
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+
+	broken := make([]string, 0)
+	seen := make(map[string]bool)
+	err = filepath.Walk(s.getTilesPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		r.Files++
+		hash := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		seen[hash] = true
+		if _, ok := refs[hash]; !ok {
+			r.Orphans = append(r.Orphans, hash)
+			return nil
+		}
+		if s.getFileHash(path) != hash {
+			r.Corrupt = append(r.Corrupt, hash)
+			broken = append(broken, hash)
+			return nil
+		}
+		if err := decodeImage(path); err != nil {
+			s.log.Debug(fmt.Sprintf("can't decode %s: %v", path, err))
+			r.Undecodable = append(r.Undecodable, hash)
+			broken = append(broken, hash)
+			return nil
+		}
+		r.Valid++
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+
+	missing := make([]model.Tile, 0)
+	for hash, tiles := range refs {
+		if !seen[hash] {
+			for _, tile := range tiles {
+				r.Missing = append(r.Missing, tile.String())
+			}
+			missing = append(missing, tiles...)
+		}
+	}
+
+	wrong, err := s.wrongRefs(refs)
+	if err != nil {
+		return r, err
+	}
+	r.RefsFixed = len(wrong)
+
+	if !repair {
+		return r, nil
+	}
+	if err := s.fixRefs(wrong); err != nil {
+		return r, err
+	}
+	for _, hash := range broken {
+		s.flock.Lock()
+		_, file := s.getFilename(hash)
+		err := os.Remove(file)
+		s.flock.Unlock()
+		if err != nil {
+			s.log.Error(fmt.Sprintf("error removing broken file %s: %v", file, err))
+		}
+		missing = append(missing, refs[hash]...)
+	}
+	for _, tile := range missing {
+		if _, err := s.deleteEntry(tile); err != nil {
+			return r, err
+		}
+	}
+	for _, hash := range r.Orphans {
+		s.removeBlob(hash)
+	}
+	return r, nil
+}
+
+// wrongRefs compares the stored reference counts with the actual ones, returns the right counts of all wrong ones
+func (s *badgerStore) wrongRefs(refs map[string][]model.Tile) (map[string]int, error) {
+	wrong := make(map[string]int)
+	stored := make(map[string]bool)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{refPrefix}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			hash := string(item.Key()[1:])
+			stored[hash] = true
+			err := item.Value(func(val []byte) error {
+				count := 0
+				if len(val) == 4 {
+					count = int(binary.LittleEndian.Uint32(val))
+				}
+				if count != len(refs[hash]) {
+					wrong[hash] = len(refs[hash])
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for hash, tiles := range refs {
+		if !stored[hash] {
+			wrong[hash] = len(tiles)
+		}
+	}
+	return wrong, err
+}
+
+func (s *badgerStore) fixRefs(refs map[string]int) error {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for hash, count := range refs {
+		var err error
+		if count == 0 {
+			err = wb.Delete(refKey(hash))
+		} else {
+			err = wb.Set(refKey(hash), binary.LittleEndian.AppendUint32(nil, uint32(count)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// decodeImage decodes the whole image, files with an unknown format are ok
+func decodeImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = image.Decode(f)
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	return err
+}
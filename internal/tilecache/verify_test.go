@@ -0,0 +1,77 @@
+package tilecache
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func testPNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := range 256 {
+		img.Set(x, x, c)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	ast := assert.New(t)
+	c := newTestCache(t)
+	valid := model.Tile{Provider: "osm", Z: 3, X: 1, Y: 1}
+	corrupt := model.Tile{Provider: "osm", Z: 3, X: 2, Y: 1}
+	truncated := model.Tile{Provider: "osm", Z: 3, X: 3, Y: 1}
+	missing := model.Tile{Provider: "osm", Z: 3, X: 4, Y: 1}
+
+	ast.NoError(c.Save(valid, bytes.NewReader(testPNG(t, color.White))))
+	ast.NoError(c.Save(corrupt, bytes.NewReader(testPNG(t, color.Black))))
+	tp := testPNG(t, color.Gray{Y: 128})
+	ast.NoError(c.Save(truncated, bytes.NewReader(tp[:len(tp)/2])))
+	ast.NoError(c.Save(missing, bytes.NewReader(testPNG(t, color.Gray{Y: 64}))))
+
+	e, _ := c.DBGet(corrupt)
+	_, file := badgerOf(c).getFilename(e.Hash)
+	ast.NoError(os.WriteFile(file, []byte("power loss"), 0o644))
+	e, _ = c.DBGet(missing)
+	_, file = badgerOf(c).getFilename(e.Hash)
+	ast.NoError(os.Remove(file))
+	orphan := strings.Repeat("cd", 32)
+	dir, file := badgerOf(c).getFilename(orphan)
+	ast.NoError(os.MkdirAll(dir, 0o755))
+	ast.NoError(os.WriteFile(file, []byte("orphan"), 0o644))
+
+	r, err := c.Verify(false)
+	ast.NoError(err)
+	ast.False(r.OK())
+	ast.Equal(4, r.Entries)
+	ast.Equal(4, r.Files)
+	ast.Equal(1, r.Valid)
+	ast.Len(r.Corrupt, 1)
+	ast.Len(r.Undecodable, 1)
+	ast.Len(r.Missing, 1)
+	ast.Equal([]string{orphan}, r.Orphans)
+
+	r, err = c.Verify(true)
+	ast.NoError(err)
+	ast.True(r.Repaired)
+	ast.True(c.DBHas(valid))
+	ast.False(c.DBHas(corrupt))
+	ast.False(c.DBHas(truncated))
+	ast.False(c.DBHas(missing))
+	ast.NoFileExists(file)
+
+	r, err = c.Verify(false)
+	ast.NoError(err)
+	ast.True(r.OK())
+	ast.Equal(1, r.Valid)
+}
@@ -0,0 +1,139 @@
+package tilecache
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
+)
+
+const (
+	// PolicyBlock the caller waits until there is room in the write queue
+	PolicyBlock = "block"
+	// PolicyDrop the tile will not be cached, if the write queue is full
+	PolicyDrop = "drop"
+
+	defaultWriterWorkers   = 4
+	defaultWriterQueueSize = 1000
+)
+
+// WriterConfig configuration of the asynchronous cache writer
+type WriterConfig struct {
+	Workers   int    `yaml:"workers"`   // number of parallel cache writers
+	QueueSize int    `yaml:"queuesize"` // max number of tiles waiting to be written
+	Policy    string `yaml:"policy"`    // block or drop, if the queue is full
+}
+
+type writeJob struct {
+	tile model.Tile
+	data []byte
+	info model.CacheInfo
+	mon  measurement.Monitor
+}
+
+// writer is a bounded queue with a fixed number of workers, saving tiles into the cache
+type writer struct {
+	log     *slog.Logger
+	save    func(tile model.Tile, data []byte, info model.CacheInfo) error
+	metrics *measurement.Service
+	policy  string
+	workers int
+
+	qlock  sync.RWMutex
+	closed bool
+	queue  chan writeJob
+	wg     sync.WaitGroup
+}
+
+func newWriter(cfg WriterConfig, metrics *measurement.Service, save func(tile model.Tile, data []byte, info model.CacheInfo) error) *writer {
+	w := &writer{
+		log:     logging.New("tilecache writer"),
+		save:    save,
+		metrics: metrics,
+		policy:  cfg.Policy,
+		workers: cfg.Workers,
+	}
+	if w.workers <= 0 {
+		w.workers = defaultWriterWorkers
+	}
+	if w.policy != PolicyDrop {
+		w.policy = PolicyBlock
+	}
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = defaultWriterQueueSize
+	}
+	w.queue = make(chan writeJob, size)
+	return w
+}
+
+func (w *writer) start() {
+	for range w.workers {
+		w.wg.Go(func() {
+			for j := range w.queue {
+				j.mon.Stop()
+				td := w.metrics.Start("saveTileToCache")
+				err := w.save(j.tile, j.data, j.info)
+				if err != nil {
+					td.SetError()
+					w.log.Error(fmt.Sprintf("error saving tile to cache: %v", err))
+				}
+				td.Stop()
+			}
+		})
+	}
+}
+
+// enqueue adds a tile to the write queue, returns false if the tile was dropped
+func (w *writer) enqueue(tile model.Tile, data []byte, info model.CacheInfo) bool {
+	w.qlock.RLock()
+	defer w.qlock.RUnlock()
+	if w.closed {
+		w.drop(tile, "writer closed")
+		return false
+	}
+	j := writeJob{
+		tile: tile,
+		data: data,
+		info: info,
+		mon:  w.metrics.Start("cacheWriteQueue"),
+	}
+	if w.policy == PolicyDrop {
+		select {
+		case w.queue <- j:
+			return true
+		default:
+			j.mon.Stop()
+			w.drop(tile, "queue full")
+			return false
+		}
+	}
+	w.queue <- j
+	return true
+}
+
+func (w *writer) drop(tile model.Tile, reason string) {
+	w.metrics.Point("cacheWriteDropped").Inc(1)
+	w.log.Debug(fmt.Sprintf("dropped cache write (%s): %s", reason, tile.String()))
+}
+
+// depth returns the number of tiles waiting in the queue
+func (w *writer) depth() int {
+	return len(w.queue)
+}
+
+// flush closes the queue and waits until all queued tiles are written
+func (w *writer) flush() {
+	w.qlock.Lock()
+	if w.closed {
+		w.qlock.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.qlock.Unlock()
+	w.wg.Wait()
+}
@@ -0,0 +1,47 @@
+package tilecache
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
+)
+
+func TestWriterFlush(t *testing.T) {
+	ast := assert.New(t)
+	var saved atomic.Int32
+	w := newWriter(WriterConfig{Workers: 2, QueueSize: 10}, measurement.New(true), func(tile model.Tile, data []byte, info model.CacheInfo) error {
+		saved.Add(1)
+		return nil
+	})
+	w.start()
+	for x := range 100 {
+		ast.True(w.enqueue(model.Tile{Provider: "gebco", Z: 7, X: x, Y: 1}, []byte("tile"), model.CacheInfo{}))
+	}
+	w.flush()
+	ast.Equal(int32(100), saved.Load())
+	ast.False(w.enqueue(model.Tile{Provider: "gebco", Z: 7, X: 1, Y: 1}, []byte("tile"), model.CacheInfo{}))
+}
+
+func TestWriterDrop(t *testing.T) {
+	ast := assert.New(t)
+	metrics := measurement.New(true)
+	release := make(chan struct{})
+	w := newWriter(WriterConfig{Workers: 1, QueueSize: 2, Policy: PolicyDrop}, metrics, func(tile model.Tile, data []byte, info model.CacheInfo) error {
+		<-release
+		return nil
+	})
+	// no workers started, so the queue will not be drained
+	ast.True(w.enqueue(model.Tile{Provider: "gebco", Z: 7, X: 1, Y: 1}, []byte("tile"), model.CacheInfo{}))
+	ast.True(w.enqueue(model.Tile{Provider: "gebco", Z: 7, X: 2, Y: 1}, []byte("tile"), model.CacheInfo{}))
+	ast.False(w.enqueue(model.Tile{Provider: "gebco", Z: 7, X: 3, Y: 1}, []byte("tile"), model.CacheInfo{}))
+	ast.Equal(2, w.depth())
+	ast.Equal(1, metrics.Point("cacheWriteDropped").Data().Count)
+
+	w.start()
+	close(release)
+	w.flush()
+	ast.Equal(0, w.depth())
+}
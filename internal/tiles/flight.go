@@ -0,0 +1,56 @@
+package tiles
+
+import (
+	"sync"
+
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+// call is a single in-flight tile request, all waiters share the result
+type call struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+	dups int
+}
+
+// flightGroup coalesces concurrent requests for the same tile, so only one upstream fetch is done
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[model.Tile]*call
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[model.Tile]*call),
+	}
+}
+
+// Do executes fn for the given tile, if there is already a call for this tile in flight,
+// Do waits for that call and returns its result. shared is true, if the result was given to more than one caller.
+func (g *flightGroup) Do(tile model.Tile, fn func() ([]byte, error)) (data []byte, shared bool, err error) {
+	g.mu.Lock()
+	if c, ok := g.calls[tile]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.data, true, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[tile] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, tile)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.data, c.err = fn()
+
+	g.mu.Lock()
+	shared = c.dups > 0
+	g.mu.Unlock()
+	return c.data, shared, c.err
+}
@@ -0,0 +1,72 @@
+package tiles
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/model"
+)
+
+func TestFlightCoalescing(t *testing.T) {
+	ast := assert.New(t)
+	g := newFlightGroup()
+	tile := model.Tile{Provider: "gebco", Z: 3, X: 1, Y: 2}
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("tile"), nil
+	}
+	// waiting counts the callers waiting for the call in flight
+	waiting := func() int {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if c, ok := g.calls[tile]; ok {
+			return c.dups
+		}
+		return 0
+	}
+
+	wg := sync.WaitGroup{}
+	for range 10 {
+		wg.Go(func() {
+			data, _, err := g.Do(tile, fn)
+			ast.NoError(err)
+			ast.Equal([]byte("tile"), data)
+		})
+	}
+	// the fetch is blocked until all other callers have entered Do
+	for waiting() < 9 {
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	ast.Equal(int32(1), calls.Load())
+	ast.Empty(g.calls)
+}
+
+func TestFlightError(t *testing.T) {
+	ast := assert.New(t)
+	g := newFlightGroup()
+	tile := model.Tile{Provider: "gebco", Z: 3, X: 1, Y: 2}
+	errTest := errors.New("upstream error")
+
+	_, shared, err := g.Do(tile, func() ([]byte, error) {
+		return nil, errTest
+	})
+	ast.ErrorIs(err, errTest)
+	ast.False(shared)
+
+	data, _, err := g.Do(tile, func() ([]byte, error) {
+		return []byte("tile"), nil
+	})
+	ast.NoError(err)
+	ast.Equal([]byte("tile"), data)
+}
@@ -3,13 +3,17 @@ package tiles
 // This service implements the tile service business logic to get tiles from providers and cache them if needed
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"sync"
 
 	"github.com/samber/do/v2"
+	"github.com/willie68/go_mapproxy/internal/assets"
 	"github.com/willie68/go_mapproxy/internal/logging"
 	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/offline"
 	"github.com/willie68/go_mapproxy/internal/provider"
 	"github.com/willie68/go_mapproxy/internal/utils/measurement"
 )
@@ -18,12 +22,21 @@ type providerFactory interface {
 	HasProvider(providerName string) bool
 	IsCached(providerName string) bool
 	IsPrefetchable(providerName string) bool
+	IsLocal(providerName string) bool
+	Host(providerName string) string
 }
 
 type tileCache interface {
 	Tile(tile model.Tile) (io.ReadCloser, bool)
-	Save(tile model.Tile, data io.Reader) error
+	StaleTile(tile model.Tile) (io.ReadCloser, bool)
+	StaleWhileRevalidate() bool
+	StaleOnError() bool
+	SaveAsync(tile model.Tile, data []byte, info model.CacheInfo) bool
+	CacheInfo(tile model.Tile) (model.CacheInfo, bool)
+	Refresh(tile model.Tile, info model.CacheInfo) error
 	IsActive() bool
+	Miss(tile model.Tile) (model.MissStatus, bool)
+	SaveMiss(tile model.Tile, status model.MissStatus)
 }
 
 type service struct {
@@ -32,6 +45,10 @@ type service struct {
 	cache   tileCache
 	tssf    providerFactory
 	metrics *measurement.Service
+	offline *offline.Service
+	flight  *flightGroup
+	// tiles with a running background refresh
+	refreshing sync.Map
 }
 
 func Init(inj do.Injector) {
@@ -41,6 +58,8 @@ func Init(inj do.Injector) {
 		cache:   do.MustInvokeAs[tileCache](inj),
 		tssf:    do.MustInvokeAs[providerFactory](inj),
 		metrics: do.MustInvoke[*measurement.Service](inj),
+		offline: do.MustInvoke[*offline.Service](inj),
+		flight:  newFlightGroup(),
 	})
 }
 
@@ -48,6 +67,7 @@ func (s *service) FTile(tile model.Tile) (io.ReadCloser, error) {
 	if !s.HasProvider(tile.Provider) {
 		return nil, provider.ErrNotFound
 	}
+	isOffline := s.isOffline(tile.Provider)
 
 	if s.IsCached(tile.Provider) {
 		td := s.metrics.Start("getTileFromCache")
@@ -57,47 +77,185 @@ func (s *service) FTile(tile model.Tile) (io.ReadCloser, error) {
 			return tr, nil
 		}
 		td.Stop()
+		if isOffline || s.cache.StaleWhileRevalidate() {
+			if tr, ok := s.cache.StaleTile(tile); ok {
+				s.log.Debug(fmt.Sprintf("stale tile found in cache, refreshing: %s", tile.String()))
+				s.metrics.Point("serveStaleTile").Inc(1)
+				if !isOffline {
+					s.refresh(tile)
+				}
+				return tr, nil
+			}
+		}
+	}
+
+	if isOffline {
+		s.log.Debug(fmt.Sprintf("offline, tile not in cache: %s", tile.String()))
+		s.metrics.Point("offlineMiss").Inc(1)
+		return s.offline.Placeholder(), nil
+	}
+
+	if s.IsCached(tile.Provider) {
+		if status, ok := s.cache.Miss(tile); ok {
+			s.log.Debug(fmt.Sprintf("tile missing at the upstream (%s): %s", status.String(), tile.String()))
+			return s.missing(tile, status, fmt.Errorf("upstream error on %s, retrying later", tile.String()))
+		}
 	}
 
+	data, shared, err := s.flight.Do(tile, func() ([]byte, error) {
+		return s.fetchTile(tile)
+	})
+	if errors.Is(err, provider.ErrTileNotFound) {
+		return s.missing(tile, model.MissNotFound, err)
+	}
+	if err != nil {
+		return s.missing(tile, model.MissError, err)
+	}
+	if shared {
+		s.log.Debug(fmt.Sprintf("tile request coalesced: %s", tile.String()))
+	}
+	if len(data) == 0 {
+		return s.missing(tile, model.MissEmpty, nil)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// isOffline true if no upstream request should be done for the provider, local providers (mbtiles)
+// are always available
+func (s *service) isOffline(providerName string) bool {
+	return s.offline.IsOffline(providerName) && !s.tssf.IsLocal(providerName)
+}
+
+// Refetch fetches the tile from the upstream, even if the cached tile is fresh, and updates the cache.
+// If the upstream tile is unchanged, only the cache entry is revalidated.
+func (s *service) Refetch(tile model.Tile) (io.ReadCloser, error) {
+	if !s.HasProvider(tile.Provider) {
+		return nil, provider.ErrNotFound
+	}
+	if s.isOffline(tile.Provider) {
+		return nil, fmt.Errorf("provider %s is offline", tile.Provider)
+	}
+	data, _, err := s.flight.Do(tile, func() ([]byte, error) {
+		return s.fetchTile(tile)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// missing answers a request of a tile missing at the upstream, not found and empty tiles are served
+// as empty tile, on errors a stale tile is served if configured, otherwise the error is returned
+func (s *service) missing(tile model.Tile, status model.MissStatus, err error) (io.ReadCloser, error) {
+	if status != model.MissError {
+		return assets.EmptyPNG(), nil
+	}
+	if s.IsCached(tile.Provider) && s.cache.StaleOnError() {
+		if tr, ok := s.cache.StaleTile(tile); ok {
+			s.log.Warn(fmt.Sprintf("upstream error, serving stale tile: %s", tile.String()))
+			s.metrics.Point("serveStaleTile").Inc(1)
+			return tr, nil
+		}
+	}
+	return nil, err
+}
+
+// refresh fetches the tile in the background, only one refresh per tile is running
+func (s *service) refresh(tile model.Tile) {
+	if _, running := s.refreshing.LoadOrStore(tile, true); running {
+		return
+	}
+	go func() {
+		defer s.refreshing.Delete(tile)
+		_, _, err := s.flight.Do(tile, func() ([]byte, error) {
+			return s.fetchTile(tile)
+		})
+		if err != nil {
+			s.log.Error(fmt.Sprintf("error refreshing stale tile %s: %v", tile.String(), err))
+		}
+	}()
+}
+
+// fetchTile gets the tile from the provider and saves it into the cache, if needed.
+// Only one fetchTile per tile is running at the same time, see flightGroup.
+func (s *service) fetchTile(tile model.Tile) ([]byte, error) {
 	ts, err := do.InvokeNamed[provider.Service](s.inj, tile.Provider)
 	if err != nil {
 		s.log.Error(fmt.Sprintf("System error: %v", err))
 		return nil, err
 	}
 
+	cached := s.IsCached(tile.Provider) && s.cache.IsActive()
+	info := model.CacheInfo{}
+	revalidate := false
+	if cached {
+		info, revalidate = s.cache.CacheInfo(tile)
+	}
+
 	td := s.metrics.Start("getTileFromProvider")
 	tsd := s.metrics.Start(fmt.Sprintf("getTileFromProvider:%s", tile.Provider))
-	rd, err := ts.Tile(tile)
+	var rd io.ReadCloser
+	if cs, ok := ts.(provider.ConditionalService); ok {
+		rd, info, err = cs.ConditionalTile(tile, info)
+	} else {
+		rd, err = ts.Tile(tile)
+	}
+	if revalidate && errors.Is(err, provider.ErrNotModified) {
+		tsd.Stop()
+		td.Stop()
+		s.log.Debug(fmt.Sprintf("tile not modified: %s", tile.String()))
+		return s.revalidated(tile, info)
+	}
 	if err != nil {
+		tsd.Stop()
+		td.Stop()
 		s.log.Error(fmt.Sprintf("error getting tile from tileserver: %v", err))
+		if cached {
+			s.cache.SaveMiss(tile, missStatus(err))
+		}
 		return nil, err
 	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
 	tsd.Stop()
 	td.Stop()
+	if err != nil {
+		if cached {
+			s.cache.SaveMiss(tile, model.MissError)
+		}
+		return nil, err
+	}
 
-	if s.IsCached(tile.Provider) {
-		if !s.cache.IsActive() {
-			return rd, nil
+	if cached {
+		if len(data) == 0 {
+			s.cache.SaveMiss(tile, model.MissEmpty)
+		} else {
+			s.cache.SaveAsync(tile, data, info)
 		}
 	}
+	return data, nil
+}
 
-	data, err := io.ReadAll(rd)
+// missStatus the negative caching status of an upstream error
+func missStatus(err error) model.MissStatus {
+	if errors.Is(err, provider.ErrTileNotFound) {
+		return model.MissNotFound
+	}
+	return model.MissError
+}
+
+// revalidated refreshes the stale cache entry after the upstream answered with not modified and reads the cached tile
+func (s *service) revalidated(tile model.Tile, info model.CacheInfo) ([]byte, error) {
+	err := s.cache.Refresh(tile, info)
 	if err != nil {
 		return nil, err
 	}
-	if s.IsCached(tile.Provider) {
-		go func() {
-			rd = io.NopCloser(bytes.NewReader(data))
-			td := s.metrics.Start("saveTileToCache")
-			defer td.Stop()
-			err = s.cache.Save(tile, rd)
-			if err != nil {
-				s.log.Error(fmt.Sprintf("error saving tile to cache: %v", err))
-			}
-		}()
+	rd, ok := s.cache.Tile(tile)
+	if !ok {
+		return nil, fmt.Errorf("revalidated tile not in cache: %s", tile.String())
 	}
-	rd = io.NopCloser(bytes.NewReader(data))
-	return rd, nil
+	defer rd.Close()
+	return io.ReadAll(rd)
 }
 
 func (s *service) HasProvider(providerName string) bool {
@@ -108,6 +266,22 @@ func (s *service) IsCached(providerName string) bool {
 	return s.tssf.IsCached(providerName)
 }
 
-func (s *service) IsPrefetchable(providerName string) bool {
-	return s.cache.IsActive() && s.tssf.IsCached(providerName) && s.tssf.IsPrefetchable(providerName)
+// CheckPrefetch returns the reason, why the tiles of the provider can't be prefetched, nil if they can
+func (s *service) CheckPrefetch(providerName string) error {
+	switch {
+	case !s.HasProvider(providerName):
+		return provider.ErrNotFound
+	case !s.cache.IsActive():
+		return errors.New("the cache is not active")
+	case !s.tssf.IsCached(providerName):
+		return errors.New("caching is disabled for the provider (nocache)")
+	case !s.tssf.IsPrefetchable(providerName):
+		return errors.New("prefetching is disabled for the provider (noprefetch)")
+	}
+	return nil
+}
+
+// Host the host of the upstream of the provider, empty for local providers
+func (s *service) Host(providerName string) string {
+	return s.tssf.Host(providerName)
 }
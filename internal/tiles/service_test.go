@@ -0,0 +1,224 @@
+package tiles
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samber/do/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/willie68/go_mapproxy/internal/logging"
+	"github.com/willie68/go_mapproxy/internal/model"
+	"github.com/willie68/go_mapproxy/internal/offline"
+	"github.com/willie68/go_mapproxy/internal/provider"
+	"github.com/willie68/go_mapproxy/internal/utils/measurement"
+)
+
+// fakeCache a tile cache with only stale tiles
+type fakeCache struct {
+	flock  sync.Mutex
+	stale  map[model.Tile]string
+	saved  map[model.Tile]string
+	swr    bool
+	onErr  bool
+	misses int
+}
+
+func (c *fakeCache) Tile(tile model.Tile) (io.ReadCloser, bool) { return nil, false }
+
+func (c *fakeCache) StaleTile(tile model.Tile) (io.ReadCloser, bool) {
+	c.flock.Lock()
+	defer c.flock.Unlock()
+	data, ok := c.stale[tile]
+	if !ok {
+		return nil, false
+	}
+	return io.NopCloser(strings.NewReader(data)), true
+}
+
+func (c *fakeCache) StaleWhileRevalidate() bool { return c.swr }
+func (c *fakeCache) StaleOnError() bool         { return c.onErr }
+
+func (c *fakeCache) SaveAsync(tile model.Tile, data []byte, info model.CacheInfo) bool {
+	c.flock.Lock()
+	defer c.flock.Unlock()
+	c.saved[tile] = string(data)
+	return true
+}
+
+func (c *fakeCache) CacheInfo(tile model.Tile) (model.CacheInfo, bool) {
+	return model.CacheInfo{}, false
+}
+func (c *fakeCache) Refresh(tile model.Tile, info model.CacheInfo) error { return nil }
+func (c *fakeCache) IsActive() bool                                      { return true }
+func (c *fakeCache) Miss(tile model.Tile) (model.MissStatus, bool)       { return 0, false }
+
+func (c *fakeCache) SaveMiss(tile model.Tile, status model.MissStatus) {
+	c.flock.Lock()
+	defer c.flock.Unlock()
+	c.misses++
+}
+
+func (c *fakeCache) savedTile(tile model.Tile) (string, bool) {
+	c.flock.Lock()
+	defer c.flock.Unlock()
+	data, ok := c.saved[tile]
+	return data, ok
+}
+
+// fakeFactory a factory with cached http providers, or local providers with local
+type fakeFactory struct {
+	local bool
+}
+
+func (f fakeFactory) HasProvider(providerName string) bool    { return true }
+func (f fakeFactory) IsCached(providerName string) bool       { return true }
+func (f fakeFactory) IsPrefetchable(providerName string) bool { return true }
+func (f fakeFactory) IsLocal(providerName string) bool        { return f.local }
+func (f fakeFactory) Host(providerName string) string         { return "example.com" }
+
+// fakeUpstream a provider, Tile blocks while the gate is closed
+type fakeUpstream struct {
+	calls atomic.Int32
+	gate  chan struct{}
+	err   error
+}
+
+func (u *fakeUpstream) Tile(tile model.Tile) (io.ReadCloser, error) {
+	u.calls.Add(1)
+	if u.gate != nil {
+		<-u.gate
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	return io.NopCloser(strings.NewReader("fresh")), nil
+}
+
+var staleTile = model.Tile{Provider: "osm", Z: 3, X: 1, Y: 2}
+
+func newTestService(c *fakeCache, u *fakeUpstream) *service {
+	inj := do.New()
+	var ps provider.Service = u
+	do.ProvideNamedValue(inj, staleTile.Provider, ps)
+	c.stale = map[model.Tile]string{staleTile: "stale"}
+	c.saved = make(map[model.Tile]string)
+	return &service{
+		inj:     inj,
+		log:     logging.New("tiles"),
+		cache:   c,
+		tssf:    fakeFactory{},
+		metrics: measurement.New(false),
+		offline: &offline.Service{},
+		flight:  newFlightGroup(),
+	}
+}
+
+func readTile(ast *assert.Assertions, rd io.ReadCloser) string {
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	ast.NoError(err)
+	return string(data)
+}
+
+// waitRefreshed waits until no background refresh is running
+func waitRefreshed(s *service) {
+	for range 200 {
+		running := false
+		s.refreshing.Range(func(key, value any) bool {
+			running = true
+			return false
+		})
+		if !running {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	ast := assert.New(t)
+	c := &fakeCache{swr: true}
+	u := &fakeUpstream{}
+	s := newTestService(c, u)
+
+	rd, err := s.FTile(staleTile)
+	ast.NoError(err)
+	ast.Equal("stale", readTile(ast, rd))
+
+	waitRefreshed(s)
+	ast.Equal(int32(1), u.calls.Load())
+	data, ok := c.savedTile(staleTile)
+	ast.True(ok)
+	ast.Equal("fresh", data)
+}
+
+func TestStaleRefreshDeduplicated(t *testing.T) {
+	ast := assert.New(t)
+	c := &fakeCache{swr: true}
+	u := &fakeUpstream{gate: make(chan struct{})}
+	s := newTestService(c, u)
+
+	// the refresh started by the first request is still running for the others
+	for range 5 {
+		rd, err := s.FTile(staleTile)
+		ast.NoError(err)
+		ast.Equal("stale", readTile(ast, rd))
+	}
+	close(u.gate)
+	waitRefreshed(s)
+	ast.Equal(int32(1), u.calls.Load())
+}
+
+func TestStaleOnError(t *testing.T) {
+	ast := assert.New(t)
+	errUpstream := errors.New("upstream error")
+	c := &fakeCache{onErr: true}
+	u := &fakeUpstream{err: errUpstream}
+	s := newTestService(c, u)
+
+	rd, err := s.FTile(staleTile)
+	ast.NoError(err)
+	ast.Equal("stale", readTile(ast, rd))
+	ast.Equal(int32(1), u.calls.Load())
+	ast.Equal(1, c.misses)
+
+	// without stale on error the upstream error is returned
+	c = &fakeCache{}
+	s = newTestService(c, u)
+	_, err = s.FTile(staleTile)
+	ast.ErrorIs(err, errUpstream)
+	ast.Equal(int32(2), u.calls.Load())
+}
+
+// fakeConfig the config of the offline service
+type fakeConfig struct {
+	offline bool
+}
+
+func (c fakeConfig) GetOfflineConfig() offline.Config      { return offline.Config{Active: c.offline} }
+func (c fakeConfig) GetProviderConfig() provider.ConfigMap { return provider.ConfigMap{} }
+
+func TestRefetchOffline(t *testing.T) {
+	ast := assert.New(t)
+	u := &fakeUpstream{}
+	s := newTestService(&fakeCache{}, u)
+	do.ProvideValue(s.inj, fakeConfig{offline: true})
+	offline.Init(s.inj)
+	s.offline = do.MustInvoke[*offline.Service](s.inj)
+
+	_, err := s.Refetch(staleTile)
+	ast.ErrorContains(err, "offline")
+	ast.Equal(int32(0), u.calls.Load())
+
+	// local providers are always available
+	s.tssf = fakeFactory{local: true}
+	rd, err := s.Refetch(staleTile)
+	ast.NoError(err)
+	ast.Equal("fresh", readTile(ast, rd))
+	ast.Equal(int32(1), u.calls.Load())
+}
@@ -20,6 +20,7 @@ type Data struct {
 	Total      int64  `json:"total"`
 	Count      int    `json:"count"`
 	ErrorCount int    `json:"errorCount"`
+	Active     int    `json:"active"`
 	MaxActive  int    `json:"maxActive"`
 }
 
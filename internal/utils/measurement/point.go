@@ -106,6 +106,7 @@ func (p *Point) Data() Data {
 		Total:      p.calcTime(p.total),
 		Count:      p.count,
 		ErrorCount: p.errorCount,
+		Active:     p.active,
 		MaxActive:  p.maxActive,
 	}
 }
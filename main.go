@@ -26,6 +26,18 @@ var (
 	pfZoom      int
 	pfProviders string
 	port        int
+	offlineMode bool
+	repair      bool
+	reportFile  string
+	minZoom     int
+	maxZoom     int
+	bbox        string
+	tms         bool
+	areaFile    string
+	route       string
+	buffer      string
+	dryRun      bool
+	maxFailed   string
 	inj         do.Injector
 )
 
@@ -34,10 +46,22 @@ func init() {
 	flag.BoolVarP(&showVersion, "version", "v", false, "showing the version")
 	flag.StringVarP(&configFile, "config", "c", "config.yaml", "this is the path and filename to the config file")
 	flag.IntVarP(&port, "port", "p", 0, "overwrite the port (8580) of the config")
+	flag.BoolVarP(&offlineMode, "offline", "o", false, "start in offline mode, only cached and local tiles will be served")
+	flag.BoolVar(&repair, "repair", false, "cache verify: repair the found problems")
+	flag.StringVar(&reportFile, "report", "", "cache verify, seed: write the json report into this file instead of stdout")
+	flag.IntVar(&minZoom, "minzoom", 0, "prefetch, cache export/import: min zoom of the tiles")
+	flag.IntVar(&maxZoom, "maxzoom", 0, "cache export/import: max zoom of the tiles, 0 for all")
+	flag.StringVarP(&bbox, "bbox", "b", "", "prefetch, cache export/import: only tiles in this bbox west,south,east,north (in degrees)")
+	flag.StringVar(&areaFile, "area-file", "", "prefetch: only tiles in the polygons of this GeoJSON file")
+	flag.StringVar(&route, "route", "", "prefetch: only tiles along the route of this GPX or GeoJSON (linestring) file")
+	flag.StringVar(&buffer, "buffer", "5nm", "prefetch: width of the route corridor on each side, e.g. 5nm or 10km")
+	flag.BoolVar(&dryRun, "dry-run", false, "prefetch: only estimate the number of tiles, the disk usage and the duration, writes a json report")
+	flag.StringVar(&maxFailed, "max-failed", "0", "seed: exit with code 1 if more tiles failed, a number of tiles or a percentage like 1%")
+	flag.BoolVar(&tms, "tms", false, "cache import: the rows of the tile directory are in TMS order (y flipped)")
 	flag.IntVarP(&pfZoom, "zoom", "z", 0, "max zoom for prefetch tiles")
 	flag.StringVarP(&pfProviders, "system", "s", "", "prefetch system, if empty no prefetching will be done, csv if more than one needed.")
 	flag.Usage = func() {
-		fmt.Printf("Usage of %s:\n", os.Args[0])
+		fmt.Printf("Usage of %s: [flags] [command]\n", os.Args[0])
 		fmt.Println("more on https://github.com/willie68/go_mapproxy")
 		flag.PrintDefaults()
 		fmt.Println()
@@ -48,6 +72,23 @@ func init() {
 		fmt.Printf("%s -c config.yaml\n", os.Args[0])
 		fmt.Println("run as proxy with caching and prefetching zomm 5: take the default config, add your needed provider,switch caching to true and set a path. Than run")
 		fmt.Printf("%s -c config.yaml -s <your provider to be cached> -z 4\n", os.Args[0])
+		fmt.Println("prefetch only a region in the zoom levels 8 to 14, given by a bbox or the polygons of a GeoJSON file")
+		fmt.Printf("%s -c config.yaml -s <your provider to be cached> --minzoom 8 -z 14 -b 7.0,50.0,8.0,51.0\n", os.Args[0])
+		fmt.Printf("%s -c config.yaml -s <your provider to be cached> --minzoom 8 -z 14 --area-file area.geojson\n", os.Args[0])
+		fmt.Println("prefetch the corridor along a planned route, 3 nautical miles on each side")
+		fmt.Printf("%s -c config.yaml -s <your provider to be cached> --minzoom 8 -z 16 --route passage.gpx --buffer 3nm\n", os.Args[0])
+		fmt.Println("estimate the number of tiles, the disk usage and the duration of a prefetch without downloading it")
+		fmt.Printf("%s -c config.yaml -s <your provider to be cached> --minzoom 8 -z 14 -b 7.0,50.0,8.0,51.0 --dry-run\n", os.Args[0])
+		fmt.Println()
+		fmt.Println("commands:")
+		fmt.Println("cache verify: verify the cache (server must be stopped), writes a json report, repair with --repair")
+		fmt.Printf("%s -c config.yaml cache verify --repair --report report.json\n", os.Args[0])
+		fmt.Println("cache export <provider> <file>: export the cached tiles of the provider into a MBTiles file (server must be stopped)")
+		fmt.Printf("%s -c config.yaml cache export osm osm.mbtiles --minzoom 5 --maxzoom 14 -b 7.0,50.0,8.0,51.0\n", os.Args[0])
+		fmt.Println("cache import <provider> <source>: import a MBTiles file or a z/x/y tile directory into the cache of the provider (server must be stopped)")
+		fmt.Printf("%s -c config.yaml cache import osm osm.mbtiles --maxzoom 14\n", os.Args[0])
+		fmt.Println("seed: run the prefetch job of the command line, or the jobs of the config, without starting the server and exit when finished")
+		fmt.Printf("%s -c config.yaml seed -s <your provider to be cached> --minzoom 8 -z 14 -b 7.0,50.0,8.0,51.0 --max-failed 1%%\n", os.Args[0])
 	}
 }
 
@@ -71,7 +112,8 @@ func main() {
 		panic(err)
 	}
 
-	config.SetParameter(config.WithPort(port))
+	config.SetParameter(config.WithPort(port), config.WithOffline(offlineMode))
+	runCommand(flag.Args())
 	js := config.JSON()
 	if js == "" {
 		panic("error on marshal config to json")
@@ -82,7 +124,13 @@ func main() {
 
 	internal.Init(inj)
 
-	prefetch.Prefetch(pfProviders, pfZoom)
+	job := cmdJob()
+	if dryRun {
+		os.Exit(prefetchEstimate(job))
+	}
+	prefetch.RestoreJobs()
+	prefetch.Prefetch(job)
+	prefetch.PrefetchJobs()
 
 	router, err := api.APIRoutes(inj)
 	if err != nil {